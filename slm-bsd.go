@@ -1,3 +1,4 @@
+//go:build openbsd || freebsd
 // +build openbsd freebsd
 
 // slm_bsd.go
@@ -17,9 +18,10 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
-	"github.com/mischief/ndb"
 	pledge "github.com/kr/pledge"
+	"github.com/mischief/ndb"
 )
 
 const (
@@ -81,7 +83,9 @@ func main() {
 	if opts.SysPrompt != "" {
 		msgs = append(msgs, Message{"system", opts.SysPrompt})
 	}
-	msgs = append(msgs, Message{"user", opts.UserPrompt})
+	if strings.TrimSpace(opts.UserPrompt) != "" {
+		msgs = append(msgs, Message{"user", opts.UserPrompt})
+	}
 
 	reply, err := sendChat(opts, msgs)
 	if err != nil {
@@ -116,6 +120,11 @@ func parseFlags() *Opts {
 		}
 		userp = string(data)
 	}
+	if emptyPrompt(userp, *sysp) {
+		fmt.Fprintln(os.Stderr, "[ERROR] empty prompt")
+		flag.Usage()
+		os.Exit(2)
+	}
 
 	return &Opts{
 		Model:      *model,
@@ -127,6 +136,12 @@ func parseFlags() *Opts {
 	}
 }
 
+// emptyPrompt is true when there is nothing to send: a blank prompt
+// (an empty pipe, say) and no system prompt to go on.
+func emptyPrompt(userp, sysp string) bool {
+	return strings.TrimSpace(userp) == "" && strings.TrimSpace(sysp) == ""
+}
+
 func histDir() string {
 	confDir, err := os.UserConfigDir()
 	if err != nil {
@@ -209,7 +224,9 @@ func sendChat(opts *Opts, msgs []Message) (string, error) {
 	}
 
 	var errResp struct {
-		Error struct { Message string `json:"message"` } `json:"error"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
 	}
 	if err := json.Unmarshal(bodyBytes, &errResp); err == nil && errResp.Error.Message != "" {
 		return "", fmt.Errorf("OpenAI API error: %s", errResp.Error.Message)
@@ -224,4 +241,3 @@ func sendChat(opts *Opts, msgs []Message) (string, error) {
 	}
 	return cres.Choices[0].Message.Content, nil
 }
-
@@ -13,6 +13,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/mischief/ndb"
 )
@@ -64,7 +65,9 @@ func main() {
 	if opts.SysPrompt != "" {
 		msgs = append(msgs, Message{"system", opts.SysPrompt})
 	}
-	msgs = append(msgs, Message{"user", opts.UserPrompt})
+	if strings.TrimSpace(opts.UserPrompt) != "" {
+		msgs = append(msgs, Message{"user", opts.UserPrompt})
+	}
 
 	reply, err := sendChat(opts, msgs)
 	if err != nil {
@@ -99,6 +102,11 @@ func parseFlags() *Opts {
 		}
 		userp = string(data)
 	}
+	if emptyPrompt(userp, *sysp) {
+		fmt.Fprintln(os.Stderr, "[ERROR] empty prompt")
+		flag.Usage()
+		os.Exit(2)
+	}
 
 	return &Opts{
 		Model:      *model,
@@ -110,6 +118,12 @@ func parseFlags() *Opts {
 	}
 }
 
+// emptyPrompt is true when there is nothing to send: a blank prompt
+// (an empty pipe, say) and no system prompt to go on.
+func emptyPrompt(userp, sysp string) bool {
+	return strings.TrimSpace(userp) == "" && strings.TrimSpace(sysp) == ""
+}
+
 func histDir() string {
 	confDir, err := os.UserConfigDir()
 	if err != nil {
@@ -195,7 +209,9 @@ func sendChat(opts *Opts, msgs []Message) (string, error) {
 
 	// Check for API-level errors in JSON
 	var errResp struct {
-		Error struct { Message string `json:"message"` } `json:"error"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
 	}
 	if err := json.Unmarshal(bodyBytes, &errResp); err == nil && errResp.Error.Message != "" {
 		return "", fmt.Errorf("OpenAI API error: %s", errResp.Error.Message)
@@ -211,4 +227,3 @@ func sendChat(opts *Opts, msgs []Message) (string, error) {
 	}
 	return cres.Choices[0].Message.Content, nil
 }
-
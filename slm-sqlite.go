@@ -0,0 +1,189 @@
+//go:build sqlite
+
+// slm-sqlite.go
+// slm: optional SQLite history store for slm.go
+// Build with: go build -tags sqlite slm.go slm-sqlite.go
+// Uses modernc.org/sqlite, required in go.mod; it has no plan9 port,
+// so this is for the unix hosts slm.go is built on.
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	SQLITEEXT = ".db"
+)
+
+const sqliteschema = `
+create table if not exists sessions (
+	id      integer primary key,
+	name    text not null unique,
+	created text not null
+);
+create table if not exists messages (
+	id                integer primary key,
+	session           integer not null references sessions(id),
+	role              text not null,
+	content           text not null,
+	time              text not null,
+	prompt_tokens     integer not null default 0,
+	completion_tokens integer not null default 0,
+	fingerprint       text not null default ''
+);
+create index if not exists messages_session on messages(session, id);
+`
+
+type sqlitestore struct {
+	db      *sql.DB
+	session int64
+}
+
+func init() {
+	histstores["sqlite"] = storetype{SQLITEEXT, opensqlite}
+}
+
+func opensqlite(path string) (HistoryStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteschema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// a database per session, like the other stores, named for it
+	name := strings.TrimSuffix(filepath.Base(path), SQLITEEXT)
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err = db.Exec("insert or ignore into sessions(name, created) values(?, ?)", name, now)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &sqlitestore{db: db}
+	if err := db.QueryRow("select id from sessions where name = ?", name).Scan(&s.session); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := s.addfingerprint(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.migrate(path); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// addfingerprint adds the fingerprint column to a database made
+// before messages had one.
+func (s *sqlitestore) addfingerprint() error {
+	rows, err := s.db.Query("select name from pragma_table_info('messages')")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return err
+		}
+		if col == "fingerprint" {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = s.db.Exec("alter table messages add column fingerprint text not null default ''")
+	return err
+}
+
+// migrate seeds an empty database from the ndb history that sits
+// next to it, so switching to -store sqlite keeps the conversation.
+func (s *sqlitestore) migrate(path string) error {
+	var n int
+	if err := s.db.QueryRow("select count(*) from messages").Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	old := ndbstore{path: strings.TrimSuffix(path, SQLITEEXT) + HISTEXT}
+	if _, err := os.Stat(old.path); err != nil {
+		return nil
+	}
+	msgs, err := old.Load(0)
+	if err != nil {
+		return err
+	}
+	return s.Append(msgs...)
+}
+
+func (s *sqlitestore) Load(last int) ([]Message, error) {
+	q := "select role, content, time, prompt_tokens, completion_tokens, fingerprint from messages where session = ? order by id"
+	args := []interface{}{s.session}
+	if last > 0 {
+		q = "select role, content, time, prompt_tokens, completion_tokens, fingerprint from (select * from messages where session = ? order by id desc limit ?) order by id"
+		args = append(args, last)
+	}
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []Message
+	for rows.Next() {
+		var m Message
+		var when string
+		var u Usage
+		if err := rows.Scan(&m.Role, &m.Content, &when, &u.PromptTokens, &u.CompletionTokens, &m.Fingerprint); err != nil {
+			return nil, err
+		}
+		m.Time, _ = time.Parse(time.RFC3339, when)
+		if u.PromptTokens+u.CompletionTokens > 0 {
+			u.TotalTokens = u.PromptTokens + u.CompletionTokens
+			m.Usage = &u
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+func (s *sqlitestore) Append(msgs ...Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if m.Time.IsZero() {
+			m.Time = time.Now().UTC()
+		}
+		var u Usage
+		if m.Usage != nil {
+			u = *m.Usage
+		}
+		_, err := tx.Exec("insert into messages(session, role, content, time, prompt_tokens, completion_tokens, fingerprint) values(?, ?, ?, ?, ?, ?, ?)",
+			s.session, m.Role, m.Content, m.Time.Format(time.RFC3339), u.PromptTokens, u.CompletionTokens, m.Fingerprint)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlitestore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,50 @@
+//go:build sqlite
+
+// slm-sqlite_test.go
+// slm: tests for the SQLite history store
+// Run with: go test -tags sqlite slm.go slm-sqlite.go slm_test.go slm-sqlite_test.go
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// TestSqliteOldSchema checks that a database made before messages
+// had a fingerprint column gets one, and keeps what it had.
+func TestSqliteOldSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SESSION+SQLITEEXT)
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+create table sessions (id integer primary key, name text not null unique, created text not null);
+create table messages (id integer primary key, session integer not null references sessions(id),
+	role text not null, content text not null, time text not null,
+	prompt_tokens integer not null default 0, completion_tokens integer not null default 0);
+insert into sessions(name, created) values('llm', '2024-03-01T12:30:00Z');
+insert into messages(session, role, content, time) values(1, 'user', 'old', '2024-03-01T12:30:00Z');
+`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := opensqlite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Append(Message{Role: "assistant", Content: "new", Fingerprint: "fp_123"}); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := store.Load(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Content != "old" || msgs[1].Fingerprint != "fp_123" {
+		t.Errorf("got %#v", msgs)
+	}
+}
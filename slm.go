@@ -4,57 +4,391 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	mrand "math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/mischief/ndb"
 )
 
 const (
-	HISTDIR  = "lib/llm"
-	HISTFILE = "llm.history"
-	APIURL   = "https://api.openai.com/v1/chat/completions"
+	HISTDIR      = "lib/llm"
+	SESSION      = "llm"
+	HISTEXT      = ".history"
+	JSONLEXT     = ".jsonl"
+	TITLEEXT     = ".title"
+	HISTVER      = 1
+	CONFFILE     = "config"
+	PROMPTDIR    = "prompts"
+	BASEURL      = "https://api.openai.com/v1"
+	TAILCHUNK    = 64 * 1024
+	ANTHROPICVER = "2023-06-01"
+	PINGTIMEOUT  = 5 * time.Second
+	PARALLEL     = 4
+	LINEHIST     = "repl.history"
+	DOCSEP       = "\n---\n\n"
+	DOCWARN      = 256 << 10
+	LINEHISTMAX  = 1000
+	WATCHPOLL    = 250 * time.Millisecond
+	WATCHQUIET   = 500 * time.Millisecond
+
+	EXITTRUNC  = 3
+	EXITFILTER = 4
+	EXITEMPTY  = 5
+	EXITFORMAT = 6
+	DEFMAXOUT  = 4096
+	SNIPLEN    = 200
+	RETRYBASE  = 500 * time.Millisecond
+	RETRYMAX   = 30 * time.Second
 )
 
+// Message is sent to the API as role and content; the other fields
+// only live in the history.
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role        string    `json:"role"`
+	Content     string    `json:"content"`
+	Time        time.Time `json:"-"`
+	Usage       *Usage    `json:"-"`
+	Fingerprint string    `json:"-"` // system_fingerprint of the backend that wrote a reply
+	Images      []string  `json:"-"` // -img data URLs, sent with the prompt but not kept
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
 type Choice struct {
-	Message Message `json:"message"`
+	Message      Message   `json:"message"`
+	FinishReason string    `json:"finish_reason"`
+	Logprobs     *Logprobs `json:"logprobs"`
+}
+
+type Logprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+type TokenLogprob struct {
+	Token       string  `json:"token"`
+	Logprob     float64 `json:"logprob"`
+	TopLogprobs []struct {
+		Token   string  `json:"token"`
+		Logprob float64 `json:"logprob"`
+	} `json:"top_logprobs"`
 }
 
 type ChatRequest struct {
-	Model       string    `json:"model"`
-	Temperature float64   `json:"temperature"`
-	Messages    []Message `json:"messages"`
+	Model          string            `json:"model"`
+	Temperature    float64           `json:"temperature"`
+	MaxTokens      int               `json:"max_tokens,omitempty"`
+	Effort         string            `json:"reasoning_effort,omitempty"`
+	Stream         bool              `json:"stream,omitempty"`
+	StreamOptions  *StreamOptions    `json:"stream_options,omitempty"`
+	Logprobs       bool              `json:"logprobs,omitempty"`
+	TopLogprobs    int               `json:"top_logprobs,omitempty"`
+	ResponseFormat *ResponseFormat   `json:"response_format,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	Messages       []Message         `json:"messages"`
+}
+
+// MarshalJSON sends a message carrying -img images as content parts,
+// the text first, which is how chat completions takes them.
+func (r ChatRequest) MarshalJSON() ([]byte, error) {
+	type plain ChatRequest
+	var msgs []interface{}
+	for i, m := range r.Messages {
+		if len(m.Images) == 0 {
+			continue
+		}
+		if msgs == nil {
+			msgs = make([]interface{}, len(r.Messages))
+			for j := range r.Messages {
+				msgs[j] = r.Messages[j]
+			}
+		}
+		parts := []ContentPart{{Type: "text", Text: m.Content}}
+		for _, url := range m.Images {
+			parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{url}})
+		}
+		msgs[i] = struct {
+			Role    string        `json:"role"`
+			Content []ContentPart `json:"content"`
+		}{m.Role, parts}
+	}
+	if msgs == nil {
+		return json.Marshal(plain(r))
+	}
+	return json.Marshal(struct {
+		plain
+		Messages []interface{} `json:"messages"`
+	}{plain(r), msgs})
+}
+
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ResponseFormat asks for structured output under -schema.
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+type JSONSchema struct {
+	Name   string          `json:"name"`
+	Strict bool            `json:"strict"`
+	Schema json.RawMessage `json:"schema"`
 }
 
 type ChatResponse struct {
-	Choices []Choice `json:"choices"`
+	Choices     []Choice `json:"choices"`
+	Usage       *Usage   `json:"usage"`
+	Fingerprint string   `json:"system_fingerprint"`
+}
+
+// ResponsesRequest is the /v1/responses shape used under -api
+// responses; role/content messages are valid input items as is.
+type ResponsesRequest struct {
+	Model       string            `json:"model"`
+	Temperature float64           `json:"temperature"`
+	MaxTokens   int               `json:"max_output_tokens,omitempty"`
+	Reasoning   *Reasoning        `json:"reasoning,omitempty"`
+	Text        *ResponsesText    `json:"text,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Input       []Message         `json:"input"`
+}
+
+type Reasoning struct {
+	Effort string `json:"effort"`
+}
+
+// ResponsesText carries the structured output format, which the
+// responses API flattens into a single object.
+type ResponsesText struct {
+	Format struct {
+		Type string `json:"type"`
+		JSONSchema
+	} `json:"format"`
+}
+
+type ResponsesResponse struct {
+	Status            string `json:"status"`
+	IncompleteDetails *struct {
+		Reason string `json:"reason"`
+	} `json:"incomplete_details"`
+	Output []struct {
+		Type    string `json:"type"`
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	} `json:"output"`
+	Usage *struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// Reply is what sendchat hands back: the text plus the response
+// details reported on stderr.
+type Reply struct {
+	Content      string
+	FinishReason string
+	Header       http.Header
+	Usage        *Usage
+	Logprobs     []TokenLogprob
+	Fingerprint  string
+	Model        string        // that answered, a -fallback maybe
+	FirstByte    time.Duration // until the response headers came
+	Elapsed      time.Duration // until the whole body was read
+}
+
+// RateLimit is read from the x-ratelimit-* response headers.
+type RateLimit struct {
+	LimitRequests     int
+	RemainingRequests int
+	ResetRequests     time.Duration
+	LimitTokens       int
+	RemainingTokens   int
+	ResetTokens       time.Duration
 }
 
 type Opts struct {
-	Model      string
-	Temp       float64
-	SysPrompt  string
-	UserPrompt string
-	Continue   bool
-	APIKey     string
-	Home       string
+	Model            string
+	Temp             float64
+	SysPrompt        string
+	UserPrompt       string
+	Continue         bool
+	Last             int
+	Store            string
+	CountTokens      bool
+	WrapCode         string
+	ExtractCode      string
+	Logprobs         bool
+	TopLogprobs      int
+	Field            string
+	ReplyBase64      bool
+	API              string
+	Role             string
+	NoNewline        bool
+	Tee              string
+	MaxTokens        int
+	Effort           string
+	MaxCost          float64
+	ConfirmOver      int
+	ListPrompts      bool
+	View             bool
+	Since            time.Time
+	Undated          bool
+	Redact           []*regexp.Regexp
+	Interactive      bool
+	RateLimit        bool
+	Measure          bool
+	SaveUsage        bool
+	PromptsOnly      bool
+	Retries          int
+	AutoContinue     int
+	Samples          int
+	RetryBudget      time.Duration
+	PostProcess      string
+	SystemOnce       bool
+	DropSystem       bool
+	Session          string
+	Prune            int
+	Migrate          bool
+	Force            bool
+	IdemKey          string
+	Schema           json.RawMessage
+	SchemaLocal      bool // the model takes no response_format; only check the reply
+	SchemaName       string
+	Strict           bool
+	Prefix           string
+	Suffix           string
+	FailEmpty        bool
+	ShowConfig       bool
+	ConfigPath       string
+	Stream           bool
+	Out              string
+	Sink             io.Writer // where -S writes the reply as it streams
+	Warn             io.Writer // where ask warns; stderr when nil
+	Pager            bool
+	WarnTokens       int
+	ReplyToClip      bool
+	Archive          string
+	ArchiveFormat    string
+	MaxHistBytes     int64
+	Provider         string
+	BaseURL          string
+	KeyEnv           string
+	Batch            string
+	DryCost          bool
+	ReplyRole        string
+	Ping             map[string]Provider
+	CompactJSON      bool
+	SystemEvery      int
+	ThinkOpen        string
+	ThinkClose       string
+	AnswerAfter      string
+	RetryEmpty       int
+	Fallback         []string
+	SaveRequest      string
+	RawRequest       []byte // under -load-request, sent instead of the assembled request
+	LoadRequest      string
+	Render           bool
+	StdinDelim       string
+	JSONRetry        int
+	Roles            map[string]string
+	Meta             map[string]string
+	MetaHeader       string
+	TruncateAt       int
+	TruncateHist     bool
+	ListSessions     bool
+	SetTitle         string
+	AutoTitle        bool
+	Headers          http.Header
+	NoDefaultHeaders bool
+	CompactOnExit    bool
+	Watch            string
+	Context          []Message
+	Images           []string
+	Jitter           string
+	Fingerprint      bool
+	MergeRoles       bool
+	ReplyHash        bool
+	Dedupe           string
+	AdaptiveRate     bool
+	BatchJSONL       string
+	SpareKeys        []string
+	LineHist         bool
+	ContinueCode     int
+	ErrorLog         string
+	ValidateConfig   bool
+	Doc              string
+	Org              string
+	Project          string
+	SummarizeFile    string
+	ChunkTokens      int
+	ChunkOverlap     int
+	Split            string
+	SplitDir         string
+	Backup           string
+	BackupAll        bool
+	Allow            []string
+	TraceID          string
+	TraceFlags       string
+	TraceGiven       bool
+	ReplyStats       bool
+	FromLast         bool
+	ReplayRoles      map[string]bool
+	APIKey           string
+	Home             string
 }
 
 type CLIError struct {
-	Context 	string
-	Err		error
+	Context string
+	Err     error
 }
 
 func (e CLIError) Error() string {
@@ -64,161 +398,5700 @@ func (e CLIError) Error() string {
 	return e.Context
 }
 
+func (e CLIError) Unwrap() error {
+	return e.Err
+}
+
+// APIError is a non-200 answer from the API.
+type APIError struct {
+	Status int
+	Msg    string
+	Code   string // the error code in the body, e.g. model_not_found
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("[ERROR]: API status %d: %s", e.Status, e.Msg)
+}
+
+// StrictError is a warning turned fatal by -strict; Code is the
+// exit status so scripts can tell the cases apart.
+type StrictError struct {
+	Code int
+	Msg  string
+}
+
+func (e *StrictError) Error() string {
+	return "[ERROR]: " + e.Msg
+}
+
+// fatal exits with the StrictError code when there is one.
+func fatal(err error) {
+	var se *StrictError
+	if errors.As(err, &se) {
+		log.Print(err)
+		exit(se.Code)
+	}
+	log.Print(err)
+	exit(1)
+}
+
 func wrap(context string, e error) error {
 	return CLIError{Context: context, Err: e}
 }
 
 func logit(format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
-	log.Fatal(wrap(msg, nil))
+	log.Print(wrap(msg, nil))
+	exit(1)
 }
 
 func checkit(err error, context string) {
 	if err != nil {
-		wrap(context, err)
+		log.Print(wrap(context, err))
+		exit(1)
+	}
+}
+
+// The surroundings of the process, which run swaps out so the whole
+// program can be driven in-process.
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+	getenv           = os.Getenv
+	client           = http.DefaultClient
+)
+
+// quiet is -q: no warnings or notes on what slm is doing go to
+// stderr. Errors do, and so do the reports flags ask for.
+var quiet bool
+
+// warnf prints a warning on stderr unless -q is given.
+func warnf(format string, args ...interface{}) {
+	if !quiet {
+		fmt.Fprintf(stderr, "warning: "+format+"\n", args...)
+	}
+}
+
+// note logs a note about a request, a retry, a fallback or a wait,
+// unless -q is given; errors are logged with log.Print whatever the
+// flags. Like warn, it keeps the note of a job running alongside
+// others in opts.Warn.
+func note(opts *Opts, format string, args ...interface{}) {
+	if quiet {
+		return
 	}
+	if opts.Warn != nil {
+		log.New(opts.Warn, log.Prefix(), log.Flags()).Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// exitcode carries an exit status from exit up to run.
+type exitcode int
+
+// exit ends the program with code. It unwinds to run rather than
+// calling os.Exit, so deferred cleanup happens and run can return.
+func exit(code int) {
+	panic(exitcode(code))
 }
 
 func main() {
-	opts := parseflags()
+	os.Exit(run(os.Args[1:], os.Getenv, os.Stdin, os.Stdout, os.Stderr, http.DefaultClient))
+}
+
+// run is the whole program with its arguments, environment, standard
+// files and HTTP client passed in, returning the exit status; tests
+// can drive it without a subprocess. It sets package state, so only
+// one run may be going at a time.
+func run(args []string, env func(string) string, in io.Reader, out, errw io.Writer, c *http.Client) (code int) {
+	ostdin, ostdout, ostderr, ogetenv, oclient := stdin, stdout, stderr, getenv, client
+	stdin, stdout, stderr, getenv, client = in, out, errw, env, c
+	atomic.StoreInt64(&idemseq, 0)
+	quiet = false
+	log.SetOutput(errw)
+	defer func() {
+		stdin, stdout, stderr, getenv, client = ostdin, ostdout, ostderr, ogetenv, oclient
+		log.SetOutput(os.Stderr)
+		log.SetPrefix("")
+		if e := recover(); e != nil {
+			ec, ok := e.(exitcode)
+			if !ok {
+				panic(e)
+			}
+			code = int(ec)
+		}
+	}()
+	slm(args)
+	return 0
+}
+
+func slm(args []string) {
+	fs := flag.NewFlagSet("slm", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	// the error log goes in before the flags are parsed, so that
+	// config and flag errors reach it too
+	elog := &errorlog{path: errorlogarg(args)}
+	if elog.path != "" {
+		log.SetOutput(io.MultiWriter(stderr, elog))
+	}
+	opts, err := parseflags(fs, args, stdin)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if errors.Is(err, errflags) {
+		exit(2)
+	}
+	if errors.Is(err, errempty) {
+		log.Print(wrap("[ERROR]", err))
+		fs.Usage()
+		exit(2)
+	}
+	if err != nil {
+		log.Print(wrap("[ERROR]", err))
+		exit(1)
+	}
+	// the trace is made in parseflags when not given, so every run
+	// has one to find its log lines by
+	log.SetPrefix("trace=" + opts.TraceID + " ")
+	if opts.ErrorLog != "" {
+		elog.path, elog.opts = opts.ErrorLog, opts
+		log.SetOutput(io.MultiWriter(stderr, elog))
+	}
+	if opts.ValidateConfig {
+		if !validateconfig(stdout, fs, opts.ConfigPath, opts.Home) {
+			exit(1)
+		}
+		return
+	}
+	if err := gatecaps(opts); err != nil {
+		fatal(err)
+	}
 	ensurehistdir(opts.Home)
 
-	msgs := []Message{}
-	if opts.Continue {
-		msgs = loadhist(opts.Home)
+	if opts.View {
+		store := histstore(opts)
+		defer store.Close()
+		msgs := loadhist(store, opts.Last)
+		if !opts.Since.IsZero() {
+			msgs = since(msgs, opts.Since, opts.Undated)
+		}
+		if opts.Redact != nil {
+			msgs = redact(msgs, opts.Redact)
+		}
+		viewhist(stdout, msgs)
+		return
 	}
-	if opts.SysPrompt != "" {
-		msgs = append(msgs, Message{"system", opts.SysPrompt})
+	if opts.Prune > 0 {
+		prune(opts)
+		return
+	}
+	if opts.Migrate {
+		migrate(opts)
+		return
+	}
+	if opts.Dedupe != "" {
+		dedupehist(opts)
+		return
+	}
+	if opts.Backup != "" {
+		dir, err := backup(opts)
+		checkit(err, "[ERROR]: -backup")
+		fmt.Fprintln(stdout, dir)
+		return
+	}
+	if opts.ListSessions {
+		checkit(listsessions(stdout, opts), "[ERROR]: listing sessions")
+		return
+	}
+	if opts.SetTitle != "" {
+		checkit(writetitle(opts.Home, opts.Session, opts.SetTitle), "[ERROR]: -set-title")
+		return
+	}
+	if opts.ShowConfig {
+		showconfig(stdout, fs, opts)
+		return
+	}
+	if opts.Ping != nil {
+		printpings(stdout, ping(opts.Ping, PINGTIMEOUT))
+		return
+	}
+	if opts.ListPrompts {
+		names, err := listprompts(opts.Home)
+		checkit(err, "[ERROR]: listing prompts")
+		for _, name := range names {
+			fmt.Fprintln(stdout, name)
+		}
+		return
 	}
-	msgs = append(msgs, Message{"user", opts.UserPrompt})
 
-	reply, err := sendchat(opts, msgs)
-	if err != nil {
-		log.Fatal(err)
+	if opts.Batch != "" {
+		batch(opts)
+		return
+	}
+	if opts.LoadRequest != "" {
+		loadrequest(opts)
+		return
+	}
+	if opts.Watch != "" {
+		if opts.APIKey == "" && opts.KeyEnv != "" {
+			logit("[ERROR]: %s not set", opts.KeyEnv)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		w, done := replyout(opts)
+		send := func() { watchsend(opts, w) }
+		send()
+		watch(ctx, opts.Watch, WATCHPOLL, WATCHQUIET, send)
+		checkit(done(), "[ERROR]: closing the reply")
+		return
+	}
+	if opts.StdinDelim != "" {
+		w, done := replyout(opts)
+		serve(opts, stdin, w)
+		checkit(done(), "[ERROR]: closing the reply")
+		return
+	}
+	if opts.SummarizeFile != "" {
+		if opts.APIKey == "" && opts.KeyEnv != "" {
+			logit("[ERROR]: %s not set", opts.KeyEnv)
+		}
+		sum, err := summarizefile(opts)
+		if err != nil {
+			fatal(err)
+		}
+		w, done := replyout(opts)
+		printout(w, sum, !opts.NoNewline)
+		checkit(done(), "[ERROR]: closing the reply")
+		return
 	}
-	fmt.Println(reply)
 
+	store := histstore(opts)
+	defer store.Close()
+	if opts.CompactOnExit {
+		defer compactexit(store)
+	}
+	msgs := []Message{}
+	var loaded []Message
+	fresh := false
 	if opts.Continue {
-		appendhist(opts.Home, opts.UserPrompt, reply)
+		loaded = loadhist(store, opts.Last)
+		fresh = len(loaded) == 0
+		msgs = loaded
+		if opts.Roles != nil {
+			msgs = normroles(msgs, opts.Roles)
+		}
+		if opts.ReplayRoles != nil {
+			msgs = replayroles(msgs, opts.ReplayRoles)
+		}
+	}
+	// under -system-once the system prompt is kept in a history
+	// that has none, so later runs send it only once; it is sent
+	// again when -replay-roles leaves it out of the request
+	var pending []Message
+	if opts.SysPrompt != "" && !(opts.SystemOnce && hassystem(msgs)) {
+		sys := Message{Role: "system", Content: opts.SysPrompt}
+		msgs = append(msgs, sys)
+		if opts.SystemOnce && !hassystem(loaded) {
+			pending = append(pending, sys)
+		}
+	}
+	if opts.Interactive {
+		if opts.APIKey == "" && opts.KeyEnv != "" {
+			logit("[ERROR]: %s not set", opts.KeyEnv)
+		}
+		repl(opts, store, msgs, opts.UserPrompt, pending)
+		return
+	}
+	if opts.FromLast {
+		hist := loaded
+		if !opts.Continue {
+			hist = loadhist(store, opts.Last)
+		}
+		last, ok := lastreply(hist, opts.ReplyRole)
+		if !ok {
+			logit("[ERROR]: -from-last: the %s history has no reply", opts.Session)
+		}
+		opts.UserPrompt = fromlast(last, opts.UserPrompt)
+	}
+	// context goes with this request only; the history keeps the
+	// prompt and reply
+	msgs = append(msgs, opts.Context...)
+	prompt := Message{Role: opts.Role, Content: wrapprompt(opts, opts.UserPrompt), Images: opts.Images}
+	if strings.TrimSpace(opts.UserPrompt) != "" {
+		msgs = append(msgs, prompt)
 	}
-}
-
-func parseflags() *Opts {
-	model := flag.String("m", "gpt-3.5-turbo", "model to use")
-	temp  := flag.Float64("t", 0.7, "temperature")
-	sysp := flag.String("s", "", "system prompt")
-	cont := flag.Bool("c", false, "continue with history via NDB")
-	flag.Parse()
 
-	apikey := os.Getenv("OPENAI_API_KEY")
-	if apikey == "" {
-		logit("[ERROR]: OPENAI_API_KEY not set")
+	if opts.CountTokens {
+		fmt.Fprintln(stdout, msgtokens(opts.Model, msgs))
+		return
+	}
+	if opts.MaxCost > 0 {
+		cost, err := checkcost(opts.Model, msgtokens(opts.Model, msgs), opts.MaxTokens, opts.MaxCost)
+		if err != nil {
+			log.Print(err)
+			exit(1)
+		}
+		if !quiet {
+			fmt.Fprintf(stderr, "estimated cost: $%.4f\n", cost)
+		}
+	}
+	if opts.ConfirmOver > 0 {
+		ok, err := confirmlarge(opts, msgs, prompt.Content, isterm(stdin), stdin, stderr)
+		if err != nil {
+			log.Print(err)
+			exit(1)
+		}
+		if !ok {
+			exit(1)
+		}
 	}
 
-	var userp string
-	if flag.NArg() > 0 {
-		userp = flag.Arg(0)
-	} else {
-		data, err := ioutil.ReadAll(os.Stdin)
+	if opts.APIKey == "" && opts.KeyEnv != "" {
+		logit("[ERROR]: %s not set", opts.KeyEnv)
+	}
+	if opts.Samples > 1 {
+		samples(opts, store, msgs, append(pending, prompt))
+		return
+	}
+	if opts.Stream {
+		// written as it arrives; the file is closed, whatever was
+		// streamed, even when the request fails or is interrupted
+		w, done := replyout(opts)
+		opts.Sink = w
+		res, err := ask(opts, msgs)
+		if err == nil && !opts.NoNewline {
+			fmt.Fprintln(w)
+		}
+		checkit(done(), "[ERROR]: closing the reply")
 		if err != nil {
-			checkit(err, "[ERROR]: prompt could not be read")
-			userp = string(data)
+			fatal(err)
+		}
+		report(opts, res)
+		if opts.Doc != "" {
+			checkit(appenddoc(opts.Doc, res.Content), "[ERROR]: -doc")
+		}
+		archive(opts, prompt, res)
+		if opts.Continue {
+			keepturn(opts, store, append(pending, prompt), res)
+		}
+		if opts.AutoTitle && fresh {
+			autotitle(opts, prompt, res)
+		}
+		return
+	}
+	res, err := ask(opts, msgs)
+	if err != nil {
+		fatal(err)
+	}
+	report(opts, res)
+	out, err := output(opts, res.Content)
+	if err != nil {
+		fatal(err)
+	}
+	if opts.Split != "" {
+		checkit(splitout(opts, out), "[ERROR]: -split")
+	} else if opts.Pager && isterm(stdout) {
+		pageout(out)
+	} else if opts.Render && opts.Out == "" && opts.Tee == "" && colour(stdout) {
+		printout(stdout, render(out), !opts.NoNewline)
+	} else {
+		w, done := replyout(opts)
+		printout(w, out, !opts.NoNewline)
+		checkit(done(), "[ERROR]: closing the reply")
+	}
+	if opts.ReplyToClip {
+		c, err := clipboard()
+		if err == nil {
+			err = c.Write(out)
 		}
+		checkit(err, "[ERROR]: -reply-to-clip")
+	}
+	if opts.Doc != "" {
+		checkit(appenddoc(opts.Doc, out), "[ERROR]: -doc")
 	}
 
-	home := os.Getenv("home")
-	if home == "" {
-		home = os.Getenv("HOME")
+	archive(opts, prompt, res)
+	if opts.Continue {
+		keepturn(opts, store, append(pending, prompt), res)
 	}
+	if opts.AutoTitle && fresh {
+		autotitle(opts, prompt, res)
+	}
+}
 
-	return &Opts{
-		Model:      *model,
-		Temp:       *temp,
-		SysPrompt:  *sysp,
-		UserPrompt: userp,
-		Continue:   *cont,
-		APIKey:     apikey,
-		Home:       home,
+// samples prints -parallel-sample independent replies to msgs, each
+// headed by its number. The first to succeed goes in the history.
+func samples(opts *Opts, store HistoryStore, msgs []Message, turn []Message) {
+	replies, err := sample(opts, msgs, opts.Samples)
+	w, done := replyout(opts)
+	var first *Reply
+	for i, res := range replies {
+		if res == nil {
+			continue
+		}
+		report(opts, res)
+		out, oerr := output(opts, res.Content)
+		if oerr != nil {
+			log.Print(oerr)
+		}
+		fmt.Fprintf(w, "--- sample %d\n", i+1)
+		printout(w, out, true)
+		if first == nil {
+			first = res
+		}
+	}
+	checkit(done(), "[ERROR]: closing the reply")
+	if first != nil {
+		archive(opts, turn[len(turn)-1], first)
+	}
+	if opts.Continue {
+		keepturn(opts, store, turn, first)
+	}
+	if err != nil {
+		fatal(err)
 	}
 }
 
-func ensurehistdir(home string) {
-	dir := filepath.Join(home, HISTDIR)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		checkit(err, "[ERROR]: creating history dir:")
+// sample sends msgs n times at once, with at most PARALLEL requests
+// in flight. Failed samples are nil in the result and their errors
+// are joined.
+func sample(opts *Opts, msgs []Message, n int) ([]*Reply, error) {
+	replies := make([]*Reply, n)
+	errs := make([]error, n)
+	warns := make([]bytes.Buffer, n)
+	sem := make(chan struct{}, PARALLEL)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			// a copy each, so no sample sees another's settings,
+			// and warnings held back to print in order
+			o := *opts
+			o.Warn = &warns[i]
+			res, err := ask(&o, msgs)
+			if err != nil {
+				errs[i] = fmt.Errorf("sample %d: %w", i+1, err)
+				return
+			}
+			replies[i] = res
+		}(i)
 	}
+	wg.Wait()
+	for i := range warns {
+		stderr.Write(warns[i].Bytes())
+	}
+	return replies, errors.Join(errs...)
 }
 
-func histpath(home string) string {
-	return filepath.Join(home, HISTDIR, HISTFILE)
+// loadrequest sends the chat request saved in -load-request as it
+// is, with only the endpoint and key being this run's, and prints
+// the reply. Nothing is read from or written to the history.
+func loadrequest(opts *Opts) {
+	data, err := ioutil.ReadFile(opts.LoadRequest)
+	checkit(err, "[ERROR]: -load-request")
+	var req ChatRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		logit("[ERROR]: -load-request: %s is not a chat request: %v", opts.LoadRequest, err)
+	}
+	if req.Model == "" || len(req.Messages) == 0 {
+		logit("[ERROR]: -load-request: %s has no model or no messages", opts.LoadRequest)
+	}
+	checkit(allowed(opts.Allow, req.Model), "[ERROR]: -load-request")
+	data, tp, err := untrace(data)
+	checkit(err, "[ERROR]: -load-request")
+	// the replay goes under the saved trace unless given another
+	if id, flags, ok := traceparent(tp); ok && !opts.TraceGiven {
+		opts.TraceID, opts.TraceFlags = id, flags
+		log.SetPrefix("trace=" + id + " ")
+	}
+	opts.RawRequest = data
+	opts.Model = req.Model
+	opts.Stream = req.Stream
+
+	if opts.APIKey == "" && opts.KeyEnv != "" {
+		logit("[ERROR]: %s not set", opts.KeyEnv)
+	}
+	w, done := replyout(opts)
+	opts.Sink = w
+	res, err := sendchat(opts, req.Messages)
+	if err == nil && !opts.Stream {
+		printout(w, res.Content, false)
+	}
+	if err == nil && !opts.NoNewline {
+		fmt.Fprintln(w)
+	}
+	checkit(done(), "[ERROR]: closing the reply")
+	if err != nil {
+		fatal(err)
+	}
+	report(opts, res)
 }
 
-func loadhist(home string) []Message {
-	path := histpath(home)
-	db, err := ndb.Open(path)
+const summapmsg = `This is part %d of %d of %s. Summarize it, keeping the facts, names and figures that matter; the summary will be combined with those of the other parts.
+
+%s`
+
+const sumreducemsg = `These are summaries of consecutive parts of %s. Combine them into one summary of the whole, in order and without repeating anything.
+
+%s`
+
+// summarizefile is -summarize-file: the file is cut into chunks that
+// fit -chunk-tokens, each is summarized (map) and the summaries are
+// summarized together (reduce) until one is left. Nothing is kept in
+// the history.
+func summarizefile(opts *Opts) (string, error) {
+	data, err := ioutil.ReadFile(opts.SummarizeFile)
 	if err != nil {
-		checkit(err, "no history file or ndb parse error")
+		return "", wrap("[ERROR]: -summarize-file", err)
 	}
-	recs := db.Search("role", "")
-	msgs := make([]Message, 0, len(recs))
-	for _, rec := range recs {
-		var role, content string
-		for _, tuple := range rec {
-			if tuple.Attr == "role" {
-				role = tuple.Val
+	parts := chunks(opts.Model, string(data), opts.ChunkTokens, opts.ChunkOverlap)
+	if len(parts) == 0 {
+		return "", wrap("[ERROR]: -summarize-file: "+opts.SummarizeFile+" is empty", nil)
+	}
+	// only the final summary is printed
+	o := *opts
+	o.Stream, o.Sink = false, nil
+	sums, err := summap(&o, opts.SummarizeFile, parts)
+	if err != nil {
+		return "", err
+	}
+	return sumreduce(&o, opts.SummarizeFile, sums)
+}
+
+// chunks cuts text at line ends, or at spaces in a line too long for
+// one chunk, into pieces of at most size tokens. Each chunk after the
+// first starts with up to overlap tokens from the end of the one
+// before, so what straddles a cut is seen whole at least once.
+func chunks(model, text string, size, overlap int) []string {
+	var pieces []string
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if counttokens(model, line) <= size {
+			pieces = append(pieces, line)
+			continue
+		}
+		pieces = append(pieces, strings.SplitAfter(line, " ")...)
+	}
+	var out []string
+	var cur []string
+	n := 0
+	for _, p := range pieces {
+		pn := counttokens(model, p)
+		if n+pn > size && n > 0 {
+			out = append(out, strings.Join(cur, ""))
+			// carry the tail over, never all of it, so each chunk
+			// moves on
+			var keep []string
+			k := 0
+			for i := len(cur) - 1; i > 0; i-- {
+				cn := counttokens(model, cur[i])
+				if k+cn > overlap || k+cn+pn > size {
+					break
+				}
+				keep = append([]string{cur[i]}, keep...)
+				k += cn
 			}
-			if tuple.Attr == "content" {
-				content = tuple.Val
+			cur, n = keep, k
+		}
+		cur = append(cur, p)
+		n += pn
+	}
+	if strings.TrimSpace(strings.Join(cur, "")) != "" {
+		out = append(out, strings.Join(cur, ""))
+	}
+	return out
+}
+
+// summap summarizes each of the parts of name on its own.
+func summap(opts *Opts, name string, parts []string) ([]string, error) {
+	sums := make([]string, len(parts))
+	for i, part := range parts {
+		if len(parts) > 1 && !quiet {
+			fmt.Fprintf(stderr, "summarizing part %d of %d\n", i+1, len(parts))
+		}
+		res, err := ask(opts, summsgs(opts, fmt.Sprintf(summapmsg, i+1, len(parts), name, part)))
+		if err != nil {
+			return nil, fmt.Errorf("part %d: %w", i+1, err)
+		}
+		sums[i] = strings.TrimSpace(res.Content)
+	}
+	return sums, nil
+}
+
+// sumreduce combines the summaries of name into one, a chunk of them
+// at a time should they not fit together.
+func sumreduce(opts *Opts, name string, sums []string) (string, error) {
+	for len(sums) > 1 {
+		groups := chunks(opts.Model, strings.Join(sums, "\n\n"), opts.ChunkTokens, 0)
+		next := make([]string, len(groups))
+		for i, g := range groups {
+			res, err := ask(opts, summsgs(opts, fmt.Sprintf(sumreducemsg, name, g)))
+			if err != nil {
+				return "", fmt.Errorf("combining summaries: %w", err)
 			}
+			next[i] = strings.TrimSpace(res.Content)
 		}
-		if role != "" && content != "" {
-			msgs = append(msgs, Message{Role: role, Content: content})
+		if len(next) >= len(sums) {
+			return "", wrap("[ERROR]: -summarize-file: the summaries do not get shorter; raise -chunk-tokens", nil)
 		}
+		sums = next
 	}
-	return msgs
+	return sums[0], nil
 }
 
-func appendhist(home, userp, reply string) {
-	path := histpath(home)
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		logit("[ERROR] open history src: ", err)
+func summsgs(opts *Opts, prompt string) []Message {
+	var msgs []Message
+	if opts.SysPrompt != "" {
+		msgs = append(msgs, Message{Role: "system", Content: opts.SysPrompt})
 	}
-	defer f.Close()
+	return append(msgs, Message{Role: "user", Content: prompt})
+}
 
-	fmt.Fprintf(f, "message role=%q content=%q\n", "user", userp)
-	fmt.Fprintf(f, "message role=%q content=%q\n", "assistant", reply)
+// watch polls path every poll and calls fire once it has changed and
+// then been left alone for quiet, so an editor saving several times
+// in a row makes one call. It returns when ctx is done.
+func watch(ctx context.Context, path string, poll, quiet time.Duration, fire func()) {
+	stamp := func() (time.Time, int64) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+	mtime, size := stamp()
+	var changed time.Time
+	tick := time.NewTicker(poll)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			if m, sz := stamp(); !m.Equal(mtime) || sz != size {
+				mtime, size = m, sz
+				changed = now
+			} else if !changed.IsZero() && now.Sub(changed) >= quiet {
+				changed = time.Time{}
+				fire()
+			}
+		}
+	}
 }
 
-func sendchat(opts *Opts, msgs []Message) (string, error) {
-	req := ChatRequest{Model: opts.Model, Temperature: opts.Temp, Messages: msgs}
-	buf, err := json.Marshal(req)
+// watchsend sends the -watch file as the prompt and prints the reply
+// under a line saying when. Failures are reported and watching goes on.
+func watchsend(opts *Opts, w io.Writer) {
+	data, err := ioutil.ReadFile(opts.Watch)
 	if err != nil {
-		return "", wrap("[ERROR]: marshalling request: ", err)
+		log.Print(err)
+		return
 	}
-
-	reqhttp, err := http.NewRequest("POST", APIURL, bytes.NewReader(buf))
+	var msgs []Message
+	if opts.SysPrompt != "" {
+		msgs = append(msgs, Message{Role: "system", Content: opts.SysPrompt})
+	}
+	msgs = append(msgs, Message{Role: opts.Role, Content: wrapprompt(opts, strings.TrimSpace(string(data)))})
+	if opts.Stream {
+		// the reply goes to w as it comes, under the line
+		fmt.Fprintf(w, "--- %s\n", time.Now().Format("15:04:05"))
+		opts.Sink = w
+		res, err := ask(opts, msgs)
+		fmt.Fprintln(w)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		report(opts, res)
+		return
+	}
+	res, err := ask(opts, msgs)
 	if err != nil {
-		return "", wrap("[ERROR]: creating request: ", err)
+		log.Print(err)
+		return
 	}
-	reqhttp.Header.Set("Content-Type", "application/json")
-	reqhttp.Header.Set("Authorization", "Bearer "+opts.APIKey)
-
-	resp, err := http.DefaultClient.Do(reqhttp)
+	report(opts, res)
+	out, err := output(opts, res.Content)
 	if err != nil {
-		return "", wrap("[ERROR]: request error: ", err)
+		log.Print(err)
 	}
-	defer resp.Body.Close()
+	fmt.Fprintf(w, "--- %s\n", time.Now().Format("15:04:05"))
+	printout(w, out, true)
+}
 
-	var cres ChatResponse
-	if err := json.NewDecoder(resp.Body).Decode(&cres); err != nil {
-		return "", wrap("[ERROR]: decode response: ", err)
+// serve answers the prompts in r, each ended by -stdin-delimiter, as
+// they come, writing every reply to w followed by the delimiter. It
+// runs until r is at EOF; a failed prompt gets an empty reply so the
+// two sides stay in step.
+func serve(opts *Opts, r io.Reader, w io.Writer) {
+	if opts.APIKey == "" && opts.KeyEnv != "" {
+		logit("[ERROR]: %s not set", opts.KeyEnv)
 	}
-	if len(cres.Choices) == 0 {
-		return "", wrap("[ERROR]: no choices in response", nil)
+	if opts.Stream {
+		opts.Sink = w
+	}
+	delim := []byte(opts.StdinDelim)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<30)
+	sc.Split(func(data []byte, eof bool) (int, []byte, error) {
+		if i := bytes.Index(data, delim); i >= 0 {
+			return i + len(delim), data[:i], nil
+		}
+		if eof && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for n := 1; sc.Scan(); n++ {
+		p := strings.TrimSpace(sc.Text())
+		if p == "" {
+			continue
+		}
+		var msgs []Message
+		if opts.SysPrompt != "" {
+			msgs = append(msgs, Message{Role: "system", Content: opts.SysPrompt})
+		}
+		msgs = append(msgs, Message{Role: opts.Role, Content: wrapprompt(opts, p)})
+		out := ""
+		res, err := ask(opts, msgs)
+		if err == nil {
+			report(opts, res)
+			if opts.Stream {
+				out = res.Content // w has it already
+			} else {
+				out, err = output(opts, res.Content)
+			}
+			archive(opts, msgs[len(msgs)-1], res)
+		}
+		if err != nil {
+			log.Printf("prompt %d: %v", n, err)
+		}
+		if !opts.Stream {
+			fmt.Fprint(w, out)
+		}
+		if !strings.HasSuffix(out, "\n") {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprint(w, opts.StdinDelim)
+		if res != nil {
+			pacewait(opts, res)
+		}
+	}
+	checkit(sc.Err(), "[ERROR]: reading stdin")
+}
+
+// batch sends each prompt of the -batch file on its own, with the
+// system prompt but no history. Under -dry-cost it only prices them.
+func batch(opts *Opts) {
+	prompts, err := readbatch(opts.Batch)
+	checkit(err, "[ERROR]: -batch")
+	reqs := make([][]Message, len(prompts))
+	for i, p := range prompts {
+		if opts.SysPrompt != "" {
+			reqs[i] = append(reqs[i], Message{Role: "system", Content: opts.SysPrompt})
+		}
+		reqs[i] = append(reqs[i], Message{Role: opts.Role, Content: wrapprompt(opts, p)})
+	}
+	if opts.DryCost {
+		checkit(drycost(stdout, opts.Model, opts.MaxTokens, reqs), "[ERROR]: -dry-cost")
+		return
+	}
+
+	if opts.APIKey == "" && opts.KeyEnv != "" {
+		logit("[ERROR]: %s not set", opts.KeyEnv)
+	}
+	w, done := replyout(opts)
+	failed := 0
+	if opts.BatchJSONL != "" {
+		failed = batchjsonl(opts, reqs, w)
+		reqs = nil
+	}
+	for i, msgs := range reqs {
+		res, err := ask(opts, msgs)
+		if err != nil {
+			log.Printf("prompt %d: %v", i+1, err)
+			failed++
+			continue
+		}
+		report(opts, res)
+		out, err := output(opts, res.Content)
+		if err != nil {
+			log.Printf("prompt %d: %v", i+1, err)
+		}
+		fmt.Fprintf(w, "--- prompt %d\n", i+1)
+		printout(w, out, true)
+		archive(opts, msgs[len(msgs)-1], res)
+		pacewait(opts, res)
+	}
+	checkit(done(), "[ERROR]: closing the reply")
+	if failed > 0 {
+		logit("[ERROR]: %d of %d prompts failed", failed, len(prompts))
 	}
-	return cres.Choices[0].Message.Content, nil
 }
 
+// BatchRec is a -batch-jsonl line: one prompt's whole reply, or why
+// there is none.
+type BatchRec struct {
+	Index int    `json:"index"` // of the prompt in the file, from 1
+	Reply string `json:"reply,omitempty"`
+	Usage *Usage `json:"usage,omitempty"`
+	Error string `json:"error,omitempty"`
+}
 
+// batchjsonl streams the replies to reqs, at most PARALLEL at a time,
+// and writes each to w as a JSON line once it is whole: in the order
+// they finish, or under -batch-jsonl input in the order of reqs. It
+// returns how many failed.
+func batchjsonl(opts *Opts, reqs [][]Message, w io.Writer) int {
+	o := *opts
+	o.Stream, o.Sink = true, io.Discard
+	type result struct {
+		rec  BatchRec
+		res  *Reply
+		warn bytes.Buffer
+	}
+	results := make(chan *result)
+	sem := make(chan struct{}, PARALLEL)
+	for i, msgs := range reqs {
+		go func(i int, msgs []Message) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			r := &result{rec: BatchRec{Index: i + 1}}
+			// the jobs run at once, so each gets options it can
+			// change, and its warnings wait for the writer below
+			jo := o
+			jo.Warn = &r.warn
+			res, err := ask(&jo, msgs)
+			if err == nil {
+				r.res = res
+				r.rec.Usage = res.Usage
+				r.rec.Reply, err = output(&jo, res.Content)
+			}
+			if err != nil {
+				r.rec.Error = err.Error()
+			}
+			// waiting before giving up the slot paces the batch
+			if res != nil {
+				pacewait(&jo, res)
+			}
+			results <- r
+		}(i, msgs)
+	}
 
+	enc := json.NewEncoder(w)
+	held := map[int]BatchRec{}
+	next, failed := 1, 0
+	for range reqs {
+		r := <-results
+		stderr.Write(r.warn.Bytes())
+		if r.rec.Error != "" {
+			failed++
+		}
+		if r.res != nil {
+			report(opts, r.res)
+			archive(opts, reqs[r.rec.Index-1][len(reqs[r.rec.Index-1])-1], r.res)
+		}
+		if opts.BatchJSONL != "input" {
+			checkit(enc.Encode(r.rec), "[ERROR]: writing the reply")
+			continue
+		}
+		held[r.rec.Index] = r.rec
+		for rec, ok := held[next]; ok; rec, ok = held[next] {
+			checkit(enc.Encode(rec), "[ERROR]: writing the reply")
+			delete(held, next)
+			next++
+		}
+	}
+	return failed
+}
+
+// readbatch reads a -batch file: a prompt per line, with blank lines
+// and # comments skipped and \n and the like unescaped.
+func readbatch(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var prompts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		prompts = append(prompts, unquote(line))
+	}
+	if len(prompts) == 0 {
+		return nil, fmt.Errorf("no prompts in %s", path)
+	}
+	return prompts, nil
+}
+
+// drycost prints the estimated tokens and worst case cost of each
+// request and of them all, sending nothing.
+func drycost(w io.Writer, model string, maxout int, reqs [][]Message) error {
+	total, totaltok := 0.0, 0
+	for i, msgs := range reqs {
+		n := msgtokens(model, msgs)
+		cost, err := estcost(model, n, maxout)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "prompt %d\t%d tokens\t$%.4f\n", i+1, n, cost)
+		total += cost
+		totaltok += n
+	}
+	fmt.Fprintf(w, "total\t%d tokens\t$%.4f\n", totaltok, total)
+	return nil
+}
+
+// replyout is where replies are printed: stdout, the -o file
+// instead, or under -tee both. done closes the file.
+func replyout(opts *Opts) (w io.Writer, done func() error) {
+	switch {
+	case opts.Out != "":
+		f, err := os.Create(opts.Out)
+		checkit(err, "[ERROR]: -o")
+		return f, f.Close
+	case opts.Tee != "":
+		f, err := os.Create(opts.Tee)
+		checkit(err, "[ERROR]: -tee")
+		return io.MultiWriter(stdout, f), f.Close
+	}
+	return stdout, func() error { return nil }
+}
+
+func wrapprompt(opts *Opts, p string) string {
+	return opts.Prefix + p + opts.Suffix
+}
+
+// ask sends msgs and turns the answer into the reply that is both
+// printed and stored.
+func ask(opts *Opts, msgs []Message) (*Reply, error) {
+	if opts.DropSystem {
+		msgs = dropsystem(msgs)
+	} else if opts.SystemEvery > 0 {
+		msgs = interleave(msgs, opts.SystemEvery)
+	}
+	// anthropic wants user and assistant turns to alternate
+	if opts.MergeRoles || opts.Provider == "anthropic" {
+		msgs = mergeroles(msgs)
+	}
+	res, opts, err := sendfallback(opts, msgs)
+	if err != nil {
+		return nil, err
+	}
+	// each resend gets its own -retries for transport errors; this
+	// only counts the replies that came back empty
+	for i := 0; i < opts.RetryEmpty && isempty(res); i++ {
+		note(opts, "empty reply; resending (%d of %d)", i+1, opts.RetryEmpty)
+		next, err := sendchat(opts, msgs)
+		if err != nil {
+			return nil, err
+		}
+		next.Usage = addusage(res.Usage, next.Usage)
+		res = next
+	}
+	if res, err = autocontinue(opts, msgs, res); err != nil {
+		return nil, err
+	}
+	if opts.JSONRetry > 0 {
+		if res, err = jsonretry(opts, msgs, res); err != nil {
+			return nil, err
+		}
+	}
+	if opts.FailEmpty && strings.TrimSpace(res.Content) == "" {
+		return nil, &StrictError{EXITEMPTY, "reply is empty"}
+	}
+	if err := checkreply(res); err != nil {
+		if opts.Strict {
+			return nil, err
+		}
+		warn(opts, "%s", err.(*StrictError).Msg)
+	}
+	if opts.Schema != nil {
+		if err := checkschema(opts.Schema, res.Content); err != nil {
+			if opts.Strict {
+				return nil, err
+			}
+			warn(opts, "%s", err.(*StrictError).Msg)
+		}
+	}
+	if opts.ThinkOpen != "" {
+		res.Content = stripthinking(res.Content, opts.ThinkOpen, opts.ThinkClose)
+	}
+	if opts.PostProcess != "" {
+		res.Content, err = postprocess(opts.PostProcess, res.Content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	res.Model = opts.Model
+	return res, nil
+}
+
+// warn writes a warning about a request to opts.Warn, which a
+// sample running alongside others has to itself.
+func warn(opts *Opts, format string, args ...interface{}) {
+	if quiet {
+		return
+	}
+	w := opts.Warn
+	if w == nil {
+		w = stderr
+	}
+	fmt.Fprintf(w, "warning: "+format+"\n", args...)
+}
+
+const continuemsg = "Continue exactly where you left off, without repeating anything."
+
+const codecontinuemsg = "Your reply was cut off inside a code block. Continue the code exactly where it stopped, without repeating anything and without opening a new code fence."
+
+// autocontinue asks for more while res is cut at the token limit, at
+// most -autocontinue times, and joins the parts into one reply. A cut
+// inside a ``` block is continued as code, up to -continue-code times.
+func autocontinue(opts *Opts, msgs []Message, res *Reply) (*Reply, error) {
+	for i := 0; res.FinishReason == "length"; i++ {
+		code := opts.ContinueCode > 0 && openfence(res.Content)
+		if code && i >= opts.ContinueCode || !code && i >= opts.AutoContinue {
+			break
+		}
+		if opts.MaxCost > 0 {
+			if cost := spent(opts.Model, msgs, res, i+1); cost >= opts.MaxCost {
+				warn(opts, "-autocontinue stopped at about $%.4f, over -max-cost $%.4f; the reply is cut short", cost, opts.MaxCost)
+				break
+			}
+		}
+		ask, o := continuemsg, opts
+		var skip *fenceskip
+		if code {
+			ask = codecontinuemsg
+			if opts.Stream {
+				skip = &fenceskip{w: opts.Sink}
+				c := *opts
+				c.Sink = skip
+				o = &c
+			}
+		}
+		more := append(msgs[:len(msgs):len(msgs)],
+			Message{Role: "assistant", Content: res.Content},
+			Message{Role: "user", Content: ask})
+		next, err := sendchat(o, more)
+		if err != nil {
+			return nil, err
+		}
+		if skip != nil {
+			if err := skip.flush(); err != nil {
+				return nil, wrap("[ERROR]: writing reply", err)
+			}
+		}
+		if code {
+			next.Content = dropfence(next.Content)
+		}
+		next.Content = res.Content + next.Content
+		next.Usage = addusage(res.Usage, next.Usage)
+		res = next
+	}
+	return res, nil
+}
+
+// openfence is true when s ends inside a ``` code block.
+func openfence(s string) bool {
+	open := false
+	for _, l := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(l), "```") {
+			open = !open
+		}
+	}
+	return open
+}
+
+// dropfence removes the fence a continued code reply may reopen with,
+// so the stitched reply keeps the one it was cut in.
+func dropfence(s string) string {
+	t := strings.TrimLeft(s, " \t\n")
+	if !strings.HasPrefix(t, "```") {
+		return s
+	}
+	if i := strings.IndexByte(t, '\n'); i >= 0 {
+		return t[i+1:]
+	}
+	return ""
+}
+
+// fenceskip does dropfence on a streamed continuation: it holds the
+// text back until it knows whether it starts with a fence.
+type fenceskip struct {
+	w    io.Writer
+	buf  []byte
+	done bool
+}
+
+func (f *fenceskip) Write(p []byte) (int, error) {
+	if f.done {
+		return f.w.Write(p)
+	}
+	f.buf = append(f.buf, p...)
+	t := strings.TrimLeft(string(f.buf), " \t\n")
+	if strings.HasPrefix(t, "```") && !strings.Contains(t, "\n") || strings.HasPrefix("```", t) {
+		return len(p), nil
+	}
+	return len(p), f.flush()
+}
+
+func (f *fenceskip) flush() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	_, err := io.WriteString(f.w, dropfence(string(f.buf)))
+	return err
+}
+
+// isempty is true for a reply with no text that is not a tool call.
+func isempty(res *Reply) bool {
+	return strings.TrimSpace(res.Content) == "" && res.FinishReason != "tool_calls"
+}
+
+const jsonfixmsg = "Your previous output was invalid: %v. Return only valid JSON."
+
+// jsonretry re-asks, with the reply and what was wrong with it, while
+// the reply is not JSON (or, under -schema, does not match it), at
+// most -strict-json-retry times.
+func jsonretry(opts *Opts, msgs []Message, res *Reply) (*Reply, error) {
+	bad := badjson(opts, res.Content)
+	for i := 0; i < opts.JSONRetry && bad != nil; i++ {
+		note(opts, "%v; asking again (%d of %d)", bad, i+1, opts.JSONRetry)
+		more := append(msgs[:len(msgs):len(msgs)],
+			Message{Role: "assistant", Content: res.Content},
+			Message{Role: "user", Content: fmt.Sprintf(jsonfixmsg, bad)})
+		next, err := sendchat(opts, more)
+		if err != nil {
+			return nil, err
+		}
+		next.Usage = addusage(res.Usage, next.Usage)
+		res = next
+		bad = badjson(opts, res.Content)
+	}
+	if bad != nil {
+		return nil, &StrictError{EXITFORMAT, fmt.Sprintf("still no valid JSON after %d retries: %v", opts.JSONRetry, bad)}
+	}
+	return res, nil
+}
+
+func badjson(opts *Opts, reply string) error {
+	if opts.Schema != nil {
+		if err := checkschema(opts.Schema, reply); err != nil {
+			return errors.New(err.(*StrictError).Msg)
+		}
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(reply), &v); err != nil {
+		return fmt.Errorf("reply is not JSON: %v", err)
+	}
+	return nil
+}
+
+// spent is what the n requests behind res have cost so far: by their
+// usage when the API gave it, else estimated from msgs and the reply.
+// It is 0 for a model with no known price.
+func spent(model string, msgs []Message, res *Reply, n int) float64 {
+	p, ok := modelprice(model)
+	if !ok {
+		return 0
+	}
+	if u := res.Usage; u != nil {
+		return (float64(u.PromptTokens)*p.In + float64(u.CompletionTokens)*p.Out) / 1e6
+	}
+	in := n * msgtokens(model, msgs)
+	out := counttokens(model, res.Content)
+	return (float64(in)*p.In + float64(out)*p.Out) / 1e6
+}
+
+// mergeroles joins runs of messages in the same role into one, a
+// line apart, for servers that refuse two in a row. It makes new
+// messages, so the history is left as it was.
+func mergeroles(msgs []Message) []Message {
+	out := make([]Message, 0, len(msgs))
+	for _, m := range msgs {
+		if n := len(out); n > 0 && out[n-1].Role == m.Role {
+			out[n-1].Content += "\n" + m.Content
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func addusage(a, b *Usage) *Usage {
+	if a == nil || b == nil {
+		return b
+	}
+	return &Usage{
+		PromptTokens:     a.PromptTokens + b.PromptTokens,
+		CompletionTokens: a.CompletionTokens + b.CompletionTokens,
+		TotalTokens:      a.TotalTokens + b.TotalTokens,
+	}
+}
+
+// checkreply flags replies that came back but are not whole: cut
+// at the token limit, filtered, or empty.
+func checkreply(res *Reply) error {
+	switch {
+	case res.FinishReason == "length":
+		return &StrictError{EXITTRUNC, "reply truncated at the token limit (finish_reason=length)"}
+	case res.FinishReason == "content_filter":
+		return &StrictError{EXITFILTER, "reply stopped by the content filter (finish_reason=content_filter)"}
+	case strings.TrimSpace(res.Content) == "":
+		return &StrictError{EXITEMPTY, "reply is empty"}
+	}
+	return nil
+}
+
+// checkschema checks that reply is JSON matching schema.
+func checkschema(schema json.RawMessage, reply string) error {
+	var sch, val interface{}
+	if err := json.Unmarshal(schema, &sch); err != nil {
+		return &StrictError{EXITFORMAT, "-schema: " + err.Error()}
+	}
+	if err := json.Unmarshal([]byte(reply), &val); err != nil {
+		return &StrictError{EXITFORMAT, "reply is not JSON: " + err.Error()}
+	}
+	if err := validate(sch, val, "$"); err != nil {
+		return &StrictError{EXITFORMAT, "reply does not match the schema: " + err.Error()}
+	}
+	return nil
+}
+
+// validate covers the JSON Schema keywords structured outputs use:
+// type, properties, required, additionalProperties, items and enum.
+func validate(schema, val interface{}, path string) error {
+	sch, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if t, ok := sch["type"]; ok && !hastype(t, val) {
+		return fmt.Errorf("%s: want %v", path, t)
+	}
+	if enum, ok := sch["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, val) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, val, enum)
+		}
+	}
+
+	switch v := val.(type) {
+	case map[string]interface{}:
+		props, _ := sch["properties"].(map[string]interface{})
+		if req, ok := sch["required"].([]interface{}); ok {
+			for _, r := range req {
+				if name, _ := r.(string); name != "" {
+					if _, ok := v[name]; !ok {
+						return fmt.Errorf("%s: missing %q", path, name)
+					}
+				}
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ps, ok := props[k]
+			if !ok {
+				if extra, ok := sch["additionalProperties"].(bool); ok && !extra {
+					return fmt.Errorf("%s: unexpected %q", path, k)
+				}
+				continue
+			}
+			if err := validate(ps, v[k], path+"."+k); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			if err := validate(sch["items"], e, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hastype matches val against a type name or a list of them.
+func hastype(t, val interface{}) bool {
+	if list, ok := t.([]interface{}); ok {
+		for _, e := range list {
+			if hastype(e, val) {
+				return true
+			}
+		}
+		return false
+	}
+	switch t {
+	case "object":
+		_, ok := val.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := val.([]interface{})
+		return ok
+	case "string":
+		_, ok := val.(string)
+		return ok
+	case "number":
+		_, ok := val.(float64)
+		return ok
+	case "integer":
+		f, ok := val.(float64)
+		return ok && f == float64(int64(f))
+	case "boolean":
+		_, ok := val.(bool)
+		return ok
+	case "null":
+		return val == nil
+	}
+	return true
+}
+
+// stripthinking removes the open...close scratchpad blocks reasoning
+// models put in their replies, leaving the answer. An unclosed block
+// is left alone rather than taking the rest of the reply with it.
+func stripthinking(reply, open, close string) string {
+	var b strings.Builder
+	rest := reply
+	stripped := false
+	for {
+		i := strings.Index(rest, open)
+		if i < 0 {
+			break
+		}
+		j := strings.Index(rest[i+len(open):], close)
+		if j < 0 {
+			break
+		}
+		b.WriteString(rest[:i])
+		rest = rest[i+len(open)+j+len(close):]
+		stripped = true
+	}
+	if !stripped {
+		return reply
+	}
+	b.WriteString(rest)
+	return strings.TrimSpace(b.String())
+}
+
+// postprocess pipes reply through the shell command cmd and returns
+// what it prints.
+func postprocess(cmd, reply string) (string, error) {
+	c := shell(cmd)
+	c.Stdin = strings.NewReader(reply)
+	c.Stderr = stderr
+	out, err := c.Output()
+	if err != nil {
+		return "", wrap(fmt.Sprintf("[ERROR]: -postprocess %q", cmd), err)
+	}
+	return string(out), nil
+}
+
+// Clipboard is where -clip reads the prompt and -reply-to-clip
+// puts the reply.
+type Clipboard interface {
+	Read() (string, error)
+	Write(text string) error
+}
+
+// snarf is the Plan 9 clipboard, a file.
+type snarf struct {
+	path string
+}
+
+func (s snarf) Read() (string, error) {
+	data, err := ioutil.ReadFile(s.path)
+	return string(data), err
+}
+
+func (s snarf) Write(text string) error {
+	return ioutil.WriteFile(s.path, []byte(text), 0666)
+}
+
+// clipcmd is a clipboard reached through a paste and a copy command.
+type clipcmd struct {
+	paste, copy []string
+}
+
+func (c clipcmd) Read() (string, error) {
+	out, err := exec.Command(c.paste[0], c.paste[1:]...).Output()
+	return string(out), err
+}
+
+func (c clipcmd) Write(text string) error {
+	cmd := exec.Command(c.copy[0], c.copy[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+// clipcmds are tried in order for a clipboard outside Plan 9.
+var clipcmds = []clipcmd{
+	{[]string{"wl-paste", "-n"}, []string{"wl-copy"}},
+	{[]string{"xclip", "-o", "-selection", "clipboard"}, []string{"xclip", "-selection", "clipboard"}},
+	{[]string{"xsel", "-ob"}, []string{"xsel", "-ib"}},
+	{[]string{"pbpaste"}, []string{"pbcopy"}},
+}
+
+// clipboard finds the system clipboard; it is a variable so another
+// can stand in for it.
+var clipboard = func() (Clipboard, error) {
+	if runtime.GOOS == "plan9" {
+		return snarf{"/dev/snarf"}, nil
+	}
+	for _, c := range clipcmds {
+		if _, err := exec.LookPath(c.paste[0]); err == nil {
+			return c, nil
+		}
+	}
+	return nil, errors.New("no clipboard tool found: install wl-clipboard, xclip or xsel")
+}
+
+// shell runs cmd with rc on Plan 9 and sh elsewhere.
+func shell(cmd string) *exec.Cmd {
+	sh := "sh"
+	if runtime.GOOS == "plan9" {
+		sh = "rc"
+	}
+	return exec.Command(sh, "-c", cmd)
+}
+
+// repl reads one prompt per line from stdin, sending each with the
+// conversation so far and appending every exchange to the history.
+func repl(opts *Opts, store HistoryStore, msgs []Message, first string, pending []Message) {
+	in := bufio.NewScanner(stdin)
+	in.Buffer(nil, 1024*1024)
+	w, done := replyout(opts)
+	defer done()
+	opts.Sink = w
+	var lh *linehist
+	if opts.LineHist {
+		lh = loadlinehist(filepath.Join(opts.Home, HISTDIR, LINEHIST))
+	}
+	line := first
+	for {
+		if line == "" {
+			fmt.Fprint(stderr, "> ")
+			if !in.Scan() {
+				fmt.Fprintln(stderr)
+				break
+			}
+			line = strings.TrimSpace(in.Text())
+			if line == "" {
+				continue
+			}
+			if lh != nil {
+				if line = lh.expand(line, stderr); line == "" {
+					continue
+				}
+				lh.add(line)
+			}
+		}
+
+		prompt := Message{Role: opts.Role, Content: wrapprompt(opts, line)}
+		msgs = append(msgs, prompt)
+		res, err := ask(opts, msgs)
+		if err != nil {
+			log.Print(err)
+			msgs = msgs[:len(msgs)-1]
+			line = ""
+			continue
+		}
+		report(opts, res)
+		if opts.Stream {
+			fmt.Fprintln(w)
+		} else {
+			out, err := output(opts, res.Content)
+			if err != nil {
+				log.Print(err)
+			}
+			printout(w, out, true)
+		}
+		msgs = append(msgs, Message{Role: "assistant", Content: res.Content})
+		archive(opts, prompt, res)
+		pacewait(opts, res)
+		keepturn(opts, store, append(pending, prompt), res)
+		pending = nil
+		line = ""
+	}
+	checkit(in.Err(), "[ERROR]: reading prompt")
+}
+
+// linehist is the -line-history of prompts typed at -ci, kept apart
+// from the conversation so they can be recalled in later sessions.
+type linehist struct {
+	path  string
+	lines []string
+}
+
+func loadlinehist(path string) *linehist {
+	h := &linehist{path: path}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		h.lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+		if n := len(h.lines); n > LINEHISTMAX {
+			h.lines = h.lines[n-LINEHISTMAX:]
+		}
+	}
+	return h
+}
+
+// add keeps line, on disk as well; a failure to save only warns.
+func (h *linehist) add(line string) {
+	h.lines = append(h.lines, line)
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = fmt.Fprintln(f, line)
+		f.Close()
+	}
+	if err != nil {
+		warnf("-line-history: %v", err)
+	}
+}
+
+// expand recalls earlier prompts the way a shell does: !! is the last,
+// !N the Nth and !text the last to start with text. A bare ! lists
+// them on w. What is recalled is echoed; "" means nothing to send.
+func (h *linehist) expand(line string, w io.Writer) string {
+	if !strings.HasPrefix(line, "!") {
+		return line
+	}
+	arg := line[1:]
+	if arg == "" {
+		for i, l := range h.lines {
+			fmt.Fprintf(w, "%5d  %s\n", i+1, l)
+		}
+		return ""
+	}
+	found := ""
+	if n, err := strconv.Atoi(arg); err == nil {
+		if n >= 1 && n <= len(h.lines) {
+			found = h.lines[n-1]
+		}
+	} else {
+		for i := len(h.lines) - 1; i >= 0; i-- {
+			if arg == "!" || strings.HasPrefix(h.lines[i], arg) {
+				found = h.lines[i]
+				break
+			}
+		}
+	}
+	if found == "" {
+		fmt.Fprintf(w, "%s: not in the line history\n", line)
+		return ""
+	}
+	fmt.Fprintln(w, found)
+	return found
+}
+
+func parseflags(fs *flag.FlagSet, args []string, stdin io.Reader) (*Opts, error) {
+	configf := fs.String("config", "", "read the config from this file instead of $home/lib/llm/config")
+	showconf := fs.Bool("show-config", false, "print the settings after the config and flags are applied, and exit")
+	msuffix := fs.String("model-suffix", "", "make -m a fine-tuned model name: ft:MODEL:SUFFIX")
+	provname := fs.String("provider", "", "provider from the config, or openai, anthropic or ollama (default openai)")
+	pingf := fs.Bool("ping", false, "time a /models request to each provider in the config and exit")
+	model := fs.String("m", "gpt-3.5-turbo", "model to use")
+	temp := fs.Float64("t", 0.7, "temperature")
+	maxtok := fs.Int("max-tokens", 0, "limit the reply to this many tokens (0 for the model default)")
+	effort := fs.String("effort", "", "reasoning effort for reasoning models: low, medium or high")
+	maxcost := fs.Float64("max-cost", 0, "refuse to send if the estimated cost in dollars is higher")
+	confirm := fs.Int("confirm-over", 0, "ask before sending a prompt of more than N estimated tokens (0 to never ask)")
+	sysp := fs.String("s", "", "system prompt, or - to read it from stdin")
+	sysonce := fs.Bool("system-once", false, "with -c, send the system prompt only if the history sent has none")
+	sysevery := fs.Int("system-every", 0, "repeat the system prompt before every Nth user turn of a long conversation")
+	dropsys := fs.Bool("drop-system", false, "send no system messages at all, whatever the history and flags say")
+	sysname := fs.String("sp", "", "system prompt from $home/lib/llm/prompts/NAME")
+	listp := fs.Bool("list-prompts", false, "list the named system prompts and exit")
+	view := fs.Bool("view", false, "print the history and exit")
+	sincef := fs.String("since", "", "with -view, only messages newer than a duration (24h, 7d) or date")
+	redactf := fs.Bool("redact", false, "with -view, mask emails, keys and the config's redact patterns")
+	undated := fs.Bool("include-undated", false, "with -since, keep messages that have no timestamp")
+	cont := fs.Bool("c", false, "continue with history via NDB")
+	contint := fs.Bool("ci", false, "continue with history and keep chatting interactively")
+	prefix := fs.String("prompt-prefix", "", "text put before every prompt")
+	suffix := fs.String("prompt-suffix", "", "text put after every prompt")
+	replyrole := fs.String("reply-role", "assistant", "role to store the reply under in the history")
+	role := fs.String("role", "user", "role of the prompt message: user, system or assistant")
+	session := fs.String("session", SESSION, "name of the conversation to keep the history in")
+	prune := fs.Int("prune-sessions", 0, "delete all but the N most recently used sessions and exit")
+	migratef := fs.Bool("migrate", false, "upgrade the session's ndb history to the current format and exit")
+	force := fs.Bool("f", false, "with -prune-sessions, delete without asking")
+	maxhist := fs.Int64("max-history-bytes", 64<<20, "load at most the last N bytes of a history file (0 for no limit)")
+	last := fs.Int("last", 0, "load only the last N history records (0 for all)")
+	store := fs.String("store", "ndb", "history backend: ndb, jsonl or sqlite")
+	api := fs.String("api", "chat", "OpenAI API to call: chat or responses")
+	batchf := fs.String("batch", "", "send each line of this file as a prompt of its own")
+	drycostf := fs.Bool("dry-cost", false, "with -batch, print the estimated tokens and cost of every prompt and send nothing")
+	diff := fs.String("diff", "", "review a diff: git (runs git diff), - (stdin) or a file")
+	schemaf := fs.String("schema", "", "ask for JSON matching the JSON schema in this file and check the reply")
+	tmpl := fs.String("template", "", "use the named template from the config as the prompt")
+	vars := tmplvars{}
+	fs.Var(vars, "var", "template variable as name=value or name=@file (repeatable)")
+	count := fs.Bool("count-tokens", false, "print an estimated prompt token count and exit without sending")
+	wrapc := fs.String("wrap-code", "", "wrap the reply in a markdown code fence tagged with this language (auto to guess it)")
+	nsample := fs.Int("parallel-sample", 0, "send the prompt as N separate requests at once and print every reply")
+	autocont := fs.Int("autocontinue", 0, "when the reply is cut at the token limit, ask for the rest up to N times")
+	contcode := fs.Int("continue-code", 0, "when the reply is cut inside a fenced code block, ask for the rest of the code up to `N` times")
+	retries := fs.Int("retries", 0, "retry rate limited, failed or unreachable requests this many times")
+	budget := fs.Duration("retry-budget", 0, "give up once this much time has passed, first attempt and retries together (0 for no limit)")
+	idemkey := fs.String("idempotency-key", "", "Idempotency-Key header to send (default a new UUID per request)")
+	promptsonly := fs.Bool("store-prompts-only", false, "with -c, keep only the prompts in the history, not the replies")
+	saveusage := fs.Bool("save-usage", false, "store the token usage on each history reply")
+	measuref := fs.Bool("measure", false, "print the time to first byte, total time and tokens per second on stderr")
+	warntok := fs.Int("warn-tokens", 0, "warn when the rate limit leaves fewer than N tokens, saying when it resets")
+	rlimit := fs.Bool("ratelimit", false, "print the rate limit allowances left after each request")
+	strip := fs.Bool("strip-thinking", false, "remove <think>...</think> scratchpad blocks from the reply")
+	thinktags := fs.String("think-tags", "<think>,</think>", "with -strip-thinking, the open and close tags, comma separated")
+	post := fs.String("postprocess", "", "pipe the reply through this shell command before printing and storing it")
+	failempty := fs.Bool("fail-on-empty", false, "exit with status 5 when the reply is empty")
+	strict := fs.Bool("strict", false, "treat truncated, filtered or empty replies as errors")
+	stream := fs.Bool("S", false, "stream the reply, printing it as it arrives")
+	out := fs.String("o", "", "write the reply to this file instead of stdout")
+	clip := fs.Bool("clip", false, "read the prompt from the clipboard (/dev/snarf on Plan 9)")
+	toclip := fs.Bool("reply-to-clip", false, "copy the reply to the clipboard as well")
+	pager := fs.Bool("pager", false, "show the reply in $PAGER, or highlighted with bat when its language can be told")
+	tee := fs.String("tee", "", "write the reply to this file as well as printing it")
+	nonl := fs.Bool("no-newline", false, "do not print a newline after the reply")
+	logprobs := fs.Int("logprobs", -1, "ask for token log probabilities plus the N likeliest alternatives (0-20) and print them on stderr")
+	b64in := fs.Bool("base64-prompt", false, "the prompt on stdin is base64; decode it first")
+	b64out := fs.Bool("reply-base64", false, "print the reply base64 encoded")
+	replayf := fs.String("replay-roles", "", "with -c, send only the history messages in these comma separated `roles`, e.g. user,assistant")
+	fromlastf := fs.Bool("from-last", false, "put the session's last reply before the prompt, for a follow up such as \"Now translate the above\"")
+	replystats := fs.Bool("reply-stats", false, "print the characters, words and lines of the reply on stderr")
+	tracef := fs.String("trace-id", "", "W3C trace id to send in a traceparent header and put in the log (default from $TRACEPARENT, else a new one)")
+	orgf := fs.String("org", "", "OpenAI organization to send as OpenAI-Organization (default $OPENAI_ORG_ID)")
+	projectf := fs.String("project", "", "OpenAI project to send as OpenAI-Project, for project keys (default $OPENAI_PROJECT)")
+	sumfile := fs.String("summarize-file", "", "summarize `file`, however long, a chunk at a time and then the summaries together, and exit")
+	chunktok := fs.Int("chunk-tokens", 3000, "with -summarize-file, the estimated tokens in each chunk")
+	chunkover := fs.Int("chunk-overlap", 200, "with -summarize-file, the estimated tokens each chunk repeats from the one before")
+	backupf := fs.String("backup", "", "copy the session's history into a new timestamped directory in `dir`, check the copy and exit")
+	backupall := fs.Bool("backup-all", false, "with -backup, copy every session's history")
+	split := fs.String("split", "", "print the parts of the reply between lines that are `delim` one by one, numbered")
+	splitdir := fs.String("split-dir", "", "with -split, write the parts to part-1, part-2 ... in `dir` instead")
+	quietf := fs.Bool("q", false, "print no warnings or notes on stderr, only errors and what flags ask for")
+	doc := fs.String("doc", "", "send `file` as the prompt and append the reply to it, growing a document run by run")
+	validatef := fs.Bool("validate-config", false, "check the config for unknown keys, bad values and missing files, and exit")
+	errlog := fs.String("error-log", "", "also append what slm logs, errors above all, to `file`, timestamped, with keys masked")
+	linehistf := fs.Bool("line-history", false, "with -ci, keep the prompts typed in $home/lib/llm/repl.history and recall them with !!, !N and !text")
+	keyrotate := fs.Bool("key-rotate", false, "when the key is refused (401, insufficient_quota), try $KEYENV_2, $KEYENV_3 and so on")
+	batchjsonlf := fs.String("batch-jsonl", "", "with -batch, stream every reply and write each as a JSON line in `order`: completion or input")
+	adaptive := fs.Bool("adaptive-rate", false, "in -batch, -ci and -stdin-delimiter, slow down as the rate limit headers run low")
+	dedupef := fs.String("dedupe", "", "remove repeated exchanges from the ndb history: adjacent (back to back) or all")
+	replyhash := fs.Bool("reply-hash", false, "print the sha256 of the reply on stderr")
+	mergerolesf := fs.Bool("merge-roles", false, "join messages in the same role that follow one another before sending (always done for anthropic)")
+	fingerprint := fs.Bool("print-fingerprint", false, "print the system_fingerprint of the backend that answered on stderr")
+	reqhist := fs.Bool("require-history", false, "with -c, fail rather than start afresh when the session has no history")
+	jitterf := fs.String("retry-jitter", "full", "how retry waits are randomised: none, full or equal")
+	lang := fs.String("lang", "", "ask for the reply in this language, by `code` (fr, de, ja) or name")
+	var imgfiles files
+	fs.Var(&imgfiles, "img", "send the image in `file` with the prompt, for vision models (repeatable)")
+	var ctxfiles files
+	fs.Var(&ctxfiles, "context", "send `file` as a message of its own, labelled with its name, before the prompt (repeatable)")
+	ctxrole := fs.String("context-role", "user", "role of the -context messages: user or system")
+	ctxmax := fs.Int("context-max", 32000, "leave out, with a warning, -context files past this many estimated tokens in all (0 for no limit)")
+	watchf := fs.String("watch", "", "send the prompt in `file`, and again each time it is saved, until interrupted")
+	compactf := fs.Bool("compact-on-exit", false, "with -c, drop broken and repeated records from the ndb history when done")
+	listsess := fs.Bool("list-sessions", false, "list the sessions, most recently used first, with their titles")
+	settitle := fs.String("set-title", "", "set the title of the -session")
+	autotitlef := fs.Bool("autotitle", false, "with -c, title a new session after its first exchange")
+	truncat := fs.Int("truncate-reply-at", 0, "print at most `n` characters of the reply, ending it with an ellipsis when cut")
+	trunchist := fs.Bool("truncate-history", false, "with -truncate-reply-at, store the cut reply in the history too")
+	headers := hdrflags{}
+	fs.Var(headers, "H", "send the header `Name: value` with the request (repeatable)")
+	nodefhdr := fs.Bool("no-default-headers", false, "send only the -H headers: no Content-Type, auth, Idempotency-Key or User-Agent")
+	meta := metavars{}
+	fs.Var(meta, "meta", "request metadata as key=value (repeatable), in the body's metadata or as -meta-header headers")
+	metahdr := fs.String("meta-header", "", "send -meta as headers named `prefix`KEY for a gateway to log, not in the body")
+	normrolesf := fs.Bool("normalize-roles", false, "map roles like human and ai in the loaded history to user and assistant, dropping the rest")
+	stdindelim := fs.String("stdin-delimiter", "", "answer each prompt on stdin ended by `str`, writing str after each reply, until EOF")
+	loadreq := fs.String("load-request", "", "send the chat request saved in `file` as it is and print the reply")
+	savereq := fs.String("save-request", "", "write the JSON request body to `file`, with the traceparent it went under")
+	fallback := fs.String("fallback", "", "comma separated `models` to try in turn when the model is missing or rate limited")
+	retryempty := fs.Int("retry-on-empty", 0, "resend the request up to `n` times while the reply is empty")
+	jsonretryf := fs.Int("strict-json-retry", 0, "re-ask up to `n` times, saying why, while the reply is not valid JSON (or does not match -schema)")
+	renderf := fs.Bool("render", false, "show a markdown reply with ANSI styling when stdout is a terminal and NO_COLOR is unset")
+	after := fs.String("answer-after", "", "print only the text after the last `marker` in the reply")
+	compact := fs.Bool("compact-json", false, "print a JSON reply compacted; other replies pass through")
+	field := fs.String("field", "", "print only the value at this dot path (a.b.0) of a JSON reply")
+	extract := fs.String("extract-code", "", "print only the fenced code in the reply: first or all")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, err
+		}
+		return nil, errflags // fs has told them
+	}
+
+	home := getenv("home")
+	if home == "" {
+		home = getenv("HOME")
+	}
+	confpath := *configf
+	if confpath == "" {
+		confpath = filepath.Join(home, HISTDIR, CONFFILE)
+	} else if _, err := os.Stat(confpath); err != nil {
+		// a config asked for by name has to be there
+		return nil, fmt.Errorf("-config: %v", err)
+	}
+	if *validatef {
+		// checked on its own, so a broken config can be looked at
+		return &Opts{ValidateConfig: true, ConfigPath: confpath, Home: home}, nil
+	}
+	conf, err := loadconfig(confpath)
+	if err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+
+	cli := setflags(fs)
+	if err := setdefaults(fs, conf.Defaults); err != nil {
+		return nil, fmt.Errorf("config defaults: %v", err)
+	}
+	// set this early for the warnings parseflags gives itself
+	quiet = *quietf
+
+	if *maxtok < 0 || *maxcost < 0 || *confirm < 0 {
+		return nil, fmt.Errorf("-max-tokens, -max-cost and -confirm-over must be >= 0")
+	}
+	if *retries < 0 || *budget < 0 {
+		return nil, fmt.Errorf("-retries and -retry-budget must be >= 0")
+	}
+	if *session == "" || strings.ContainsAny(*session, "/\\") || strings.HasPrefix(*session, ".") {
+		return nil, fmt.Errorf("bad session name %q", *session)
+	}
+	if *prune < 0 {
+		return nil, fmt.Errorf("-prune-sessions must be >= 0")
+	}
+	if *last < 0 {
+		return nil, fmt.Errorf("-last must be >= 0")
+	}
+	if *extract != "" && *extract != "first" && *extract != "all" {
+		return nil, fmt.Errorf("-extract-code must be first or all")
+	}
+	if *role != "user" && *role != "system" && *role != "assistant" {
+		return nil, fmt.Errorf("-role must be user, system or assistant")
+	}
+	if !rolename.MatchString(*replyrole) {
+		return nil, fmt.Errorf("bad -reply-role %q", *replyrole)
+	}
+	if *api != "chat" && *api != "responses" {
+		return nil, fmt.Errorf("-api must be chat or responses")
+	}
+	if *effort != "" && *effort != "low" && *effort != "medium" && *effort != "high" {
+		return nil, fmt.Errorf("-effort must be low, medium or high")
+	}
+	var thinkopen, thinkclose string
+	if *strip {
+		var ok bool
+		thinkopen, thinkclose, ok = strings.Cut(*thinktags, ",")
+		if !ok || thinkopen == "" || thinkclose == "" {
+			return nil, fmt.Errorf("-think-tags must be OPEN,CLOSE")
+		}
+	}
+	if *sysevery < 0 {
+		return nil, fmt.Errorf("-system-every must be >= 0")
+	}
+	if *autocont < 0 {
+		return nil, fmt.Errorf("-autocontinue must be >= 0")
+	}
+	if *contcode < 0 {
+		return nil, fmt.Errorf("-continue-code must be >= 0")
+	}
+	if *split != "" && (*stream || *pager || *nsample > 1 || *contint) {
+		return nil, fmt.Errorf("-split does not go with -S, -pager, -parallel-sample or -ci")
+	}
+	if *fromlastf && *contint {
+		return nil, fmt.Errorf("-from-last does not go with -ci")
+	}
+	if *backupall && *backupf == "" {
+		return nil, fmt.Errorf("-backup-all needs -backup")
+	}
+	if *splitdir != "" && *split == "" {
+		return nil, fmt.Errorf("-split-dir needs -split")
+	}
+	if *chunktok < 1 || *chunkover < 0 || *chunkover >= *chunktok {
+		return nil, fmt.Errorf("-chunk-tokens must be >= 1 and -chunk-overlap from 0 to less than it")
+	}
+	if *doc != "" && (*contint || *diff != "" || *tmpl != "" || *clip || fs.NArg() > 0 || *nsample > 1) {
+		return nil, fmt.Errorf("-doc is the prompt; it does not go with -ci, -diff, -template, -clip, -parallel-sample or a prompt argument")
+	}
+	if len(imgfiles) > 0 && (*contint || *batchf != "" || *watchf != "" || *stdindelim != "" || *loadreq != "" || *sumfile != "" || *doc != "") {
+		return nil, fmt.Errorf("-img goes with a single prompt; it does not go with -ci, -batch, -watch, -stdin-delimiter, -load-request, -summarize-file or -doc")
+	}
+	if len(imgfiles) > 0 && *api == "responses" {
+		return nil, fmt.Errorf("-img is sent as chat completions image parts; it does not go with -api responses")
+	}
+	if len(ctxfiles) > 0 && (*contint || *batchf != "" || *watchf != "" || *stdindelim != "" || *loadreq != "" || *sumfile != "") {
+		return nil, fmt.Errorf("-context goes with a single prompt; it does not go with -ci, -batch, -watch, -stdin-delimiter, -load-request or -summarize-file")
+	}
+	if *pager && (*out != "" || *tee != "" || *stream) {
+		return nil, fmt.Errorf("-pager does not go with -o, -tee or -S")
+	}
+	if *batchjsonlf != "" {
+		switch {
+		case *batchf == "":
+			return nil, fmt.Errorf("-batch-jsonl needs -batch")
+		case *batchjsonlf != "input" && *batchjsonlf != "completion":
+			return nil, fmt.Errorf("-batch-jsonl must be input or completion")
+		case *api != "chat":
+			return nil, fmt.Errorf("-batch-jsonl streams, so it needs -api chat")
+		}
+	}
+	if *drycostf && *batchf == "" {
+		return nil, fmt.Errorf("-dry-cost needs -batch")
+	}
+	if *batchf != "" && (*cont || *contint || *stream || *nsample > 1) {
+		return nil, fmt.Errorf("-batch does not go with -c, -ci, -S or -parallel-sample")
+	}
+	if *out != "" && *tee != "" {
+		return nil, fmt.Errorf("use -o or -tee, not both")
+	}
+	if *stream {
+		switch {
+		case *api != "chat":
+			return nil, fmt.Errorf("-S needs -api chat")
+		case *renderf || *truncat > 0 || *after != "" || *field != "" || *compact || *extract != "" || *wrapc != "" || *post != "" || *b64out:
+			return nil, fmt.Errorf("-S prints the reply as it comes, so it does not go with -render, -truncate-reply-at, -answer-after, -field, -compact-json, -extract-code, -wrap-code, -postprocess or -reply-base64")
+		case *nsample > 1:
+			return nil, fmt.Errorf("-S does not go with -parallel-sample")
+		}
+	}
+	if *loadreq != "" && *api != "chat" {
+		return nil, fmt.Errorf("-load-request replays chat requests; it needs -api chat")
+	}
+	if *jsonretryf < 0 {
+		return nil, fmt.Errorf("-strict-json-retry must be >= 0")
+	}
+	if *compactf && !*cont && !*contint {
+		return nil, fmt.Errorf("-compact-on-exit needs -c or -ci")
+	}
+	if *compactf && *store != "ndb" {
+		return nil, fmt.Errorf("-compact-on-exit works on the ndb store only")
+	}
+	if *autotitlef && !*cont {
+		return nil, fmt.Errorf("-autotitle needs -c")
+	}
+	if *nodefhdr {
+		h := http.Header(headers)
+		if h.Get("Authorization") == "" && h.Get("x-api-key") == "" {
+			warnf("-no-default-headers: no -H gives an Authorization header, so the request goes without the key")
+		}
+	}
+	if *dedupef != "" && *dedupef != "adjacent" && *dedupef != "all" {
+		return nil, fmt.Errorf("-dedupe must be adjacent or all")
+	}
+	switch *jitterf {
+	case "none", "full", "equal":
+	default:
+		return nil, fmt.Errorf("-retry-jitter must be none, full or equal")
+	}
+	if *truncat < 0 {
+		return nil, fmt.Errorf("-truncate-reply-at must be >= 0")
+	}
+	if *trunchist && *truncat == 0 {
+		return nil, fmt.Errorf("-truncate-history needs -truncate-reply-at")
+	}
+	if *retryempty < 0 {
+		return nil, fmt.Errorf("-retry-on-empty must be >= 0")
+	}
+	if *nsample < 0 {
+		return nil, fmt.Errorf("-parallel-sample must be >= 0")
+	}
+	if *nsample > 1 && (*idemkey != "" || *contint) {
+		return nil, fmt.Errorf("-parallel-sample does not go with -idempotency-key or -ci")
+	}
+	if *batchjsonlf != "" && *idemkey != "" {
+		// its requests go out in no set order, so their keys would
+		// not match from one run to the next
+		return nil, fmt.Errorf("-batch-jsonl does not go with -idempotency-key")
+	}
+	if *logprobs > 20 {
+		return nil, fmt.Errorf("-logprobs takes at most 20 alternatives")
+	}
+	if *logprobs >= 0 && *api != "chat" {
+		return nil, fmt.Errorf("-logprobs needs -api chat")
+	}
+	if _, ok := histstores[*store]; !ok {
+		return nil, fmt.Errorf("unknown history store %q", *store)
+	}
+	if *reqhist {
+		if !*cont && !*contint {
+			return nil, fmt.Errorf("-require-history needs -c or -ci")
+		}
+		path := histpath(home, *store, *session)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, fmt.Errorf("-require-history: session %q has no history (%s)", *session, path)
+		}
+	}
+
+	var cutoff time.Time
+	if *sincef != "" {
+		var err error
+		cutoff, err = parsesince(*sincef, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("-since: %v", err)
+		}
+	}
+	if *sysp != "" && *sysname != "" {
+		return nil, fmt.Errorf("use -s or -sp, not both")
+	}
+
+	var schema json.RawMessage
+	var schemaname string
+	if *schemaf != "" {
+		data, err := ioutil.ReadFile(*schemaf)
+		if err != nil {
+			return nil, fmt.Errorf("-schema: %v", err)
+		}
+		if !json.Valid(data) {
+			return nil, fmt.Errorf("-schema: %s is not valid JSON", *schemaf)
+		}
+		schema = data
+		schemaname = schemaid(*schemaf)
+	}
+
+	var redacts []*regexp.Regexp
+	if *redactf {
+		redacts = append(redacts, defredact...)
+		for _, pat := range conf.Redact {
+			re, err := regexp.Compile(pat)
+			if err != nil {
+				return nil, fmt.Errorf("redact pattern %q: %v", pat, err)
+			}
+			redacts = append(redacts, re)
+		}
+	}
+
+	prov, err := provider(*provname, conf)
+	if err != nil {
+		return nil, err
+	}
+	if prov.Model != "" && !cli["m"] {
+		*model = prov.Model
+	}
+	if len(meta) > 0 && *metahdr == "" && prov.Type == "anthropic" {
+		return nil, fmt.Errorf("anthropic takes no -meta in the body; use -meta-header")
+	}
+	if prov.Type == "anthropic" && (*api != "chat" || *stream || *batchjsonlf != "" || *logprobs >= 0 || schema != nil || len(imgfiles) > 0) {
+		return nil, fmt.Errorf("provider %s does not take -api responses, -S, -batch-jsonl, -logprobs, -schema or -img", *provname)
+	}
+	var key string
+	if prov.KeyEnv != "" {
+		key = getenv(prov.KeyEnv)
+	}
+	// -key-rotate has KEYENV_2, KEYENV_3 and on to fall back on
+	var spare []string
+	if *keyrotate && prov.KeyEnv != "" {
+		for i := 2; getenv(fmt.Sprintf("%s_%d", prov.KeyEnv, i)) != ""; i++ {
+			spare = append(spare, fmt.Sprintf("%s_%d", prov.KeyEnv, i))
+		}
+	}
+	// -ping tries every provider in the config, or failing any the
+	// one chosen
+	var pings map[string]Provider
+	if *pingf {
+		pings = map[string]Provider{}
+		for name := range conf.Providers {
+			if pings[name], err = provider(name, conf); err != nil {
+				return nil, err
+			}
+		}
+		if len(pings) == 0 {
+			pings[prov.Type] = prov
+		}
+	}
+
+	if full, ok := conf.Aliases[*model]; ok {
+		*model = full
+	}
+	*model = modelname(*model, *msuffix)
+	var roles map[string]string
+	if *normrolesf {
+		roles = map[string]string{}
+		for k, v := range defroles {
+			roles[k] = v
+		}
+		for k, v := range conf.Roles {
+			roles[k] = v
+		}
+	}
+	var fallbacks []string
+	for _, m := range strings.Split(*fallback, ",") {
+		if m = strings.TrimSpace(m); m == "" {
+			continue
+		}
+		if full, ok := conf.Aliases[m]; ok {
+			m = full
+		}
+		fallbacks = append(fallbacks, modelname(m, *msuffix))
+	}
+	if err := allowed(conf.Allow, append([]string{*model}, fallbacks...)...); err != nil {
+		return nil, err
+	}
+
+	if *prefix == "" {
+		*prefix = conf.Prefix
+	}
+	if *suffix == "" {
+		*suffix = conf.Suffix
+	}
+	if *lang != "" {
+		*suffix += "\n\n" + langmsg(*lang)
+	}
+
+	if *sysname != "" {
+		data, err := ioutil.ReadFile(filepath.Join(home, HISTDIR, PROMPTDIR, *sysname))
+		if err != nil {
+			return nil, fmt.Errorf("system prompt %s: %v", *sysname, err)
+		}
+		*sysp = strings.TrimRight(string(data), "\n")
+	}
+
+	var userp string
+	// commands that take no prompt
+	command := *listp || *view || *prune > 0 || *migratef || *showconf || *batchf != "" || *pingf || *loadreq != "" || *stdindelim != "" || *listsess || *settitle != "" || *watchf != "" || *dedupef != "" || *sumfile != "" || *backupf != ""
+	// under -s - stdin is the system prompt, so the prompt has to
+	// come from somewhere else; it is read before the command
+	// modes too, which would otherwise send "-" itself
+	if *sysp == "-" {
+		switch {
+		case *contint || *stdindelim != "" || *diff == "-" || *b64in:
+			return nil, fmt.Errorf("-s - reads the system prompt from stdin; it does not go with -ci, -stdin-delimiter, -diff - or -base64-prompt")
+		case *loadreq != "":
+			// the saved request has its system prompt in it
+			return nil, fmt.Errorf("-s - does not go with -load-request, which sends the request as it was saved")
+		case !command && fs.NArg() == 0 && *tmpl == "" && !*clip && *diff == "" && *doc == "":
+			return nil, fmt.Errorf("with -s -, give the prompt as an argument")
+		}
+		data, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("system prompt could not be read: %v", err)
+		}
+		*sysp = strings.TrimRight(string(data), "\n")
+	}
+	if command {
+		// no prompt to read
+	} else if *contint {
+		// the conversation is read line by line; an argument,
+		// if any, is the first turn
+		userp = fs.Arg(0)
+	} else if *diff != "" {
+		d, err := readdiff(*diff, stdin)
+		if err != nil {
+			return nil, fmt.Errorf("-diff: %v", err)
+		}
+		userp, err = reviewprompt(d, fs.Arg(0))
+		if err != nil {
+			return nil, fmt.Errorf("-diff: %v", err)
+		}
+	} else if *doc != "" {
+		data, err := ioutil.ReadFile(*doc)
+		if err != nil {
+			return nil, fmt.Errorf("-doc: %v", err)
+		}
+		if len(data) > DOCWARN {
+			warnf("-doc %s is %d KB and all of it is sent each run; start a new one or trim it", *doc, len(data)>>10)
+		}
+		userp = string(data)
+	} else if *tmpl != "" {
+		text, ok := conf.Templates[*tmpl]
+		if !ok {
+			return nil, fmt.Errorf("no template %q in config", *tmpl)
+		}
+		userp, err = rendertmpl(*tmpl, text, vars)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %v", *tmpl, err)
+		}
+	} else if *clip {
+		c, err := clipboard()
+		if err == nil {
+			userp, err = c.Read()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("-clip: %v", err)
+		}
+	} else if fs.NArg() > 0 {
+		userp = fs.Arg(0)
+	} else {
+		data, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("prompt could not be read: %v", err)
+		}
+		userp = string(data)
+		if *b64in {
+			if userp, err = unbase64(userp); err != nil {
+				return nil, fmt.Errorf("-base64-prompt: %v", err)
+			}
+		}
+	}
+	sent := *sysp
+	if *dropsys {
+		sent = ""
+	}
+	if !command && !*contint && emptyprompt(userp, sent) {
+		return nil, errempty
+	}
+
+	// the trace is the caller's when there is one, so the request
+	// shows up under it
+	traceid, traceflags, tracegiven := *tracef, "01", *tracef != ""
+	if traceid == "" {
+		traceid, traceflags, tracegiven = traceparent(getenv("TRACEPARENT"))
+		if !tracegiven {
+			if traceid, err = randhex(16); err != nil {
+				return nil, err
+			}
+			traceflags = "01"
+		}
+	} else if !istraceid(traceid) {
+		return nil, fmt.Errorf("-trace-id must be 32 lower case hex digits, not all zero")
+	}
+
+	var replay map[string]bool
+	if *replayf != "" && !*cont && !*contint {
+		return nil, fmt.Errorf("-replay-roles needs -c or -ci")
+	}
+	if *replayf != "" {
+		replay = map[string]bool{}
+		for _, r := range strings.Split(*replayf, ",") {
+			if r = strings.TrimSpace(r); !rolename.MatchString(r) {
+				return nil, fmt.Errorf("-replay-roles: bad role %q", r)
+			}
+			replay[r] = true
+		}
+	}
+
+	org, project := *orgf, *projectf
+	if org == "" {
+		org = getenv("OPENAI_ORG_ID")
+	}
+	if project == "" {
+		project = getenv("OPENAI_PROJECT")
+	}
+
+	var ctxmsgs []Message
+	if len(ctxfiles) > 0 {
+		if ctxmsgs, err = contextmsgs(ctxfiles, *ctxrole, *model, *ctxmax); err != nil {
+			return nil, err
+		}
+	}
+	var images []string
+	if len(imgfiles) > 0 {
+		if images, err = imageurls(imgfiles); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Opts{
+		Model:            *model,
+		Temp:             *temp,
+		SysPrompt:        *sysp,
+		UserPrompt:       userp,
+		Continue:         *cont || *contint,
+		Interactive:      *contint,
+		RateLimit:        *rlimit,
+		Measure:          *measuref,
+		SaveUsage:        *saveusage,
+		PromptsOnly:      *promptsonly,
+		Retries:          *retries,
+		AutoContinue:     *autocont,
+		Samples:          *nsample,
+		RetryBudget:      *budget,
+		PostProcess:      *post,
+		SystemOnce:       *sysonce,
+		DropSystem:       *dropsys,
+		Session:          *session,
+		Prune:            *prune,
+		Migrate:          *migratef,
+		Force:            *force,
+		IdemKey:          *idemkey,
+		Schema:           schema,
+		SchemaName:       schemaname,
+		Strict:           *strict,
+		Prefix:           *prefix,
+		Suffix:           *suffix,
+		Last:             *last,
+		Store:            *store,
+		CountTokens:      *count,
+		WrapCode:         *wrapc,
+		ExtractCode:      *extract,
+		Logprobs:         *logprobs >= 0,
+		TopLogprobs:      *logprobs,
+		Field:            *field,
+		ReplyBase64:      *b64out,
+		API:              *api,
+		Role:             *role,
+		NoNewline:        *nonl,
+		Tee:              *tee,
+		MaxTokens:        *maxtok,
+		Effort:           *effort,
+		MaxCost:          *maxcost,
+		ConfirmOver:      *confirm,
+		ListPrompts:      *listp,
+		View:             *view,
+		Since:            cutoff,
+		Undated:          *undated,
+		Redact:           redacts,
+		FailEmpty:        *failempty,
+		ShowConfig:       *showconf,
+		ConfigPath:       confpath,
+		Stream:           *stream,
+		Out:              *out,
+		Pager:            *pager,
+		WarnTokens:       *warntok,
+		ReplyToClip:      *toclip,
+		Archive:          conf.Archive,
+		ArchiveFormat:    conf.ArchiveFormat,
+		MaxHistBytes:     *maxhist,
+		Provider:         prov.Type,
+		BaseURL:          prov.URL,
+		KeyEnv:           prov.KeyEnv,
+		Batch:            *batchf,
+		DryCost:          *drycostf,
+		ReplyRole:        *replyrole,
+		Ping:             pings,
+		CompactJSON:      *compact,
+		SystemEvery:      *sysevery,
+		ThinkOpen:        thinkopen,
+		ThinkClose:       thinkclose,
+		AnswerAfter:      *after,
+		RetryEmpty:       *retryempty,
+		Fallback:         fallbacks,
+		SaveRequest:      *savereq,
+		LoadRequest:      *loadreq,
+		Render:           *renderf,
+		StdinDelim:       *stdindelim,
+		JSONRetry:        *jsonretryf,
+		Roles:            roles,
+		Meta:             meta,
+		MetaHeader:       *metahdr,
+		TruncateAt:       *truncat,
+		TruncateHist:     *trunchist,
+		ListSessions:     *listsess,
+		SetTitle:         *settitle,
+		AutoTitle:        *autotitlef,
+		Headers:          http.Header(headers),
+		NoDefaultHeaders: *nodefhdr,
+		CompactOnExit:    *compactf,
+		Watch:            *watchf,
+		Context:          ctxmsgs,
+		Images:           images,
+		Jitter:           *jitterf,
+		Fingerprint:      *fingerprint,
+		MergeRoles:       *mergerolesf,
+		ReplyHash:        *replyhash,
+		Dedupe:           *dedupef,
+		AdaptiveRate:     *adaptive,
+		BatchJSONL:       *batchjsonlf,
+		SpareKeys:        spare,
+		LineHist:         *linehistf,
+		ContinueCode:     *contcode,
+		ErrorLog:         *errlog,
+		Doc:              *doc,
+		Org:              org,
+		Project:          project,
+		SummarizeFile:    *sumfile,
+		ChunkTokens:      *chunktok,
+		ChunkOverlap:     *chunkover,
+		Split:            *split,
+		SplitDir:         *splitdir,
+		Backup:           *backupf,
+		BackupAll:        *backupall,
+		Allow:            conf.Allow,
+		TraceID:          traceid,
+		TraceFlags:       traceflags,
+		TraceGiven:       tracegiven,
+		ReplyStats:       *replystats,
+		FromLast:         *fromlastf,
+		ReplayRoles:      replay,
+		APIKey:           key,
+		Home:             home,
+	}, nil
+}
+
+// rolename is what a -reply-role may be: assistant as a rule, but
+// one can make up roles for training data.
+var rolename = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// errflags is returned by parseflags for flags it cannot parse.
+var errflags = errors.New("bad flags")
+
+// errempty is returned by parseflags when there is no prompt;
+// main prints the usage for it.
+var errempty = errors.New("empty prompt")
+
+// emptyprompt is true when there is nothing to send: a blank prompt
+// (an empty pipe, say) and no system prompt to go on.
+func emptyprompt(userp, sysp string) bool {
+	return strings.TrimSpace(userp) == "" && strings.TrimSpace(sysp) == ""
+}
+
+func ensurehistdir(home string) {
+	dir := filepath.Join(home, HISTDIR)
+	checkit(os.MkdirAll(dir, 0755), "[ERROR]: creating history dir")
+}
+
+// Config is read from $home/lib/llm/config, an ndb file:
+//
+//	template=commit text="Write a commit message for:\n{{.Diff}}"
+//	template=review file=/usr/glenda/lib/llm/review.tmpl
+//	prompt= prefix="Answer concisely: " suffix="\nReturn only the answer."
+//	redact=phone pattern="[0-9]{3}-[0-9]{4}"
+//	defaults= m=gpt-4o t=0.2 save-usage=true
+//	alias=support model=ft:gpt-4o-mini:acme::9xyz
+//	role=narrator as=system
+//	provider=local type=ollama model=llama3
+//	archive= file=/usr/glenda/lib/llm/archive.jsonl format=jsonl
+//	allow=gpt-4o-mini
+//	allow=gpt-4o*
+type Config struct {
+	Templates map[string]string
+	Aliases   map[string]string
+	Roles     map[string]string
+	Providers map[string]Provider
+	Prefix    string
+	Suffix    string
+	Redact    []string
+	Defaults  []ndb.Tuple
+	Allow     []string // models that may be used, as patterns; all if none
+
+	Archive       string
+	ArchiveFormat string
+}
+
+func loadconfig(path string) (*Config, error) {
+	conf := &Config{Templates: map[string]string{}, Aliases: map[string]string{}, Roles: map[string]string{}, Providers: map[string]Provider{}}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return conf, nil
+	}
+	db, err := ndb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rec := range db.Search("template", "") {
+		var name, text, file string
+		for _, tuple := range rec {
+			switch tuple.Attr {
+			case "template":
+				name = tuple.Val
+			case "text":
+				text = unquote(tuple.Val)
+			case "file":
+				file = tuple.Val
+			}
+		}
+		if file != "" {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, wrap("template "+name, err)
+			}
+			text = string(data)
+		}
+		conf.Templates[name] = text
+	}
+
+	for _, rec := range db.Search("defaults", "") {
+		for _, tuple := range rec {
+			if tuple.Attr != "defaults" {
+				conf.Defaults = append(conf.Defaults, ndb.Tuple{Attr: tuple.Attr, Val: unquote(tuple.Val)})
+			}
+		}
+	}
+
+	for _, rec := range db.Search("alias", "") {
+		var name, model string
+		for _, tuple := range rec {
+			switch tuple.Attr {
+			case "alias":
+				name = tuple.Val
+			case "model":
+				model = tuple.Val
+			}
+		}
+		if name != "" && model != "" {
+			conf.Aliases[name] = model
+		}
+	}
+
+	for _, rec := range db.Search("role", "") {
+		var name, as string
+		for _, tuple := range rec {
+			switch tuple.Attr {
+			case "role":
+				name = tuple.Val
+			case "as":
+				as = tuple.Val
+			}
+		}
+		if name != "" && as != "" {
+			conf.Roles[strings.ToLower(name)] = as
+		}
+	}
+
+	for _, rec := range db.Search("provider", "") {
+		var name string
+		var p Provider
+		for _, tuple := range rec {
+			switch tuple.Attr {
+			case "provider":
+				name = tuple.Val
+			case "type":
+				p.Type = tuple.Val
+			case "url":
+				p.URL = tuple.Val
+			case "keyenv":
+				p.KeyEnv = tuple.Val
+			case "model":
+				p.Model = tuple.Val
+			}
+		}
+		if name != "" {
+			if p.Type == "" {
+				p.Type = "openai"
+			}
+			conf.Providers[name] = p
+		}
+	}
+
+	for _, rec := range db.Search("archive", "") {
+		for _, tuple := range rec {
+			switch tuple.Attr {
+			case "file":
+				conf.Archive = tuple.Val
+			case "format":
+				conf.ArchiveFormat = tuple.Val
+			}
+		}
+	}
+	if f := conf.ArchiveFormat; f != "" && f != "jsonl" && f != "markdown" {
+		return nil, fmt.Errorf("archive format must be jsonl or markdown, not %q", f)
+	}
+
+	for _, rec := range db.Search("redact", "") {
+		for _, tuple := range rec {
+			if tuple.Attr == "pattern" {
+				conf.Redact = append(conf.Redact, tuple.Val)
+			}
+		}
+	}
+
+	for _, rec := range db.Search("allow", "") {
+		for _, tuple := range rec {
+			if tuple.Attr != "allow" || tuple.Val == "" {
+				continue
+			}
+			if _, err := filepath.Match(tuple.Val, ""); err != nil {
+				return nil, fmt.Errorf("allow=%s: %v", tuple.Val, err)
+			}
+			conf.Allow = append(conf.Allow, tuple.Val)
+		}
+	}
+
+	for _, rec := range db.Search("prompt", "") {
+		for _, tuple := range rec {
+			switch tuple.Attr {
+			case "prefix":
+				conf.Prefix = unquote(tuple.Val)
+			case "suffix":
+				conf.Suffix = unquote(tuple.Val)
+			}
+		}
+	}
+	return conf, nil
+}
+
+// confattrs are the attributes each kind of config record may have,
+// besides its own; defaults= takes flag names instead.
+var confattrs = map[string][]string{
+	"template": {"text", "file"},
+	"defaults": nil,
+	"alias":    {"model"},
+	"role":     {"as"},
+	"provider": {"type", "url", "keyenv", "model"},
+	"archive":  {"file", "format"},
+	"redact":   {"pattern"},
+	"prompt":   {"prefix", "suffix"},
+	"allow":    nil,
+}
+
+// validateconfig checks the config at path for -validate-config,
+// saying on w what is wrong and what only looks wrong: unknown records
+// and attributes (typos, most likely) and unset key variables are
+// warnings; unreadable files, bad flag values and incomplete records
+// are errors, and make it return false. The defaults are set on fs
+// to check them, so fs is no good for a run afterwards.
+func validateconfig(w io.Writer, fs *flag.FlagSet, path, home string) bool {
+	ok := true
+	warn := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, "%s: warning: %s\n", path, fmt.Sprintf(format, args...))
+	}
+	bad := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, "%s: error: %s\n", path, fmt.Sprintf(format, args...))
+		ok = false
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		warn("no config; the built in defaults are used")
+		return true
+	}
+	if err != nil {
+		bad("%v", err)
+		return false
+	}
+	db, err := ndb.Open(path)
+	if err != nil {
+		bad("%v", err)
+		return false
+	}
+
+	// ndb has no way to list every record, so their kinds are read
+	// off the lines that start one
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || line[0] == ' ' || line[0] == '\t' || line[0] == '#' {
+			continue
+		}
+		kind, _, _ := strings.Cut(fields[0], "=")
+		if _, known := confattrs[kind]; !known {
+			warn("line %d: unknown record %s=", i+1, kind)
+		}
+	}
+
+	kinds := make([]string, 0, len(confattrs))
+	for kind := range confattrs {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	provs := map[string]bool{}
+	for _, kind := range kinds {
+		attrs := confattrs[kind]
+		for _, rec := range db.Search(kind, "") {
+			if rec[0].Attr != kind {
+				continue
+			}
+			name, vals := rec[0].Val, map[string]string{}
+			for _, t := range rec[1:] {
+				vals[t.Attr] = unquote(t.Val)
+				if kind == "defaults" {
+					if fs.Lookup(t.Attr) == nil {
+						warn("defaults: no flag -%s", t.Attr)
+					} else if err := fs.Set(t.Attr, vals[t.Attr]); err != nil {
+						bad("defaults: -%s: %v", t.Attr, err)
+					}
+					continue
+				}
+				known := false
+				for _, a := range attrs {
+					known = known || t.Attr == a
+				}
+				if !known {
+					warn("%s=%s: unknown attribute %s", kind, name, t.Attr)
+				}
+			}
+			switch kind {
+			case "template":
+				if f := vals["file"]; f != "" {
+					if _, err := os.Stat(f); err != nil {
+						bad("template=%s: %v", name, err)
+					}
+				} else if _, has := vals["text"]; !has {
+					bad("template=%s: has neither text= nor file=", name)
+				}
+			case "alias":
+				if vals["model"] == "" {
+					bad("alias=%s: no model=", name)
+				}
+			case "role":
+				switch vals["as"] {
+				case "system", "user", "assistant":
+				default:
+					bad("role=%s: as= must be system, user or assistant", name)
+				}
+			case "provider":
+				provs[name] = true
+				typ := vals["type"]
+				if typ == "" {
+					typ = "openai"
+				}
+				def, known := provtypes[typ]
+				if !known {
+					bad("provider=%s: type must be openai, anthropic or ollama", name)
+					break
+				}
+				keyenv := vals["keyenv"]
+				if keyenv == "" {
+					keyenv = def.KeyEnv
+				}
+				if keyenv != "" && getenv(keyenv) == "" {
+					warn("provider=%s: $%s is not set", name, keyenv)
+				}
+			case "archive":
+				if vals["file"] == "" {
+					bad("archive: no file=")
+				} else if _, err := os.Stat(filepath.Dir(vals["file"])); err != nil {
+					bad("archive: %v", err)
+				}
+				if f := vals["format"]; f != "" && f != "jsonl" && f != "markdown" {
+					bad("archive: format must be jsonl or markdown, not %q", f)
+				}
+			case "redact":
+				if _, err := regexp.Compile(vals["pattern"]); err != nil {
+					bad("redact=%s: %v", name, err)
+				}
+			case "allow":
+				if _, err := filepath.Match(name, ""); err != nil {
+					bad("allow=%s: %v", name, err)
+				}
+			}
+		}
+	}
+
+	// what the defaults point at has to be there
+	if f := fs.Lookup("sp"); f.Value.String() != "" {
+		if _, err := os.Stat(filepath.Join(home, HISTDIR, PROMPTDIR, f.Value.String())); err != nil {
+			bad("defaults: -sp: %v", err)
+		}
+	}
+	if f := fs.Lookup("provider"); f.Value.String() != "" {
+		if _, known := provtypes[f.Value.String()]; !known && !provs[f.Value.String()] {
+			bad("defaults: no provider %q", f.Value.String())
+		}
+	}
+	if ok {
+		fmt.Fprintf(w, "%s: ok\n", path)
+	}
+	return ok
+}
+
+// allowed refuses the models that match none of the allow= patterns
+// of a shared config. Aliases count by the model they stand for.
+func allowed(allow []string, models ...string) error {
+	if len(allow) == 0 {
+		return nil
+	}
+	for _, m := range models {
+		ok := false
+		for _, pat := range allow {
+			if match, _ := filepath.Match(pat, m); match {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("model %s is not allowed by the config (allow: %s)", m, strings.Join(allow, ", "))
+		}
+	}
+	return nil
+}
+
+// showconfig prints what a run would use, for -show-config: the
+// config file, the endpoint, the key (masked) and every flag once
+// the config defaults and the command line are applied.
+func showconfig(w io.Writer, fs *flag.FlagSet, opts *Opts) {
+	fmt.Fprintf(w, "config=%q\n", opts.ConfigPath)
+	fmt.Fprintf(w, "provider=%q\n", opts.Provider)
+	fmt.Fprintf(w, "endpoint=%q\n", endpoint(opts))
+	fmt.Fprintf(w, "key=%q\n", maskkey(opts.APIKey))
+	fmt.Fprintf(w, "history=%q\n", histpath(opts.Home, opts.Store, opts.Session))
+	fs.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "config":
+		case "H":
+			fmt.Fprintf(w, "%s=%q\n", f.Name, fmt.Sprint(maskheaders(opts.Headers)))
+		default:
+			fmt.Fprintf(w, "%s=%q\n", f.Name, f.Value.String())
+		}
+	})
+}
+
+// maskheaders is h with the values of credential headers masked like
+// the key: an auth scheme such as Bearer is kept.
+func maskheaders(h http.Header) http.Header {
+	m := http.Header{}
+	for name, vals := range h {
+		for _, v := range vals {
+			if credheader(name) {
+				if scheme, cred, ok := strings.Cut(v, " "); ok && !strings.ContainsAny(scheme, "=:") {
+					v = scheme + " " + maskkey(cred)
+				} else {
+					v = maskkey(v)
+				}
+			}
+			m.Add(name, v)
+		}
+	}
+	return m
+}
+
+// credheader is true for headers that carry a credential.
+func credheader(name string) bool {
+	n := strings.ToLower(name)
+	for _, w := range []string{"auth", "key", "token", "secret", "cookie", "password"} {
+		if strings.Contains(n, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskkey keeps just enough of an API key to tell keys apart.
+func maskkey(key string) string {
+	switch {
+	case key == "":
+		return "(unset)"
+	case len(key) <= 12:
+		return "****"
+	}
+	return key[:3] + "..." + key[len(key)-4:]
+}
+
+// modelname adds a fine-tune suffix such as "acme::9xyz" to base,
+// which may already be a fine-tuned name to go on from.
+func modelname(base, suffix string) string {
+	if suffix == "" {
+		return base
+	}
+	suffix = strings.TrimPrefix(suffix, ":")
+	if !strings.HasPrefix(base, "ft:") {
+		base = "ft:" + base
+	}
+	return base + ":" + suffix
+}
+
+// Provider is an API to send to. The config names them:
+//
+//	provider=local type=ollama model=llama3
+//	provider=work type=openai url=https://llm.example.com/v1 keyenv=WORK_KEY
+type Provider struct {
+	Type   string // openai, anthropic or ollama
+	URL    string // base URL, up to the /v1
+	KeyEnv string // environment variable holding the key, if one is needed
+	Model  string // used unless -m is given
+}
+
+// provtypes are the defaults for each type of provider, and can be
+// used by type name without a config record.
+var provtypes = map[string]Provider{
+	"openai":    {Type: "openai", URL: BASEURL, KeyEnv: "OPENAI_API_KEY"},
+	"anthropic": {Type: "anthropic", URL: "https://api.anthropic.com/v1", KeyEnv: "ANTHROPIC_API_KEY"},
+	"ollama":    {Type: "ollama", URL: "http://localhost:11434/v1"},
+}
+
+// provider looks name up in the config and then among the types,
+// filling in what a config record leaves out from its type.
+func provider(name string, conf *Config) (Provider, error) {
+	if name == "" {
+		name = "openai"
+	}
+	p, ok := conf.Providers[name]
+	if !ok {
+		p, ok = provtypes[name]
+		if !ok {
+			return Provider{}, fmt.Errorf("no provider %q in the config", name)
+		}
+		return p, nil
+	}
+	def, ok := provtypes[p.Type]
+	if !ok {
+		return Provider{}, fmt.Errorf("provider %s: type must be openai, anthropic or ollama", name)
+	}
+	if p.URL == "" {
+		p.URL = def.URL
+	}
+	if p.KeyEnv == "" {
+		p.KeyEnv = def.KeyEnv
+	}
+	p.URL = strings.TrimRight(p.URL, "/")
+	return p, nil
+}
+
+// setauth adds the key to h the way the provider type wants it.
+func setauth(h http.Header, ptype, key string) {
+	switch {
+	case ptype == "anthropic":
+		h.Set("x-api-key", key)
+		h.Set("anthropic-version", ANTHROPICVER)
+	case key != "":
+		h.Set("Authorization", "Bearer "+key)
+	}
+}
+
+// setscope adds the OpenAI organization and project a key is used
+// for, leaving out whichever is unset.
+func setscope(h http.Header, org, project string) {
+	if org != "" {
+		h.Set("OpenAI-Organization", org)
+	}
+	if project != "" {
+		h.Set("OpenAI-Project", project)
+	}
+}
+
+// Ping is how long a provider took to list its models, or why it
+// could not.
+type Ping struct {
+	Name string
+	Time time.Duration
+	Err  error
+}
+
+// ping asks each provider for /models at once, giving up on those that
+// take longer than timeout, and returns the answers fastest first with
+// the failures last.
+func ping(provs map[string]Provider, timeout time.Duration) []Ping {
+	pings := make([]Ping, 0, len(provs))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, p := range provs {
+		wg.Add(1)
+		go func(name string, p Provider) {
+			defer wg.Done()
+			d, err := pingone(p, timeout)
+			mu.Lock()
+			pings = append(pings, Ping{name, d, err})
+			mu.Unlock()
+		}(name, p)
+	}
+	wg.Wait()
+	sort.Slice(pings, func(i, j int) bool {
+		a, b := pings[i], pings[j]
+		if (a.Err == nil) != (b.Err == nil) {
+			return a.Err == nil
+		}
+		if a.Time != b.Time {
+			return a.Time < b.Time
+		}
+		return a.Name < b.Name
+	})
+	return pings
+}
+
+func pingone(p Provider, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", p.URL+"/models", nil)
+	if err != nil {
+		return 0, err
+	}
+	key := ""
+	if p.KeyEnv != "" {
+		key = getenv(p.KeyEnv)
+	}
+	setauth(req.Header, p.Type, key)
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	d := time.Since(start)
+	if resp.StatusCode != http.StatusOK {
+		return d, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return d, nil
+}
+
+// printpings reports ping's answers, marking the fastest.
+func printpings(w io.Writer, pings []Ping) {
+	for i, p := range pings {
+		switch {
+		case p.Err != nil:
+			fmt.Fprintf(w, "%s\tunreachable: %v\n", p.Name, p.Err)
+		case i == 0:
+			fmt.Fprintf(w, "%s\t%v\tfastest\n", p.Name, p.Time.Round(100*time.Microsecond))
+		default:
+			fmt.Fprintf(w, "%s\t%v\n", p.Name, p.Time.Round(100*time.Microsecond))
+		}
+	}
+}
+
+func endpoint(opts *Opts) string {
+	switch {
+	case opts.Provider == "anthropic":
+		return opts.BaseURL + "/messages"
+	case opts.API == "responses":
+		return opts.BaseURL + "/responses"
+	}
+	return opts.BaseURL + "/chat/completions"
+}
+
+// setflags are the flags set so far.
+func setflags(fs *flag.FlagSet) map[string]bool {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// setdefaults sets the flags named in the config's defaults record
+// that the command line left alone, so explicit flags always win.
+func setdefaults(fs *flag.FlagSet, defs []ndb.Tuple) error {
+	set := setflags(fs)
+	for _, d := range defs {
+		if fs.Lookup(d.Attr) == nil {
+			return fmt.Errorf("no flag -%s", d.Attr)
+		}
+		if set[d.Attr] {
+			continue
+		}
+		if err := fs.Set(d.Attr, d.Val); err != nil {
+			return fmt.Errorf("-%s: %v", d.Attr, err)
+		}
+	}
+	return nil
+}
+
+// unquote undoes the Go-style escapes (\n, \t, ...) ndb leaves in
+// place once it has stripped the surrounding quotes.
+func unquote(val string) string {
+	if s, err := strconv.Unquote(`"` + val + `"`); err == nil {
+		return s
+	}
+	return val
+}
+
+const reviewintro = `Review this change. Point out bugs, risky or unclear code and missing
+tests, citing file and line, and say briefly what is good. Do not restate
+the diff.`
+
+// readdiff gets the diff to review from git, stdin or a file.
+func readdiff(src string, stdin io.Reader) (string, error) {
+	switch src {
+	case "git":
+		out, err := exec.Command("git", "diff").Output()
+		if err != nil {
+			var ee *exec.ExitError
+			if errors.As(err, &ee) && len(ee.Stderr) > 0 {
+				msg, _, _ := strings.Cut(strings.TrimSpace(string(ee.Stderr)), "\n")
+				return "", errors.New("git diff: " + msg)
+			}
+			return "", err
+		}
+		return string(out), nil
+	case "-":
+		data, err := ioutil.ReadAll(stdin)
+		return string(data), err
+	default:
+		data, err := ioutil.ReadFile(src)
+		return string(data), err
+	}
+}
+
+// reviewprompt wraps diff as a code review request, with extra as
+// any further instructions from the command line.
+func reviewprompt(diff, extra string) (string, error) {
+	if strings.TrimSpace(diff) == "" {
+		return "", errors.New("no changes to review")
+	}
+	var b strings.Builder
+	b.WriteString(reviewintro)
+	if extra != "" {
+		b.WriteString("\n\n" + extra)
+	}
+	b.WriteString("\n\n```diff\n" + strings.TrimRight(diff, "\n") + "\n```\n")
+	return b.String(), nil
+}
+
+// schemaid names a schema after its file, keeping to the letters,
+// digits, _ and - the API allows.
+func schemaid(path string) string {
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	id := strings.Map(func(r rune) rune {
+		if r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r)) || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, base)
+	if id == "" {
+		id = "schema"
+	}
+	return id
+}
+
+// tmplvars collects repeated -var name=value flags; a value of
+// @file is replaced by the contents of file.
+type tmplvars map[string]string
+
+func (v tmplvars) String() string {
+	return fmt.Sprint(map[string]string(v))
+}
+
+func (v tmplvars) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("want name=value, got %q", s)
+	}
+	val := kv[1]
+	if strings.HasPrefix(val, "@") {
+		data, err := ioutil.ReadFile(val[1:])
+		if err != nil {
+			return err
+		}
+		val = string(data)
+	}
+	v[kv[0]] = val
+	return nil
+}
+
+// langnames names the languages -lang knows by code; anything else
+// is used as given.
+var langnames = map[string]string{
+	"ar": "Arabic", "de": "German", "en": "English", "es": "Spanish",
+	"fr": "French", "hi": "Hindi", "it": "Italian", "ja": "Japanese",
+	"ko": "Korean", "nl": "Dutch", "pl": "Polish", "pt": "Portuguese",
+	"ru": "Russian", "sv": "Swedish", "tr": "Turkish", "uk": "Ukrainian",
+	"zh": "Chinese",
+}
+
+// langmsg is the instruction -lang adds after the prompt.
+func langmsg(code string) string {
+	name, ok := langnames[strings.ToLower(code)]
+	if !ok {
+		name = code
+	}
+	return "Respond in " + name + "."
+}
+
+// files collects repeated file name flags, in order.
+type files []string
+
+func (f *files) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *files) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// contextmsgs reads each -context file into a message headed by its
+// name. Files that would take the total past max tokens are left out
+// with a warning.
+func contextmsgs(paths []string, role, model string, max int) ([]Message, error) {
+	if role != "user" && role != "system" {
+		return nil, fmt.Errorf("-context-role must be user or system")
+	}
+	var msgs []Message
+	total := 0
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("-context: %v", err)
+		}
+		text := fmt.Sprintf("File: %s\n\n%s", path, data)
+		n := counttokens(model, text)
+		if max > 0 && total+n > max {
+			warnf("-context: leaving out %s (about %d tokens), over -context-max %d", path, n, max)
+			continue
+		}
+		total += n
+		msgs = append(msgs, Message{Role: role, Content: text})
+	}
+	return msgs, nil
+}
+
+// imageurls reads each -img file into a data URL, the type told from
+// its first bytes.
+func imageurls(paths []string) ([]string, error) {
+	var urls []string
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("-img: %v", err)
+		}
+		mime := http.DetectContentType(data)
+		if !strings.HasPrefix(mime, "image/") {
+			return nil, fmt.Errorf("-img: %s is not an image (%s)", path, mime)
+		}
+		urls = append(urls, "data:"+mime+";base64,"+base64.StdEncoding.EncodeToString(data))
+	}
+	return urls, nil
+}
+
+// hdrflags collects repeated -H "Name: value" flags.
+type hdrflags http.Header
+
+func (h hdrflags) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h hdrflags) Set(s string) error {
+	name, val, ok := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("want Name: value, got %q", s)
+	}
+	http.Header(h).Add(name, strings.TrimSpace(val))
+	return nil
+}
+
+// metavars collects repeated -meta key=value flags.
+type metavars map[string]string
+
+var metakey = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func (v metavars) String() string {
+	return fmt.Sprint(map[string]string(v))
+}
+
+func (v metavars) Set(s string) error {
+	key, val, ok := strings.Cut(s, "=")
+	switch {
+	case !ok:
+		return fmt.Errorf("want key=value, got %q", s)
+	case !metakey.MatchString(key):
+		return fmt.Errorf("key %q must be 1-64 letters, digits, _ or -", key)
+	case strings.ContainsAny(val, "\r\n"):
+		return fmt.Errorf("value of %s has a line break", key)
+	}
+	v[key] = val
+	return nil
+}
+
+func rendertmpl(name, text string, vars tmplvars) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, map[string]string(vars)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// errorlog is the -error-log: everything slm logs is appended to the
+// file as well, a line each, stamped with the time, session, model
+// and trace and with keys and default -redact patterns masked. Until
+// the flags are parsed opts is nil, and only the patterns mask.
+type errorlog struct {
+	path   string
+	opts   *Opts
+	failed bool
+}
+
+func (e *errorlog) Write(p []byte) (int, error) {
+	msg := strings.TrimPrefix(string(p), log.Prefix())
+	if log.Flags()&(log.Ldate|log.Ltime) == log.Ldate|log.Ltime && len(msg) > len(logstamp) {
+		msg = msg[len(logstamp):]
+	}
+	msg = strings.TrimRight(msg, "\n")
+	o := e.opts
+	if o == nil {
+		o = &Opts{}
+	}
+	for _, k := range secrets(o) {
+		msg = strings.ReplaceAll(msg, k, "[redacted]")
+	}
+	for _, re := range defredact {
+		msg = re.ReplaceAllString(msg, "[redacted]")
+	}
+	msg = strings.ReplaceAll(msg, "\n", " ")
+	f, err := os.OpenFile(e.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = fmt.Fprintf(f, "%s session=%s model=%s trace=%s: %s\n",
+			time.Now().UTC().Format(time.RFC3339), o.Session, o.Model, o.TraceID, msg)
+		f.Close()
+	}
+	if err != nil && !e.failed {
+		e.failed = true
+		warnf("-error-log: %v", err)
+	}
+	return len(p), nil
+}
+
+// errorlogarg is the -error-log file named in args, found ahead of
+// parseflags; one set only by the config defaults is opened after it.
+func errorlogarg(args []string) string {
+	for i, a := range args {
+		if a == "--" {
+			break
+		}
+		name, val, hasval := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(a, "-"), "-"), "=")
+		if name != "error-log" {
+			continue
+		}
+		if hasval {
+			return val
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// logstamp is the shape of the date and time log puts first.
+const logstamp = "2006/01/02 15:04:05 "
+
+// secrets are the values an error log must never hold: the API keys
+// and the values of auth headers.
+func secrets(opts *Opts) []string {
+	var ks []string
+	if opts.APIKey != "" {
+		ks = append(ks, opts.APIKey)
+	}
+	for _, env := range append([]string{opts.KeyEnv}, opts.SpareKeys...) {
+		if k := getenv(env); env != "" && k != "" {
+			ks = append(ks, k)
+		}
+	}
+	for _, h := range []string{"Authorization", "X-Api-Key", "Api-Key"} {
+		for _, v := range opts.Headers.Values(h) {
+			if v != "" {
+				ks = append(ks, v)
+			}
+		}
+	}
+	return ks
+}
+
+// defredact are masked by -redact along with the config patterns:
+// email addresses, OpenAI style keys and bearer tokens.
+var defredact = []*regexp.Regexp{
+	regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	regexp.MustCompile(`sk-[A-Za-z0-9_-]{16,}`),
+	regexp.MustCompile(`(?i)bearer [A-Za-z0-9._~+/=-]{16,}`),
+}
+
+// redact returns copies of msgs with whatever pats match masked, for
+// showing a history without changing it.
+func redact(msgs []Message, pats []*regexp.Regexp) []Message {
+	out := make([]Message, len(msgs))
+	for i, m := range msgs {
+		for _, re := range pats {
+			m.Content = re.ReplaceAllString(m.Content, "[redacted]")
+		}
+		out[i] = m
+	}
+	return out
+}
+
+func viewhist(w io.Writer, msgs []Message) {
+	for _, m := range msgs {
+		if m.Time.IsZero() {
+			fmt.Fprintf(w, "%s:\n%s\n\n", m.Role, m.Content)
+		} else {
+			fmt.Fprintf(w, "%s (%s):\n%s\n\n", m.Role, m.Time.Local().Format("2006-01-02 15:04"), m.Content)
+		}
+	}
+}
+
+// parsesince takes a duration back from now, with d for days, or an
+// absolute date or RFC3339 time.
+func parsesince(s string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(s, "d") {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("want a duration like 24h or 7d, or a date like 2006-01-02, got %q", s)
+}
+
+// since keeps the messages at or after cutoff. Undated messages,
+// from before history had timestamps, are kept only if asked for.
+func since(msgs []Message, cutoff time.Time, undated bool) []Message {
+	var out []Message
+	for _, m := range msgs {
+		if m.Time.IsZero() {
+			if undated {
+				out = append(out, m)
+			}
+			continue
+		}
+		if !m.Time.Before(cutoff) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// prune removes the sessions of the current store beyond the
+// opts.Prune most recently modified, asking first unless -f.
+func prune(opts *Opts) {
+	dir := filepath.Join(opts.Home, HISTDIR)
+	old, err := stalesessions(dir, histstores[opts.Store].ext, opts.Prune)
+	checkit(err, "[ERROR]: listing sessions")
+	if len(old) == 0 {
+		return
+	}
+	if !opts.Force {
+		for _, path := range old {
+			fmt.Fprintln(stderr, path)
+		}
+		fmt.Fprintf(stderr, "remove %d sessions? [y/N] ", len(old))
+		answer, _ := bufio.NewReader(stdin).ReadString('\n')
+		if a := strings.TrimSpace(answer); a != "y" && a != "yes" {
+			return
+		}
+	}
+	for _, path := range old {
+		checkit(os.Remove(path), "[ERROR]: removing session")
+		os.Remove(strings.TrimSuffix(path, histstores[opts.Store].ext) + TITLEEXT)
+		fmt.Fprintln(stdout, "removed", path)
+	}
+}
+
+// Session is a conversation's history file.
+type Session struct {
+	Name  string
+	Path  string
+	Mtime time.Time
+}
+
+// sessions lists the session files in dir with extension ext, the
+// most recently modified first.
+func sessions(dir, ext string) ([]Session, error) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var all []Session
+	for _, e := range ents {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ext) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(e.Name(), ext)
+		all = append(all, Session{name, filepath.Join(dir, e.Name()), fi.ModTime()})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Mtime.After(all[j].Mtime)
+	})
+	return all, nil
+}
+
+// stalesessions lists the session files in dir with extension ext
+// other than the keep most recently modified.
+func stalesessions(dir, ext string, keep int) ([]string, error) {
+	all, err := sessions(dir, ext)
+	if err != nil {
+		return nil, err
+	}
+	var old []string
+	for i := keep; i < len(all); i++ {
+		old = append(old, all[i].Path)
+	}
+	return old, nil
+}
+
+// listsessions prints each session for -list-sessions with when it
+// was last used and its title, if it has one.
+func listsessions(w io.Writer, opts *Opts) error {
+	dir := filepath.Join(opts.Home, HISTDIR)
+	all, err := sessions(dir, histstores[opts.Store].ext)
+	if err != nil {
+		return err
+	}
+	for _, s := range all {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, s.Mtime.Local().Format("2006-01-02 15:04"), readtitle(opts.Home, s.Name))
+	}
+	return nil
+}
+
+func titlepath(home, session string) string {
+	return filepath.Join(home, HISTDIR, session+TITLEEXT)
+}
+
+// readtitle is the session's title, or "" when it has none.
+func readtitle(home, session string) string {
+	data, err := ioutil.ReadFile(titlepath(home, session))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func writetitle(home, session, title string) error {
+	return ioutil.WriteFile(titlepath(home, session), []byte(title+"\n"), 0644)
+}
+
+const titlemsg = "Give this conversation a title of at most six words. Reply with the title only."
+
+// autotitle asks, cheaply, for a title for the first exchange of a
+// new session and keeps it next to the history. A session left
+// untitled still lists, and -set-title can name it later, so failing
+// here is a warning.
+func autotitle(opts *Opts, prompt Message, res *Reply) {
+	o := *opts
+	o.MaxTokens = 16
+	o.Stream, o.Sink = false, nil
+	o.Logprobs, o.Schema, o.SaveRequest = false, nil, ""
+	msgs := []Message{prompt, {Role: "assistant", Content: res.Content}, {Role: "user", Content: titlemsg}}
+	t, err := sendchat(&o, msgs)
+	if err == nil {
+		title := strings.Trim(strings.TrimSpace(t.Content), "\"'")
+		err = writetitle(opts.Home, opts.Session, title)
+	}
+	if err != nil {
+		warnf("-autotitle: %v", err)
+	}
+}
+
+func listprompts(home string) ([]string, error) {
+	ents, err := os.ReadDir(filepath.Join(home, HISTDIR, PROMPTDIR))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range ents {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// histpath is the file of the named session; the default session
+// keeps the original llm.history name.
+func histpath(home, store, session string) string {
+	return filepath.Join(home, HISTDIR, session+histstores[store].ext)
+}
+
+// HistoryStore is where conversations are kept between -c runs.
+// Records come back in the order they were written; the file stores
+// carry no sequence numbers that a hand edit could put out of step.
+// An ndb file a hand edit has broken is mended by -compact-on-exit;
+// -migrate leaves one already at HISTVER as it is. Close lets go of what the store holds open; the file stores hold
+// nothing between calls.
+type HistoryStore interface {
+	Load(last int) ([]Message, error)
+	Append(msgs ...Message) error
+	Close() error
+}
+
+type ndbstore struct {
+	path     string
+	maxbytes int64
+}
+
+type jsonlstore struct {
+	path     string
+	maxbytes int64
+}
+
+type jsonlrec struct {
+	Message
+	Time        time.Time `json:"time"`
+	Usage       *Usage    `json:"usage,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+}
+
+type storetype struct {
+	ext  string
+	open func(path string) (HistoryStore, error)
+}
+
+// histstores maps -store names to backends; optional backends
+// built behind tags add themselves from init.
+var histstores = map[string]storetype{
+	"ndb": {HISTEXT, func(path string) (HistoryStore, error) {
+		return ndbstore{path: path}, nil
+	}},
+	"jsonl": {JSONLEXT, func(path string) (HistoryStore, error) {
+		return jsonlstore{path: path}, nil
+	}},
+}
+
+func histstore(opts *Opts) HistoryStore {
+	store, err := histstores[opts.Store].open(histpath(opts.Home, opts.Store, opts.Session))
+	if err != nil {
+		logit("[ERROR]: open %s history: %v", opts.Store, err)
+	}
+	switch s := store.(type) {
+	case ndbstore:
+		s.maxbytes = opts.MaxHistBytes
+		store = s
+	case jsonlstore:
+		s.maxbytes = opts.MaxHistBytes
+		store = s
+	}
+	return store
+}
+
+// defroles maps the roles other tools write to the ones the API
+// takes; role= records in the config add to it.
+var defroles = map[string]string{
+	"human":     "user",
+	"ai":        "assistant",
+	"bot":       "assistant",
+	"model":     "assistant",
+	"developer": "system",
+}
+
+// normroles puts msgs in the system, user and assistant roles for
+// -normalize-roles, by roles; a message it cannot place is dropped
+// with a warning rather than have the API refuse the conversation.
+func normroles(msgs []Message, roles map[string]string) []Message {
+	var out []Message
+	for i, m := range msgs {
+		role := strings.ToLower(m.Role)
+		if r, ok := roles[role]; ok {
+			role = r
+		}
+		switch role {
+		case "system", "user", "assistant":
+			m.Role = role
+			out = append(out, m)
+		default:
+			warnf("history message %d: dropping unknown role %q", i+1, m.Role)
+		}
+	}
+	return out
+}
+
+func loadhist(store HistoryStore, last int) []Message {
+	msgs, err := store.Load(last)
+	if err != nil {
+		logit("[ERROR]: history is unreadable, move it aside to start afresh: %v", err)
+	}
+	return msgs
+}
+
+// ArchiveRec is an exchange as the jsonl archive keeps it.
+type ArchiveRec struct {
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"`
+	Model   string    `json:"model"`
+	Prompt  string    `json:"prompt"`
+	Reply   string    `json:"reply"`
+	Usage   *Usage    `json:"usage,omitempty"`
+}
+
+// archive appends the exchange to the archive file named in the
+// config, whatever the session and flags. It only warns when it
+// cannot: the reply has been had either way.
+func archive(opts *Opts, prompt Message, res *Reply) {
+	if opts.Archive == "" {
+		return
+	}
+	model := opts.Model
+	if res.Model != "" {
+		model = res.Model
+	}
+	if err := writearchive(opts.Archive, opts.ArchiveFormat, ArchiveRec{
+		Time: time.Now().UTC(), Session: opts.Session, Model: model,
+		Prompt: prompt.Content, Reply: res.Content, Usage: res.Usage,
+	}); err != nil {
+		warnf("archive %s: %v", opts.Archive, err)
+	}
+}
+
+// splitreply cuts reply at the lines that are delim and nothing else,
+// dropping blank parts.
+func splitreply(reply, delim string) []string {
+	var parts []string
+	var cur []string
+	add := func() {
+		if p := strings.Trim(strings.Join(cur, "\n"), "\n"); strings.TrimSpace(p) != "" {
+			parts = append(parts, p)
+		}
+		cur = nil
+	}
+	for _, line := range strings.Split(reply, "\n") {
+		if strings.TrimSpace(line) == delim {
+			add()
+			continue
+		}
+		cur = append(cur, line)
+	}
+	add()
+	return parts
+}
+
+// splitout writes the parts of out for -split: to part-1, part-2 and
+// so on in -split-dir, saying which on stderr, or else printed under
+// a line numbering each.
+func splitout(opts *Opts, out string) error {
+	parts := splitreply(out, opts.Split)
+	if opts.SplitDir == "" {
+		w, done := replyout(opts)
+		for i, p := range parts {
+			fmt.Fprintf(w, "--- part %d\n", i+1)
+			printout(w, p, true)
+		}
+		return done()
+	}
+	if err := os.MkdirAll(opts.SplitDir, 0755); err != nil {
+		return err
+	}
+	for i, p := range parts {
+		path := filepath.Join(opts.SplitDir, fmt.Sprintf("part-%d", i+1))
+		if err := ioutil.WriteFile(path, []byte(p+"\n"), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintln(stderr, path)
+	}
+	return nil
+}
+
+// appenddoc adds reply to the end of the -doc file, after DOCSEP, so
+// the next run sends the document with it.
+func appenddoc(path, reply string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sep := DOCSEP
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		sep = "\n" + sep
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s%s\n", sep, strings.TrimRight(reply, "\n"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func writearchive(path, format string, rec ArchiveRec) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if format == "markdown" {
+		_, err = fmt.Fprintf(f, "## %s %s (%s)\n\n%s\n\n---\n\n%s\n\n",
+			rec.Time.Local().Format("2006-01-02 15:04"), rec.Session, rec.Model, rec.Prompt, rec.Reply)
+	} else {
+		err = json.NewEncoder(f).Encode(rec)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// keepturn is how an exchange gets into the history, and it only
+// does for a reply that came back whole and with something in it: a
+// failed request (res is nil) or an empty reply keeps nothing, not
+// even the prompt. The turn goes in with one write.
+func keepturn(opts *Opts, store HistoryStore, turn []Message, res *Reply) {
+	if res == nil {
+		return
+	}
+	if isempty(res) {
+		warnf("empty reply not kept in the history")
+		return
+	}
+	appendhist(store, histturn(opts, turn, res)...)
+}
+
+func appendhist(store HistoryStore, msgs ...Message) {
+	now := time.Now().UTC()
+	for i := range msgs {
+		msgs[i].Time = now
+	}
+	if err := store.Append(msgs...); err != nil {
+		logit("[ERROR]: append history: %v", err)
+	}
+}
+
+// replayroles keeps the messages of msgs in one of roles, for
+// -replay-roles; the history itself keeps them all.
+func replayroles(msgs []Message, roles map[string]bool) []Message {
+	var out []Message
+	for _, m := range msgs {
+		if roles[m.Role] {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// lastreply is the content of the latest message in role, the role
+// replies are kept under.
+func lastreply(msgs []Message, role string) (string, bool) {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == role {
+			return msgs[i].Content, true
+		}
+	}
+	return "", false
+}
+
+// fromlast is the -from-last prompt: the earlier reply and then what
+// to do with it, as in "Now translate the above".
+func fromlast(reply, instr string) string {
+	return strings.TrimSpace(reply) + "\n\n" + instr
+}
+
+// hassystem is true when msgs hold a system message anywhere, for
+// -system-once: one kept after a history began is as good as one at
+// its head.
+func hassystem(msgs []Message) bool {
+	for _, m := range msgs {
+		if m.Role == "system" {
+			return true
+		}
+	}
+	return false
+}
+
+// interleave repeats the conversation's first system message before
+// every nth user turn after the first, for -system-every, so a long
+// conversation does not drift from it. The history is left as is.
+func interleave(msgs []Message, n int) []Message {
+	var sys *Message
+	for i := range msgs {
+		if msgs[i].Role == "system" {
+			sys = &msgs[i]
+			break
+		}
+	}
+	if sys == nil {
+		return msgs
+	}
+	out := make([]Message, 0, len(msgs)+len(msgs)/n)
+	turn := 0
+	for _, m := range msgs {
+		if m.Role == "user" {
+			if turn > 0 && turn%n == 0 {
+				out = append(out, Message{Role: "system", Content: sys.Content})
+			}
+			turn++
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// dropsystem leaves out every system message, from the history and
+// the flags alike, for -drop-system. The history itself keeps them.
+func dropsystem(msgs []Message) []Message {
+	out := make([]Message, 0, len(msgs))
+	for _, m := range msgs {
+		if m.Role != "system" {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// histturn is what a turn leaves in the history: the prompt records
+// and, unless -store-prompts-only, the reply.
+func histturn(opts *Opts, turn []Message, res *Reply) []Message {
+	if opts.PromptsOnly {
+		return turn
+	}
+	return append(turn, histreply(opts, res))
+}
+
+// histreply is the record for res, under the -reply-role; usage
+// rides along under -save-usage.
+func histreply(opts *Opts, res *Reply) Message {
+	m := Message{Role: opts.ReplyRole, Content: res.Content, Fingerprint: res.Fingerprint}
+	if opts.TruncateHist {
+		m.Content = truncate(m.Content, opts.TruncateAt)
+	}
+	if opts.SaveUsage {
+		m.Usage = res.Usage
+	}
+	return m
+}
+
+func (s ndbstore) Load(last int) ([]Message, error) {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	ver, err := histversion(s.path)
+	if err != nil {
+		return nil, wrap(s.path, err)
+	}
+	if ver > HISTVER {
+		return nil, wrap(s.path, fmt.Errorf("history version %d is newer than this slm reads (%d)", ver, HISTVER))
+	}
+	// read line by line rather than with ndb.Open: version 0 files
+	// have bare "message" lines ndb skips, and ndb does not know the
+	// escaped quotes %q writes
+	var lines []string
+	if last > 0 {
+		lines, err = taillines(s.path, last, isndbrec)
+	} else {
+		lines, err = reclines(s.path, isndbrec, s.maxbytes)
+	}
+	if err != nil {
+		return nil, wrap(s.path, err)
+	}
+	recs := make([]ndb.Record, 0, len(lines))
+	for _, line := range lines {
+		recs = append(recs, parserec(line))
+	}
+	return recmsgs(recs), nil
+}
+
+func (s ndbstore) Close() error { return nil }
+
+func (s ndbstore) Append(msgs ...Message) error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// one write, so the records go in together or not at all
+	var buf bytes.Buffer
+	if fi, err := f.Stat(); err == nil && fi.Size() == 0 {
+		fmt.Fprintln(&buf, verline())
+	}
+	for _, m := range msgs {
+		if m.Time.IsZero() {
+			m.Time = time.Now().UTC()
+		}
+		fmt.Fprintln(&buf, ndbline(m))
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (s jsonlstore) Load(last int) ([]Message, error) {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	var lines []string
+	if last > 0 {
+		var err error
+		lines, err = taillines(s.path, last, isjsonlrec)
+		if err != nil {
+			return nil, wrap(s.path, err)
+		}
+	} else {
+		var err error
+		lines, err = reclines(s.path, isjsonlrec, s.maxbytes)
+		if err != nil {
+			return nil, wrap(s.path, err)
+		}
+	}
+
+	msgs := make([]Message, 0, len(lines))
+	for _, line := range lines {
+		var rec jsonlrec
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return nil, wrap(fmt.Sprintf("%s: bad record %.40q", s.path, line), err)
+		}
+		if rec.Role != "" && rec.Content != "" {
+			rec.Message.Time = rec.Time
+			rec.Message.Usage = rec.Usage
+			rec.Message.Fingerprint = rec.Fingerprint
+			msgs = append(msgs, rec.Message)
+		}
+	}
+	return msgs, nil
+}
+
+func (s jsonlstore) Close() error { return nil }
+
+func (s jsonlstore) Append(msgs ...Message) error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, m := range msgs {
+		if m.Time.IsZero() {
+			m.Time = time.Now().UTC()
+		}
+		if err := enc.Encode(jsonlrec{m, m.Time, m.Usage, m.Fingerprint}); err != nil {
+			return err
+		}
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Migrate rewrites the history in the current format, returning the
+// version it was in. Records keep what they had; those written before
+// timestamps stay undated.
+func (s ndbstore) Migrate() (int, error) {
+	s.maxbytes = 0 // the whole file is rewritten
+	ver, err := histversion(s.path)
+	if err != nil || ver == HISTVER {
+		return ver, err
+	}
+	if ver > HISTVER {
+		return ver, fmt.Errorf("history version %d is newer than this slm writes (%d)", ver, HISTVER)
+	}
+	msgs, err := s.Load(0)
+	if err != nil {
+		return ver, err
+	}
+	return ver, s.rewrite(msgs)
+}
+
+// rewrite replaces the history with msgs by way of a new file, so a
+// crash leaves either the old history or the new one.
+func (s ndbstore) rewrite(msgs []Message) error {
+	tmp := s.path + ".new"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, verline())
+	for _, m := range msgs {
+		fmt.Fprintln(w, ndbline(m))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Compact drops the records that do not parse, such as those cut
+// short or with unbalanced quotes, and any exchange that repeats the
+// one before it word for word, rewriting the history when it finds
+// any. It returns how many records went.
+func (s ndbstore) Compact() (int, error) {
+	ver, err := histversion(s.path)
+	if err != nil {
+		return 0, err
+	}
+	if ver > HISTVER {
+		return 0, fmt.Errorf("history version %d is newer than this slm writes (%d)", ver, HISTVER)
+	}
+	lines, err := reclines(s.path, isndbrec, 0)
+	if err != nil {
+		return 0, err
+	}
+	var msgs []Message
+	for _, line := range lines {
+		if !balanced(line) {
+			continue
+		}
+		msgs = append(msgs, recmsgs([]ndb.Record{parserec(line)})...)
+	}
+	msgs = dedupe(msgs, false)
+	if n := len(lines) - len(msgs); n > 0 {
+		return n, s.rewrite(msgs)
+	}
+	return 0, nil
+}
+
+// balanced is true when every quote the line opens it closes.
+func balanced(line string) bool {
+	in := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case in && line[i] == '\\':
+			i++
+		case line[i] == '"':
+			in = !in
+		}
+	}
+	return !in
+}
+
+// dedupe drops user/reply pairs that repeat the pair just before
+// or, when all, any pair seen earlier. The first of each stays.
+func dedupe(msgs []Message, all bool) []Message {
+	same := func(a, b Message) bool { return a.Role == b.Role && a.Content == b.Content }
+	key := func(q, a Message) string { return q.Content + "\x00" + a.Role + "\x00" + a.Content }
+	seen := map[string]bool{}
+	var out []Message
+	for i := 0; i < len(msgs); i++ {
+		n := len(out)
+		if i+1 < len(msgs) && msgs[i].Role == "user" && msgs[i+1].Role != "user" && msgs[i+1].Role != "system" {
+			k := key(msgs[i], msgs[i+1])
+			if (all && seen[k]) || (n >= 2 && same(msgs[i], out[n-2]) && same(msgs[i+1], out[n-1])) {
+				i++
+				continue
+			}
+			seen[k] = true
+		}
+		out = append(out, msgs[i])
+	}
+	return out
+}
+
+// Dedupe drops the exchanges that repeat an earlier one, rewriting
+// the history if there are any, and returns how many went.
+func (s ndbstore) Dedupe(all bool) (int, error) {
+	s.maxbytes = 0 // the whole file is rewritten
+	msgs, err := s.Load(0)
+	if err != nil {
+		return 0, err
+	}
+	kept := dedupe(msgs, all)
+	n := (len(msgs) - len(kept)) / 2
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.rewrite(kept)
+}
+
+// dedupehist is -dedupe on the session's ndb history.
+func dedupehist(opts *Opts) {
+	store := histstore(opts)
+	defer store.Close()
+	s, ok := store.(ndbstore)
+	if !ok {
+		logit("[ERROR]: -dedupe works on the ndb store only")
+	}
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		fmt.Fprintf(stdout, "%s: no history\n", s.path)
+		return
+	}
+	n, err := s.Dedupe(opts.Dedupe == "all")
+	checkit(err, "[ERROR]: dedupe "+s.path)
+	fmt.Fprintf(stdout, "%s: removed %d repeated exchanges\n", s.path, n)
+}
+
+// backup copies the session's history, or with -backup-all every
+// session's, and any titles into a new directory in -backup named for
+// the time, and returns it. Each copy is loaded back and compared
+// with the original before it counts.
+func backup(opts *Opts) (string, error) {
+	st := histstores[opts.Store]
+	all := []Session{{Name: opts.Session, Path: histpath(opts.Home, opts.Store, opts.Session)}}
+	if opts.BackupAll {
+		var err error
+		if all, err = sessions(filepath.Join(opts.Home, HISTDIR), st.ext); err != nil {
+			return "", err
+		}
+	}
+	if opts.BackupAll && len(all) == 0 || !opts.BackupAll && !exists(all[0].Path) {
+		return "", fmt.Errorf("no history to back up")
+	}
+	dir := filepath.Join(opts.Backup, "slm-"+time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	for _, s := range all {
+		dup := filepath.Join(dir, filepath.Base(s.Path))
+		if err := copyfile(s.Path, dup); err != nil {
+			return "", err
+		}
+		if err := samehist(opts, s.Path, dup); err != nil {
+			return "", fmt.Errorf("%s: the copy does not match: %v", dup, err)
+		}
+		if t := titlepath(opts.Home, s.Name); exists(t) {
+			if err := copyfile(t, filepath.Join(dir, filepath.Base(t))); err != nil {
+				return "", err
+			}
+		}
+	}
+	return dir, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func copyfile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// samehist loads both histories through the store and checks that
+// they hold the same messages.
+func samehist(opts *Opts, orig, dup string) error {
+	var msgs [2][]Message
+	for i, path := range []string{orig, dup} {
+		store, err := histstores[opts.Store].open(path)
+		if err != nil {
+			return err
+		}
+		msgs[i], err = store.Load(0)
+		store.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if len(msgs[0]) != len(msgs[1]) {
+		return fmt.Errorf("%d messages, not %d", len(msgs[1]), len(msgs[0]))
+	}
+	for i := range msgs[0] {
+		a, b := msgs[0][i], msgs[1][i]
+		if a.Role != b.Role || a.Content != b.Content || !a.Time.Equal(b.Time) {
+			return fmt.Errorf("message %d differs", i+1)
+		}
+	}
+	return nil
+}
+
+// compactexit is -compact-on-exit: it keeps the ndb history tidy
+// after a -c run, only warning when it cannot.
+func compactexit(store HistoryStore) {
+	s, ok := store.(ndbstore)
+	if !ok {
+		return
+	}
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return
+	}
+	n, err := s.Compact()
+	if err != nil {
+		warnf("-compact-on-exit: %v", err)
+	} else if n > 0 && !quiet {
+		fmt.Fprintf(stderr, "compacted %s: dropped %d records\n", s.path, n)
+	}
+}
+
+// migrate upgrades the session's ndb history for -migrate.
+func migrate(opts *Opts) {
+	store := histstore(opts)
+	defer store.Close()
+	s, ok := store.(ndbstore)
+	if !ok {
+		logit("[ERROR]: -migrate works on the ndb store only")
+	}
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		fmt.Fprintf(stdout, "%s: no history\n", s.path)
+		return
+	}
+	ver, err := s.Migrate()
+	checkit(err, "[ERROR]: migrate "+s.path)
+	if ver == HISTVER {
+		fmt.Fprintf(stdout, "%s: already version %d\n", s.path, ver)
+		return
+	}
+	fmt.Fprintf(stdout, "%s: version %d -> %d\n", s.path, ver, HISTVER)
+}
+
+// verline marks the format of an ndb history file. It has no role,
+// so loading passes over it; files without one are version 0.
+func verline() string {
+	return fmt.Sprintf("history= version=%d", HISTVER)
+}
+
+// histversion reads the version from the first record in path.
+func histversion(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<30)
+	for sc.Scan() {
+		line := sc.Text()
+		if !isndbrec(line) && !strings.HasPrefix(line, "history=") {
+			continue
+		}
+		for _, t := range parserec(line) {
+			if t.Attr == "version" {
+				n, err := strconv.Atoi(t.Val)
+				if err != nil {
+					return 0, fmt.Errorf("bad history version %q", t.Val)
+				}
+				return n, nil
+			}
+		}
+		return 0, nil
+	}
+	return 0, sc.Err()
+}
+
+// reclines returns the record lines of path.
+func reclines(path string, isrec func(string) bool, max int64) ([]string, error) {
+	data, err := readhist(path, max)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if isrec(line) {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// readhist reads path, or when it is over max bytes (and max is
+// set) only its last max bytes from the first whole line, so a
+// runaway history cannot take all the memory.
+func readhist(path string, max int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if max <= 0 || fi.Size() <= max {
+		return ioutil.ReadAll(f)
+	}
+	warnf("%s is %d bytes, loading only the last %d", path, fi.Size(), max)
+	buf := make([]byte, max)
+	if _, err := f.ReadAt(buf, fi.Size()-max); err != nil {
+		return nil, err
+	}
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	} else {
+		buf = nil
+	}
+	return buf, nil
+}
+
+func ndbline(m Message) string {
+	// "message=" rather than a bare "message": ndb drops any
+	// line containing a word that is not attr=value.
+	line := fmt.Sprintf("message= role=%q content=%q", m.Role, m.Content)
+	if !m.Time.IsZero() {
+		line += " time=" + m.Time.Format(time.RFC3339)
+	}
+	if u := m.Usage; u != nil {
+		line += fmt.Sprintf(" prompt_tokens=%d completion_tokens=%d total_tokens=%d",
+			u.PromptTokens, u.CompletionTokens, u.TotalTokens)
+	}
+	if m.Fingerprint != "" {
+		line += fmt.Sprintf(" fingerprint=%q", m.Fingerprint)
+	}
+	return line
+}
+
+func recmsgs(recs []ndb.Record) []Message {
+	msgs := make([]Message, 0, len(recs))
+	for _, rec := range recs {
+		var m Message
+		for _, tuple := range rec {
+			switch tuple.Attr {
+			case "role":
+				m.Role = tuple.Val
+			case "content":
+				m.Content = unquote(tuple.Val)
+			case "time":
+				m.Time, _ = time.Parse(time.RFC3339, tuple.Val)
+			case "fingerprint":
+				m.Fingerprint = unquote(tuple.Val)
+			case "prompt_tokens", "completion_tokens", "total_tokens":
+				if m.Usage == nil {
+					m.Usage = &Usage{}
+				}
+				n, _ := strconv.Atoi(tuple.Val)
+				switch tuple.Attr {
+				case "prompt_tokens":
+					m.Usage.PromptTokens = n
+				case "completion_tokens":
+					m.Usage.CompletionTokens = n
+				default:
+					m.Usage.TotalTokens = n
+				}
+			}
+		}
+		if m.Role != "" && m.Content != "" {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+func isndbrec(line string) bool {
+	return line != "" && line[0] != '#' && line[0] != ' ' && line[0] != '\t' &&
+		!strings.HasPrefix(line, "history=")
+}
+
+func isjsonlrec(line string) bool {
+	return strings.TrimSpace(line) != ""
+}
+
+// taillines reads path backwards in TAILCHUNK blocks until it has
+// the last n lines for which isrec holds, so -last does not pull the
+// whole file in. Both stores write one record per line.
+func taillines(path string, n int, isrec func(string) bool) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	off := fi.Size()
+	var buf []byte
+	var recs []string
+	for {
+		sz := int64(TAILCHUNK)
+		if off < sz {
+			sz = off
+		}
+		off -= sz
+		chunk := make([]byte, sz)
+		if _, err := f.ReadAt(chunk, off); err != nil {
+			return nil, err
+		}
+		buf = append(chunk, buf...)
+
+		lines := strings.Split(string(buf), "\n")
+		if off > 0 {
+			// the first line may be cut mid-record
+			lines = lines[1:]
+		}
+		recs = recs[:0]
+		for _, line := range lines {
+			if isrec(line) {
+				recs = append(recs, line)
+			}
+		}
+		if len(recs) >= n || off == 0 {
+			break
+		}
+	}
+	if len(recs) > n {
+		recs = recs[len(recs)-n:]
+	}
+	return recs, nil
+}
+
+// parserec splits a single ndb line into tuples, honouring "quoted
+// values" the same way ndb does.
+func parserec(line string) ndb.Record {
+	var rec ndb.Record
+	inquote := false
+	start := 0
+	for i := 0; i <= len(line); i++ {
+		if i < len(line) {
+			if inquote && line[i] == '\\' {
+				// keep escaped quotes inside the value
+				i++
+				continue
+			}
+			if line[i] == '"' {
+				inquote = !inquote
+			}
+			if inquote || (line[i] != ' ' && line[i] != '\t') {
+				continue
+			}
+		}
+		if word := line[start:i]; word != "" {
+			kv := strings.SplitN(word, "=", 2)
+			if len(kv) == 2 {
+				val := kv[1]
+				if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+					val = val[1 : len(val)-1]
+				}
+				rec = append(rec, ndb.Tuple{Attr: kv[0], Val: val})
+			}
+		}
+		start = i + 1
+	}
+	return rec
+}
+
+// report prints the details of a reply asked for by flags on
+// stderr, keeping stdout for the reply itself.
+func report(opts *Opts, res *Reply) {
+	if opts.RateLimit {
+		if rl, ok := ratelimit(res.Header); ok {
+			fmt.Fprintf(stderr, "ratelimit: %s\n", rl)
+		}
+	}
+	if opts.WarnTokens > 0 {
+		if msg, low := tokenslow(res.Header, opts.WarnTokens, time.Now()); low {
+			fmt.Fprintf(stderr, "warning: %s\n", msg)
+		}
+	}
+	if opts.Logprobs {
+		printlogprobs(stderr, res.Logprobs)
+	}
+	if opts.Measure {
+		fmt.Fprintf(stderr, "measure: %s\n", measure(opts.Model, res))
+	}
+	if opts.Fingerprint && res.Fingerprint != "" {
+		fmt.Fprintf(stderr, "fingerprint: %s\n", res.Fingerprint)
+	}
+	if opts.ReplyHash {
+		fmt.Fprintf(stderr, "reply-hash: %s\n", contenthash(res.Content))
+	}
+	if opts.ReplyStats {
+		chars, words, lines := textstats(res.Content)
+		fmt.Fprintf(stderr, "reply-stats: %d chars, %d words, %d lines\n", chars, words, lines)
+	}
+}
+
+// textstats counts s the way wc does, but in characters rather than
+// bytes and with a last line that has no newline counted too.
+func textstats(s string) (chars, words, lines int) {
+	lines = strings.Count(s, "\n")
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		lines++
+	}
+	return utf8.RuneCountInString(s), len(strings.Fields(s)), lines
+}
+
+// contenthash is the hex sha256 of s, for telling identical texts
+// apart from different ones.
+func contenthash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// measure reports the timings of res and its output rate, taken from
+// the usage or, when the server sent none, estimated from the reply.
+func measure(model string, res *Reply) string {
+	ntok, est := 0, ""
+	if res.Usage != nil {
+		ntok = res.Usage.CompletionTokens
+	} else {
+		ntok, est = counttokens(model, res.Content), "~"
+	}
+	rate := 0.0
+	if res.Elapsed > 0 {
+		rate = float64(ntok) / res.Elapsed.Seconds()
+	}
+	return fmt.Sprintf("first byte %v, total %v, %s%d tokens, %.1f tokens/s",
+		res.FirstByte.Round(time.Millisecond), res.Elapsed.Round(time.Millisecond), est, ntok, rate)
+}
+
+// printlogprobs writes a line per token: the token, its log
+// probability and, under -logprobs N, the N likeliest alternatives.
+func printlogprobs(w io.Writer, lps []TokenLogprob) {
+	for _, lp := range lps {
+		fmt.Fprintf(w, "logprob: %q\t%.4f", lp.Token, lp.Logprob)
+		for _, alt := range lp.TopLogprobs {
+			fmt.Fprintf(w, "\t%q=%.4f", alt.Token, alt.Logprob)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// ratelimit parses the x-ratelimit-* headers; ok is false when the
+// server sent none of them.
+func ratelimit(h http.Header) (RateLimit, bool) {
+	var rl RateLimit
+	ok := false
+	num := func(name string) int {
+		v := h.Get(name)
+		if v == "" {
+			return 0
+		}
+		ok = true
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	dur := func(name string) time.Duration {
+		v := h.Get(name)
+		if v == "" {
+			return 0
+		}
+		ok = true
+		d, _ := time.ParseDuration(v)
+		return d
+	}
+	rl.LimitRequests = num("x-ratelimit-limit-requests")
+	rl.RemainingRequests = num("x-ratelimit-remaining-requests")
+	rl.ResetRequests = dur("x-ratelimit-reset-requests")
+	rl.LimitTokens = num("x-ratelimit-limit-tokens")
+	rl.RemainingTokens = num("x-ratelimit-remaining-tokens")
+	rl.ResetTokens = dur("x-ratelimit-reset-tokens")
+	return rl, ok
+}
+
+// pace is how long to wait before the next request so that what is
+// left of the rate limit lasts until it resets: nothing while more
+// than a tenth remains, then the reset time shared out over what is
+// left, and the whole of it once nothing is. The tighter of the
+// request and token limits wins.
+func pace(rl RateLimit) time.Duration {
+	wait := func(limit, remaining int, reset time.Duration) time.Duration {
+		switch {
+		case limit <= 0 || reset <= 0 || remaining*10 > limit:
+			return 0
+		case remaining <= 0:
+			return reset
+		}
+		return reset / time.Duration(remaining+1)
+	}
+	d := wait(rl.LimitRequests, rl.RemainingRequests, rl.ResetRequests)
+	if t := wait(rl.LimitTokens, rl.RemainingTokens, rl.ResetTokens); t > d {
+		d = t
+	}
+	return d
+}
+
+// pacewait sleeps, under -adaptive-rate, for as long as pace says
+// after res, between the requests of a batch or conversation.
+func pacewait(opts *Opts, res *Reply) {
+	if !opts.AdaptiveRate {
+		return
+	}
+	rl, ok := ratelimit(res.Header)
+	if d := pace(rl); ok && d > 0 {
+		note(opts, "rate limit running low; waiting %v", d.Round(time.Millisecond))
+		time.Sleep(d)
+	}
+}
+
+// tokenslow is true when the x-ratelimit-remaining-tokens header
+// says fewer than min tokens are left; msg says when they come back.
+func tokenslow(h http.Header, min int, now time.Time) (msg string, low bool) {
+	if h.Get("x-ratelimit-remaining-tokens") == "" {
+		return "", false
+	}
+	rl, _ := ratelimit(h)
+	if rl.RemainingTokens >= min {
+		return "", false
+	}
+	return fmt.Sprintf("%d of %d tokens left, the budget resets in %v (at %s)",
+		rl.RemainingTokens, rl.LimitTokens, rl.ResetTokens,
+		now.Add(rl.ResetTokens).Local().Format("15:04:05")), true
+}
+
+func (rl RateLimit) String() string {
+	return fmt.Sprintf("requests %d/%d (reset %v), tokens %d/%d (reset %v)",
+		rl.RemainingRequests, rl.LimitRequests, rl.ResetRequests,
+		rl.RemainingTokens, rl.LimitTokens, rl.ResetTokens)
+}
+
+// output applies the display-only transforms to reply; history
+// always keeps the reply as the model sent it.
+func output(opts *Opts, reply string) (string, error) {
+	if opts.AnswerAfter != "" {
+		i := strings.LastIndex(reply, opts.AnswerAfter)
+		if i >= 0 {
+			reply = strings.TrimSpace(reply[i+len(opts.AnswerAfter):])
+		} else if opts.Strict {
+			return reply, &StrictError{EXITFORMAT, "-answer-after: marker not in the reply"}
+		}
+	}
+	if opts.Field != "" {
+		v, err := jsonfield(reply, opts.Field)
+		if err != nil {
+			return reply, &StrictError{EXITFORMAT, "-field: " + err.Error()}
+		}
+		reply = v
+	}
+	if opts.CompactJSON {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, []byte(strings.TrimSpace(reply))); err == nil {
+			reply = buf.String()
+		} else if opts.Strict {
+			return reply, &StrictError{EXITFORMAT, "-compact-json: reply is not JSON: " + err.Error()}
+		}
+	}
+	if opts.ExtractCode != "" {
+		if opts.Strict && len(codeblocks(reply)) == 0 {
+			return reply, &StrictError{EXITFORMAT, "-extract-code: no fenced code in the reply"}
+		}
+		reply = extractcode(reply, opts.ExtractCode == "all")
+	}
+	reply = truncate(reply, opts.TruncateAt)
+	if opts.WrapCode == "auto" {
+		reply = wrapcode(reply, detectlang(reply))
+	} else if opts.WrapCode != "" {
+		reply = wrapcode(reply, opts.WrapCode)
+	}
+	if opts.ReplyBase64 {
+		reply = base64.StdEncoding.EncodeToString([]byte(reply))
+	}
+	return reply, nil
+}
+
+// truncate cuts s to n characters, the last being an ellipsis, when
+// it is longer; n of 0 leaves it whole.
+func truncate(s string, n int) string {
+	if n <= 0 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:n-1]) + "…"
+}
+
+// unbase64 decodes standard base64, ignoring the line breaks and
+// spaces that encoders wrap it with.
+func unbase64(s string) (string, error) {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+	data, err := base64.StdEncoding.DecodeString(s)
+	return string(data), err
+}
+
+// jsonfield returns the value at the dot separated path in the JSON
+// reply, which may sit in a code fence. Numbers index arrays. Strings
+// come out bare, anything else as JSON.
+func jsonfield(reply, path string) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(reply), &v); err != nil {
+		blocks := codeblocks(reply)
+		if len(blocks) == 0 || json.Unmarshal([]byte(blocks[0].Code), &v) != nil {
+			return "", fmt.Errorf("reply is not JSON: %v", err)
+		}
+	}
+	seen := "$"
+	for _, key := range strings.Split(path, ".") {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			val, ok := x[key]
+			if !ok {
+				return "", fmt.Errorf("no %q in %s", key, seen)
+			}
+			v = val
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(x) {
+				return "", fmt.Errorf("no index %q in %s (%d items)", key, seen, len(x))
+			}
+			v = x[i]
+		default:
+			return "", fmt.Errorf("%s is not an object or array", seen)
+		}
+		seen += "." + key
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func printout(w io.Writer, out string, newline bool) {
+	if newline {
+		fmt.Fprintln(w, out)
+	} else {
+		fmt.Fprint(w, out)
+	}
+}
+
+func wrapcode(reply, lang string) string {
+	return "```" + lang + "\n" + strings.TrimRight(reply, "\n") + "\n```"
+}
+
+// colour is true when f is a terminal and NO_COLOR is not set.
+func colour(w io.Writer) bool {
+	return getenv("NO_COLOR") == "" && isterm(w)
+}
+
+const (
+	ansibold  = "\x1b[1m"
+	ansiul    = "\x1b[4m"
+	ansicode  = "\x1b[36m"
+	ansireset = "\x1b[0m"
+)
+
+var (
+	mdbold = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	mdcode = regexp.MustCompile("`([^`]+)`")
+	mdlist = regexp.MustCompile(`^(\s*)[-*+] `)
+)
+
+// render turns the markdown most replies come in to ANSI for the
+// terminal: headings, bold, inline code, lists and fenced code. It
+// is only for looking at; the history keeps the markdown.
+func render(md string) string {
+	var b strings.Builder
+	fenced := false
+	for _, line := range strings.Split(md, "\n") {
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(line), "```"):
+			fenced = !fenced
+			continue
+		case fenced:
+			line = ansicode + line + ansireset
+		case strings.HasPrefix(line, "#"):
+			line = ansibold + ansiul + strings.TrimLeft(strings.TrimLeft(line, "#"), " ") + ansireset
+		default:
+			line = mdlist.ReplaceAllString(line, "$1• ")
+			line = mdbold.ReplaceAllString(line, ansibold+"$1"+ansireset)
+			line = mdcode.ReplaceAllString(line, ansicode+"$1"+ansireset)
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// pageout shows out in $PAGER, or with bat highlighting it when the
+// language can be told. With neither to hand it is just printed.
+func pageout(out string) {
+	var c *exec.Cmd
+	lang := detectlang(out)
+	if bat, err := exec.LookPath("bat"); err == nil && lang != "" && lang != "rc" {
+		c = exec.Command(bat, "--paging=always", "--language", lang)
+	} else if pager := getenv("PAGER"); pager != "" {
+		c = shell(pager)
+	} else if path, err := exec.LookPath(defpager()); err == nil {
+		c = exec.Command(path)
+	}
+	if c == nil {
+		printout(stdout, out, true)
+		return
+	}
+	c.Stdin = strings.NewReader(out + "\n")
+	c.Stdout = stdout
+	c.Stderr = stderr
+	if err := c.Run(); err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			log.Print(wrap("[ERROR]: pager", err))
+			return
+		}
+		printout(stdout, out, true)
+	}
+}
+
+func defpager() string {
+	if runtime.GOOS == "plan9" {
+		return "p"
+	}
+	return "less"
+}
+
+// langhints tell languages apart by lines only they would have; the
+// first to match wins, so the stricter ones come first.
+var langhints = []struct {
+	lang string
+	re   *regexp.Regexp
+}{
+	{"go", regexp.MustCompile(`(?m)^package \w+$|^func (\(\w+ \*?\w+\) )?\w+\(`)},
+	{"rust", regexp.MustCompile(`(?m)^\s*(pub )?fn \w+\(|\blet mut \w+`)},
+	{"c", regexp.MustCompile(`(?m)^#include [<"]`)},
+	{"python", regexp.MustCompile(`(?m)^\s*def \w+\(.*\):\s*$|^(from [\w.]+ )?import [\w.]+(, [\w.]+)*\s*$`)},
+	{"sql", regexp.MustCompile(`(?im)^\s*(select .+ from|create table|insert into|update \w+ set)\b`)},
+	{"html", regexp.MustCompile(`(?i)^\s*<(!doctype html|html|head|body|div)\b`)},
+	{"javascript", regexp.MustCompile(`\bfunction\s*\w*\(|\b(const|let) \w+ = |\) => `)},
+	{"sh", regexp.MustCompile(`(?m)^\s*(if \[|for \w+ in .*; do|echo |export \w+=)`)},
+}
+
+// interps maps #! interpreters to languages.
+var interps = map[string]string{
+	"sh": "sh", "bash": "sh", "dash": "sh", "ksh": "sh", "zsh": "sh",
+	"rc": "rc", "python": "python", "python3": "python",
+	"perl": "perl", "ruby": "ruby", "node": "javascript",
+}
+
+// detectlang guesses the language of a code reply: the tag of its
+// first fence, the #! line, or failing those the telltale lines in
+// langhints. It is "" when nothing fits.
+func detectlang(reply string) string {
+	code := reply
+	if blocks := codeblocks(reply); len(blocks) > 0 {
+		if blocks[0].Lang != "" {
+			return blocks[0].Lang
+		}
+		code = blocks[0].Code
+	}
+	code = strings.TrimSpace(code)
+	if strings.HasPrefix(code, "#!") {
+		line, _, _ := strings.Cut(code, "\n")
+		f := strings.Fields(line[2:])
+		if len(f) > 0 {
+			name := filepath.Base(f[0])
+			if name == "env" && len(f) > 1 {
+				name = f[1]
+			}
+			if lang, ok := interps[name]; ok {
+				return lang
+			}
+		}
+	}
+	if (strings.HasPrefix(code, "{") || strings.HasPrefix(code, "[")) && json.Valid([]byte(code)) {
+		return "json"
+	}
+	for _, h := range langhints {
+		if h.re.MatchString(code) {
+			return h.lang
+		}
+	}
+	return ""
+}
+
+type codeblock struct {
+	Lang string
+	Code string
+}
+
+// codeblocks returns the ``` or ~~~ fenced blocks of text in order.
+// A fence left open runs to the end of text.
+func codeblocks(text string) []codeblock {
+	var blocks []codeblock
+	var fence string
+	var cur *codeblock
+	var body []string
+	for _, line := range strings.Split(text, "\n") {
+		trim := strings.TrimSpace(line)
+		if cur == nil {
+			if strings.HasPrefix(trim, "```") || strings.HasPrefix(trim, "~~~") {
+				n := len(trim) - len(strings.TrimLeft(trim, trim[:1]))
+				fence = trim[:n]
+				cur = &codeblock{Lang: strings.TrimSpace(trim[n:])}
+				body = nil
+			}
+			continue
+		}
+		if strings.HasPrefix(trim, fence) && strings.Trim(trim, fence[:1]) == "" {
+			cur.Code = strings.Join(body, "\n")
+			blocks = append(blocks, *cur)
+			cur = nil
+			continue
+		}
+		body = append(body, line)
+	}
+	if cur != nil {
+		cur.Code = strings.Join(body, "\n")
+		blocks = append(blocks, *cur)
+	}
+	return blocks
+}
+
+// extractcode returns the code of the first fenced block, or of all
+// of them separated by blank lines. A reply without fences is
+// returned as is.
+func extractcode(reply string, all bool) string {
+	blocks := codeblocks(reply)
+	if len(blocks) == 0 {
+		return reply
+	}
+	if !all {
+		return blocks[0].Code
+	}
+	codes := make([]string, len(blocks))
+	for i, b := range blocks {
+		codes[i] = b.Code
+	}
+	return strings.Join(codes, "\n\n")
+}
+
+// Price is in dollars per million tokens.
+type Price struct {
+	In  float64
+	Out float64
+}
+
+// prices is looked up by the longest model prefix, so dated
+// snapshots like gpt-4o-2024-08-06 share their family's price.
+var prices = map[string]Price{
+	"gpt-3.5-turbo": {0.50, 1.50},
+	"gpt-4":         {30, 60},
+	"gpt-4-turbo":   {10, 30},
+	"gpt-4o":        {2.50, 10},
+	"gpt-4o-mini":   {0.15, 0.60},
+	"gpt-4.1":       {2, 8},
+	"gpt-4.1-mini":  {0.40, 1.60},
+	"gpt-4.1-nano":  {0.10, 0.40},
+	"o1":            {15, 60},
+	"o1-mini":       {1.10, 4.40},
+	"o3-mini":       {1.10, 4.40},
+}
+
+// Caps is what a model takes beyond plain chat.
+type Caps struct {
+	Effort   bool // reasoning_effort
+	Logprobs bool
+	Schema   bool // response_format json_schema
+	Vision   bool // image parts, for -img
+}
+
+// capabilities is keyed by model name prefix, the longest match
+// winning, like prices. Models not in it are given the benefit of the
+// doubt.
+var capabilities = map[string]Caps{
+	"gpt-3.5":     {Logprobs: true},
+	"gpt-4":       {Logprobs: true},
+	"gpt-4-turbo": {Logprobs: true, Vision: true},
+	"gpt-4o":      {Logprobs: true, Schema: true, Vision: true},
+	"gpt-4o-mini": {Logprobs: true, Schema: true, Vision: true},
+	"gpt-4.1":     {Logprobs: true, Schema: true, Vision: true},
+	"o1":          {Effort: true, Schema: true, Vision: true},
+	"o1-mini":     {},
+	"o3":          {Effort: true, Schema: true, Vision: true},
+	"o3-mini":     {Effort: true, Schema: true},
+	"o4-mini":     {Effort: true, Schema: true, Vision: true},
+}
+
+func modelcaps(model string) Caps {
+	best := ""
+	for name := range capabilities {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return Caps{Effort: true, Logprobs: true, Schema: true, Vision: true}
+	}
+	return capabilities[best]
+}
+
+// gatecaps leaves out, with a warning, what was asked for that the
+// model is known not to take, rather than have the API refuse the
+// request. Under -strict it is an error. Without response_format a
+// -schema reply is still checked here.
+func gatecaps(opts *Opts) error {
+	c := modelcaps(opts.Model)
+	var not []string
+	if opts.Effort != "" && !c.Effort {
+		not = append(not, "-effort")
+		opts.Effort = ""
+	}
+	if opts.Logprobs && !c.Logprobs {
+		not = append(not, "-logprobs")
+		opts.Logprobs = false
+	}
+	if opts.Schema != nil && !c.Schema {
+		not = append(not, "-schema")
+		opts.SchemaLocal = true
+	}
+	if len(opts.Images) > 0 && !c.Vision {
+		not = append(not, "-img")
+		opts.Images = nil
+	}
+	if len(not) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%s does not take %s", opts.Model, strings.Join(not, ", "))
+	if opts.Strict {
+		return &StrictError{EXITFORMAT, msg}
+	}
+	it := "it"
+	if len(not) > 1 {
+		it = "them"
+	}
+	warnf("%s, leaving %s out", msg, it)
+	return nil
+}
+
+func modelprice(model string) (Price, bool) {
+	best := ""
+	for name := range prices {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	p, ok := prices[best]
+	return p, ok
+}
+
+// estcost is the worst case for a request: every prompt token at the
+// input price and a reply of maxout tokens (DEFMAXOUT when unset).
+func estcost(model string, prompttok, maxout int) (float64, error) {
+	p, ok := modelprice(model)
+	if !ok {
+		return 0, wrap(fmt.Sprintf("[ERROR]: no price known for model %s", model), nil)
+	}
+	if maxout <= 0 {
+		maxout = DEFMAXOUT
+	}
+	return (float64(prompttok)*p.In + float64(maxout)*p.Out) / 1e6, nil
+}
+
+func checkcost(model string, prompttok, maxout int, limit float64) (float64, error) {
+	cost, err := estcost(model, prompttok, maxout)
+	if err != nil {
+		return 0, err
+	}
+	if cost > limit {
+		return cost, wrap(fmt.Sprintf("[ERROR]: estimated cost $%.4f is over -max-cost $%.4f", cost, limit), nil)
+	}
+	return cost, nil
+}
+
+// confirmlarge asks on the terminal before sending a prompt of more
+// than -confirm-over tokens. Without a terminal there is no one to
+// ask: the prompt goes, or under -strict it is refused.
+func confirmlarge(opts *Opts, msgs []Message, prompt string, tty bool, in io.Reader, out io.Writer) (bool, error) {
+	n := counttokens(opts.Model, prompt)
+	if n <= opts.ConfirmOver {
+		return true, nil
+	}
+	if !tty {
+		if opts.Strict {
+			return false, wrap(fmt.Sprintf("[ERROR]: prompt of about %d tokens is over -confirm-over %d", n, opts.ConfirmOver), nil)
+		}
+		return true, nil
+	}
+	fmt.Fprintf(out, "prompt is about %d tokens (%d characters)", n, len(prompt))
+	if cost, err := estcost(opts.Model, msgtokens(opts.Model, msgs), opts.MaxTokens); err == nil {
+		fmt.Fprintf(out, ", up to $%.4f", cost)
+	}
+	fmt.Fprint(out, ". send? [y/N] ")
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	a := strings.TrimSpace(answer)
+	return a == "y" || a == "yes", nil
+}
+
+// isterm is true when f is a terminal; on Plan 9 that is /dev/cons,
+// which is served by #c and so shows up as a character device.
+func isterm(v interface{}) bool {
+	f, ok := v.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// counttokens estimates what text costs in tokens for model. An
+// exact tokenizer built in behind a tag can replace it from init.
+var counttokens = esttokens
+
+// esttokens approximates BPE tokenization: ascii words cost about a
+// token per four characters, other letters and punctuation a token
+// each. It is deterministic so estimates are stable between runs.
+func esttokens(model, text string) int {
+	n, word := 0, 0
+	flush := func() {
+		n += (word + 3) / 4
+		word = 0
+	}
+	for _, r := range text {
+		switch {
+		case r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			word++
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			flush()
+			n++
+		}
+	}
+	flush()
+	return n
+}
+
+// msgtokens adds the chat format overhead: a few tokens framing each
+// message and three priming the reply.
+func msgtokens(model string, msgs []Message) int {
+	n := 3
+	for _, m := range msgs {
+		n += 4 + counttokens(model, m.Content)
+	}
+	return n
+}
+
+// idemseq counts the requests sent under an -idempotency-key.
+var idemseq int64
+
+// sendchat makes up to 1+opts.Retries attempts, backing off between
+// them, and gives up early once opts.RetryBudget would be overrun.
+// Retries run under a deadline at the end of the budget so a server
+// that is slow to fail cannot stretch it.
+func sendchat(opts *Opts, msgs []Message) (*Reply, error) {
+	// one key for every attempt, so a gateway that honours it
+	// will not act on a retried request twice; a given key is the
+	// run's first request and KEY-2, KEY-3 ... the ones after it,
+	// which are different requests and must not be taken for it
+	key := opts.IdemKey
+	if key == "" {
+		var err error
+		if key, err = newuuid(); err != nil {
+			return nil, err
+		}
+	} else if n := atomic.AddInt64(&idemseq, 1); n > 1 {
+		key = fmt.Sprintf("%s-%d", key, n)
+	}
+	hdr := http.Header{}
+	hdr.Set("Idempotency-Key", key)
+	if opts.TraceID != "" {
+		span, err := randhex(8)
+		if err != nil {
+			return nil, err
+		}
+		hdr.Set("traceparent", fmt.Sprintf("00-%s-%s-%s", opts.TraceID, span, opts.TraceFlags))
+	}
+
+	start := time.Now()
+	ctx := context.Background()
+	if opts.Stream {
+		// an interrupt ends the stream rather than the program, so
+		// what has been written so far is kept
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+	}
+	// the budget bounds the whole of it, the first attempt too
+	if opts.RetryBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, start.Add(opts.RetryBudget))
+		defer cancel()
+	}
+	for attempt := 0; ; attempt++ {
+		res, err := sendonce(ctx, opts, msgs, hdr)
+		if err != nil && opts.RetryBudget > 0 && ctx.Err() == context.DeadlineExceeded {
+			return nil, wrap(fmt.Sprintf("[ERROR]: retry budget %v spent after %d attempts", opts.RetryBudget, attempt+1), err)
+		}
+		if err == nil || !retryable(err) || attempt >= opts.Retries {
+			return res, err
+		}
+		wait := jitter(backoff(attempt), opts.Jitter, mrand.Int63n)
+		if opts.RetryBudget > 0 && time.Since(start)+wait >= opts.RetryBudget {
+			return nil, wrap(fmt.Sprintf("[ERROR]: retry budget %v spent after %d attempts", opts.RetryBudget, attempt+1), err)
+		}
+		note(opts, "%v; retrying in %v", err, wait)
+		time.Sleep(wait)
+	}
+}
+
+// sendrotate tries the -key-rotate keys in turn while the API turns
+// the one before away for its auth or quota. It says which key
+// answered by the name of its variable, never the key, and returns
+// the options holding it; opts keeps the first key.
+func sendrotate(opts *Opts, msgs []Message) (*Reply, *Opts, error) {
+	res, err := sendchat(opts, msgs)
+	used, name := opts, opts.KeyEnv
+	for _, next := range opts.SpareKeys {
+		if err == nil || !keyrefused(err) {
+			break
+		}
+		note(opts, "%s: %v; trying %s", name, err, next)
+		name = next
+		o := *opts
+		o.APIKey = getenv(next)
+		used = &o
+		res, err = sendchat(used, msgs)
+	}
+	if err == nil && name != opts.KeyEnv {
+		note(opts, "key: %s", name)
+	}
+	return res, used, err
+}
+
+// keyrefused is true when the key, not the request, is at fault: it
+// is wrong or revoked, or its quota is spent.
+func keyrefused(err error) bool {
+	var ae *APIError
+	if !errors.As(err, &ae) {
+		return false
+	}
+	return ae.Status == http.StatusUnauthorized || ae.Code == "insufficient_quota"
+}
+
+// sendfallback tries the -fallback models in turn while the one
+// before is missing or still rate limited after its retries. It
+// returns the options the reply was got with, a copy when a fallback
+// answered, for the requests that go on from it; opts is left alone,
+// so the next prompt starts from the first model again.
+func sendfallback(opts *Opts, msgs []Message) (*Reply, *Opts, error) {
+	res, used, err := sendrotate(opts, msgs)
+	for _, m := range opts.Fallback {
+		if err == nil || !unavailable(err) {
+			break
+		}
+		note(opts, "%s: %v; falling back to %s", used.Model, err, m)
+		o := *opts
+		o.Model = m
+		res, used, err = sendrotate(&o, msgs)
+	}
+	if err == nil && len(opts.Fallback) > 0 {
+		note(opts, "model: %s", used.Model)
+	}
+	return res, used, err
+}
+
+// unavailable is true when the model, not the request, is at fault.
+func unavailable(err error) bool {
+	var ae *APIError
+	if !errors.As(err, &ae) {
+		return false
+	}
+	return ae.Status == http.StatusNotFound || ae.Status == http.StatusTooManyRequests || ae.Code == "model_not_found"
+}
+
+// retryable is true for transport failures, rate limiting and
+// server errors; anything else would fail the same way again.
+func retryable(err error) bool {
+	var ae *APIError
+	if errors.As(err, &ae) {
+		return ae.Status == http.StatusTooManyRequests || ae.Status >= 500
+	}
+	var ue *url.Error
+	return errors.As(err, &ue)
+}
+
+func backoff(attempt int) time.Duration {
+	d := RETRYBASE << uint(attempt)
+	if d > RETRYMAX || d <= 0 {
+		d = RETRYMAX
+	}
+	return d
+}
+
+// jitter spreads a backoff of d so processes that failed together do
+// not all retry together: full waits anywhere up to d, equal at
+// least half of it, none exactly d. rnd is rand.Int63n or, to test,
+// a seeded one.
+func jitter(d time.Duration, strategy string, rnd func(int64) int64) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	switch strategy {
+	case "full":
+		return time.Duration(rnd(int64(d) + 1))
+	case "equal":
+		half := d / 2
+		return half + time.Duration(rnd(int64(d-half)+1))
+	}
+	return d
+}
+
+// newuuid makes a random (version 4) UUID.
+func newuuid() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", wrap("[ERROR]: reading random bytes", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func randhex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", wrap("[ERROR]: reading random bytes", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// withtrace is a request body with the traceparent it was sent under
+// as its first member, for -save-request.
+func withtrace(body []byte, tp string) []byte {
+	body = bytes.TrimSpace(body)
+	if tp == "" || len(body) < 2 || body[0] != '{' {
+		return body
+	}
+	out := []byte(`{"traceparent":` + strconv.Quote(tp))
+	if rest := bytes.TrimSpace(body[1:]); len(rest) > 0 && rest[0] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, body[1:]...)
+}
+
+// untrace takes the traceparent withtrace put at the head of a saved
+// request back out, leaving the body byte for byte as it was sent.
+func untrace(body []byte) ([]byte, string, error) {
+	const head = `{"traceparent":`
+	body = bytes.TrimSpace(body)
+	if !bytes.HasPrefix(body, []byte(head)) {
+		return body, "", nil
+	}
+	var tp string
+	dec := json.NewDecoder(bytes.NewReader(body[len(head):]))
+	if err := dec.Decode(&tp); err != nil {
+		return nil, "", fmt.Errorf("traceparent: %v", err)
+	}
+	rest := bytes.TrimSpace(body[len(head)+int(dec.InputOffset()):])
+	rest = bytes.TrimPrefix(rest, []byte(","))
+	return append([]byte("{"), rest...), tp, nil
+}
+
+// traceparent takes the trace id and flags out of a W3C traceparent,
+// 00-TRACEID-PARENTID-FLAGS.
+func traceparent(tp string) (id, flags string, ok bool) {
+	f := strings.Split(strings.TrimSpace(tp), "-")
+	if len(f) != 4 || len(f[0]) != 2 || len(f[2]) != 16 || len(f[3]) != 2 || !istraceid(f[1]) {
+		return "", "", false
+	}
+	return f[1], f[3], true
+}
+
+// istraceid is true for 32 lower case hex digits, not all zero.
+func istraceid(id string) bool {
+	if len(id) != 32 || id == strings.Repeat("0", 32) {
+		return false
+	}
+	for _, r := range id {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+func sendonce(ctx context.Context, opts *Opts, msgs []Message, hdr http.Header) (*Reply, error) {
+	endpoint := endpoint(opts)
+	var req interface{} = chatreq(opts, msgs)
+	switch {
+	case opts.Provider == "anthropic":
+		req = anthropicreq(opts, msgs)
+	case opts.API == "responses":
+		req = responsesreq(opts, msgs)
+	}
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return nil, wrap("[ERROR]: marshalling request", err)
+	}
+	if opts.RawRequest != nil {
+		buf = opts.RawRequest
+	}
+	// the key goes in a header, so the body is safe to hand around;
+	// the traceparent is put in with it
+	if opts.SaveRequest != "" {
+		if err := ioutil.WriteFile(opts.SaveRequest, withtrace(buf, hdr.Get("traceparent")), 0666); err != nil {
+			return nil, wrap("[ERROR]: saving request", err)
+		}
+	}
+
+	reqhttp, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(buf))
+	if err != nil {
+		return nil, wrap("[ERROR]: creating request", err)
+	}
+	if opts.NoDefaultHeaders {
+		// nothing but -H; an empty User-Agent keeps Go's out
+		reqhttp.Header.Set("User-Agent", "")
+	} else {
+		reqhttp.Header.Set("Content-Type", "application/json")
+		setauth(reqhttp.Header, opts.Provider, opts.APIKey)
+		if opts.Provider != "anthropic" {
+			setscope(reqhttp.Header, opts.Org, opts.Project)
+		}
+		for k, v := range hdr {
+			reqhttp.Header[k] = v
+		}
+		if opts.MetaHeader != "" {
+			for k, v := range opts.Meta {
+				reqhttp.Header.Set(opts.MetaHeader+k, v)
+			}
+		}
+	}
+	for k, v := range opts.Headers {
+		reqhttp.Header[k] = v
+	}
+
+	start := time.Now()
+	resp, err := client.Do(reqhttp)
+	if err != nil {
+		return nil, wrap("[ERROR]: request error", err)
+	}
+	defer resp.Body.Close()
+	first := time.Since(start)
+
+	if opts.Stream && resp.StatusCode == http.StatusOK {
+		res, err := readstream(resp.Body, opts.Sink)
+		if err != nil {
+			return nil, err
+		}
+		res.Header, res.FirstByte, res.Elapsed = resp.Header, first, time.Since(start)
+		return res, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, wrap("[ERROR]: reading response", err)
+	}
+	elapsed := time.Since(start)
+	if resp.StatusCode != http.StatusOK {
+		msg, code := apierrmsg(body)
+		return nil, &APIError{resp.StatusCode, msg, code}
+	}
+	if !isjson(resp.Header.Get("Content-Type"), body) {
+		return nil, wrap(fmt.Sprintf("[ERROR]: %s sent a non-JSON reply (status %d, %s): %s",
+			endpoint, resp.StatusCode, resp.Header.Get("Content-Type"), snippet(body, SNIPLEN)), nil)
+	}
+
+	res := &Reply{Header: resp.Header, FirstByte: first, Elapsed: elapsed}
+	if opts.Provider == "anthropic" {
+		res.Content, res.FinishReason, res.Usage, err = anthropictext(body)
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	if opts.API == "responses" {
+		res.Content, res.FinishReason, res.Usage, err = responsestext(body)
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	var cres ChatResponse
+	if err := json.Unmarshal(body, &cres); err != nil {
+		return nil, wrap("[ERROR]: decode response", err)
+	}
+	if len(cres.Choices) == 0 {
+		return nil, wrap("[ERROR]: no choices in response", nil)
+	}
+	res.Content = cres.Choices[0].Message.Content
+	res.FinishReason = cres.Choices[0].FinishReason
+	res.Usage = cres.Usage
+	res.Fingerprint = cres.Fingerprint
+	if lp := cres.Choices[0].Logprobs; lp != nil {
+		res.Logprobs = lp.Content
+	}
+	return res, nil
+}
+
+// StreamChunk is one server-sent event of a streamed chat reply.
+type StreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage       *Usage `json:"usage"`
+	Fingerprint string `json:"system_fingerprint"`
+}
+
+// readstream writes the content of each event to w as it comes and
+// returns the whole reply once the server sends [DONE].
+func readstream(r io.Reader, w io.Writer) (*Reply, error) {
+	res := &Reply{}
+	var content strings.Builder
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		data, ok := strings.CutPrefix(sc.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var c StreamChunk
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			return nil, wrap("[ERROR]: decode stream", err)
+		}
+		if c.Usage != nil {
+			res.Usage = c.Usage
+		}
+		if c.Fingerprint != "" {
+			res.Fingerprint = c.Fingerprint
+		}
+		if len(c.Choices) == 0 {
+			continue
+		}
+		if d := c.Choices[0].Delta.Content; d != "" {
+			content.WriteString(d)
+			if _, err := io.WriteString(w, d); err != nil {
+				return nil, wrap("[ERROR]: writing reply", err)
+			}
+		}
+		if fr := c.Choices[0].FinishReason; fr != "" {
+			res.FinishReason = fr
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, wrap("[ERROR]: reading stream", err)
+	}
+	res.Content = content.String()
+	return res, nil
+}
+
+// apierrmsg prefers the message of an OpenAI error body and falls
+// back to a snippet of the body; code is the error code, if any.
+func apierrmsg(body []byte) (msg, code string) {
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+			Code    string `json:"code"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil && e.Error.Message != "" {
+		return e.Error.Message, e.Error.Code
+	}
+	return snippet(body, SNIPLEN), ""
+}
+
+// isjson guards against proxies answering with an HTML error page:
+// a JSON content type wins, otherwise the body must look like JSON.
+func isjson(ctype string, body []byte) bool {
+	if strings.Contains(ctype, "json") {
+		return true
+	}
+	b := bytes.TrimSpace(body)
+	return len(b) > 0 && (b[0] == '{' || b[0] == '[')
+}
+
+func snippet(body []byte, n int) string {
+	s := strings.Join(strings.Fields(string(body)), " ")
+	if len(s) > n {
+		s = s[:n] + "..."
+	}
+	return strconv.Quote(s)
+}
+
+func chatreq(opts *Opts, msgs []Message) ChatRequest {
+	req := ChatRequest{Model: opts.Model, Temperature: opts.Temp, MaxTokens: opts.MaxTokens, Effort: opts.Effort, Messages: msgs}
+	if opts.MetaHeader == "" {
+		req.Metadata = opts.Meta
+	}
+	if opts.Stream {
+		req.Stream = true
+		req.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+	if opts.Logprobs {
+		req.Logprobs = true
+		req.TopLogprobs = opts.TopLogprobs
+	}
+	if opts.Schema != nil && !opts.SchemaLocal {
+		req.ResponseFormat = &ResponseFormat{
+			Type:       "json_schema",
+			JSONSchema: &JSONSchema{Name: opts.SchemaName, Strict: true, Schema: opts.Schema},
+		}
+	}
+	return req
+}
+
+func responsesreq(opts *Opts, msgs []Message) ResponsesRequest {
+	req := ResponsesRequest{Model: opts.Model, Temperature: opts.Temp, MaxTokens: opts.MaxTokens, Input: msgs}
+	if opts.MetaHeader == "" {
+		req.Metadata = opts.Meta
+	}
+	if opts.Effort != "" {
+		req.Reasoning = &Reasoning{opts.Effort}
+	}
+	if opts.Schema != nil && !opts.SchemaLocal {
+		req.Text = &ResponsesText{}
+		req.Text.Format.Type = "json_schema"
+		req.Text.Format.JSONSchema = JSONSchema{Name: opts.SchemaName, Strict: true, Schema: opts.Schema}
+	}
+	return req
+}
+
+// AnthropicRequest is the Anthropic /v1/messages shape, which keeps
+// the system prompt out of the messages and needs max_tokens.
+type AnthropicRequest struct {
+	Model       string    `json:"model"`
+	MaxTokens   int       `json:"max_tokens"`
+	Temperature float64   `json:"temperature"`
+	System      string    `json:"system,omitempty"`
+	Messages    []Message `json:"messages"`
+}
+
+type AnthropicResponse struct {
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+	Usage      *struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+func anthropicreq(opts *Opts, msgs []Message) AnthropicRequest {
+	req := AnthropicRequest{Model: opts.Model, MaxTokens: opts.MaxTokens, Temperature: opts.Temp}
+	if req.MaxTokens == 0 {
+		req.MaxTokens = DEFMAXOUT
+	}
+	var sys []string
+	for _, m := range msgs {
+		if m.Role == "system" {
+			sys = append(sys, m.Content)
+			continue
+		}
+		req.Messages = append(req.Messages, m)
+	}
+	req.System = strings.Join(sys, "\n\n")
+	return req
+}
+
+func anthropictext(body []byte) (string, string, *Usage, error) {
+	var ares AnthropicResponse
+	if err := json.Unmarshal(body, &ares); err != nil {
+		return "", "", nil, wrap("[ERROR]: decode response", err)
+	}
+	var text []string
+	for _, part := range ares.Content {
+		if part.Type == "text" {
+			text = append(text, part.Text)
+		}
+	}
+	if len(text) == 0 {
+		return "", "", nil, wrap("[ERROR]: no text in response", nil)
+	}
+	var u *Usage
+	if ares.Usage != nil {
+		u = &Usage{ares.Usage.InputTokens, ares.Usage.OutputTokens, ares.Usage.InputTokens + ares.Usage.OutputTokens}
+	}
+	finish := "stop"
+	if ares.StopReason == "max_tokens" {
+		finish = "length"
+	}
+	return strings.Join(text, ""), finish, u, nil
+}
+
+// responsestext joins the output_text parts of the message items in
+// a /v1/responses body, skipping reasoning and other item types.
+func responsestext(body []byte) (string, string, *Usage, error) {
+	var rres ResponsesResponse
+	if err := json.Unmarshal(body, &rres); err != nil {
+		return "", "", nil, wrap("[ERROR]: decode response", err)
+	}
+	var text []string
+	for _, item := range rres.Output {
+		if item.Type != "message" {
+			continue
+		}
+		for _, part := range item.Content {
+			if part.Type == "output_text" {
+				text = append(text, part.Text)
+			}
+		}
+	}
+	if len(text) == 0 {
+		return "", "", nil, wrap("[ERROR]: no output text in response", nil)
+	}
+	var u *Usage
+	if rres.Usage != nil {
+		u = &Usage{rres.Usage.InputTokens, rres.Usage.OutputTokens, rres.Usage.TotalTokens}
+	}
+	// map an incomplete response onto the chat finish reasons
+	finish := "stop"
+	if rres.Status == "incomplete" && rres.IncompleteDetails != nil {
+		finish = rres.IncompleteDetails.Reason
+		if finish == "max_output_tokens" {
+			finish = "length"
+		}
+	}
+	return strings.Join(text, ""), finish, u, nil
+}
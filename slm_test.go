@@ -0,0 +1,3745 @@
+// slm_test.go
+// slm: tests for slm.go, driving it in-process through run
+// Run with: go test slm.go slm_test.go (the other variants are
+// package main too); -update rewrites the golden files in testdata.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// fixture is a home with a config whose only provider is a test
+// server, and the requests that server was sent.
+type fixture struct {
+	home string
+	srv  *httptest.Server
+	vars map[string]string // more of the environment
+
+	mu     sync.Mutex
+	bodies []string
+	hdrs   []http.Header
+}
+
+// newfixture serves every request with reply, after noting it.
+func newfixture(t *testing.T, reply http.HandlerFunc) *fixture {
+	t.Helper()
+	f := &fixture{home: t.TempDir()}
+	f.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.bodies = append(f.bodies, string(body))
+		f.hdrs = append(f.hdrs, r.Header.Clone())
+		f.mu.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		reply(w, r)
+	}))
+	t.Cleanup(f.srv.Close)
+	dir := filepath.Join(f.home, HISTDIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	conf := "provider=test type=openai url=" + f.srv.URL + "/v1 keyenv=TEST_KEY\n"
+	if err := os.WriteFile(filepath.Join(dir, CONFFILE), []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// chatreply answers with content as a chat completion.
+func chatreply(content string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":`+quote(content)+`},"finish_reason":"stop"}],`+
+			`"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`)
+	}
+}
+
+// streamreply answers with parts as a streamed chat completion.
+func streamreply(parts ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, p := range parts {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%s}}]}\n\n", quote(p))
+		}
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n")
+	}
+}
+
+func quote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// env is the environment slm sees under the fixture.
+func (f *fixture) env(k string) string {
+	if v, ok := f.vars[k]; ok {
+		return v
+	}
+	switch k {
+	case "home":
+		return f.home
+	case "TEST_KEY":
+		return "sk-test0123456789abcdef"
+	}
+	return ""
+}
+
+// run runs slm with args and stdin against the fixture's provider.
+func (f *fixture) run(stdin string, args ...string) (out, errs string, code int) {
+	var o, e bytes.Buffer
+	code = run(append([]string{"-provider", "test"}, args...), f.env, strings.NewReader(stdin), &o, &e, f.srv.Client())
+	return o.String(), e.String(), code
+}
+
+// parse runs parseflags on args under the fixture's environment,
+// which stays in place until the test is over, for tests that call
+// into slm below run.
+func (f *fixture) parse(t *testing.T, args ...string) (*Opts, error) {
+	t.Helper()
+	ogetenv, oclient, ostderr := getenv, client, stderr
+	t.Cleanup(func() { getenv, client, stderr = ogetenv, oclient, ostderr })
+	getenv, client, stderr = f.env, f.srv.Client(), io.Discard
+	fs := flag.NewFlagSet("slm", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return parseflags(fs, append([]string{"-provider", "test"}, args...), strings.NewReader(""))
+}
+
+// golden compares got with testdata/name, or writes it under -update.
+func golden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to make it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs:\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestRunChat(t *testing.T) {
+	f := newfixture(t, chatreply("Hello, glenda."))
+	out, errs, code := f.run("", "-m", "gpt-4o", "say hello")
+	if code != 0 || errs != "" {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	golden(t, "chat.out", out)
+	if len(f.bodies) != 1 {
+		t.Fatalf("%d requests, want 1", len(f.bodies))
+	}
+	golden(t, "chat.req", f.bodies[0])
+	if got := f.hdrs[0].Get("Authorization"); got != "Bearer sk-test0123456789abcdef" {
+		t.Errorf("Authorization %q", got)
+	}
+}
+
+func TestRunHTTPError(t *testing.T) {
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error":{"message":"bad model","code":"invalid_model"}}`)
+	})
+	out, errs, code := f.run("", "hello")
+	if code != 1 {
+		t.Errorf("exit %d, want 1", code)
+	}
+	if out != "" {
+		t.Errorf("stdout %q, want nothing", out)
+	}
+	if !strings.Contains(errs, "[ERROR]: API status 400: bad model") {
+		t.Errorf("stderr %q", errs)
+	}
+}
+
+func TestRunShowConfig(t *testing.T) {
+	f := newfixture(t, chatreply(""))
+	out, errs, code := f.run("", "-show-config", "-H", "Authorization: Bearer sk-SECRET0123456789")
+	if code != 0 || errs != "" {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if strings.Contains(out, "SECRET") || strings.Contains(out, "0123456789abcdef") {
+		t.Errorf("-show-config shows a secret:\n%s", out)
+	}
+	out = strings.ReplaceAll(out, f.home, "$home")
+	out = strings.ReplaceAll(out, f.srv.URL, "$url")
+	golden(t, "show-config.out", out)
+}
+
+// bighist writes an ndb history of n messages for the benchmarks.
+func bighist(b *testing.B, n int) ndbstore {
+	b.Helper()
+	s := ndbstore{path: filepath.Join(b.TempDir(), "big"+HISTEXT)}
+	msgs := make([]Message, n)
+	for i := range msgs {
+		msgs[i] = Message{Role: []string{"user", "assistant"}[i%2], Content: strings.Repeat("lorem ipsum dolor sit amet ", 20)}
+	}
+	if err := s.Append(msgs...); err != nil {
+		b.Fatal(err)
+	}
+	return s
+}
+
+// BenchmarkLoadHistory compares -last, which reads only the tail of
+// the file, with loading all of it.
+func BenchmarkLoadHistory(b *testing.B) {
+	s := bighist(b, 20000)
+	for _, last := range []int{0, 10} {
+		name := "all"
+		if last > 0 {
+			name = "last10"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Load(last); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// convo is a conversation with the awkward cases in it: quotes,
+// newlines, backslashes, equals signs and non-ascii text.
+func convo() []Message {
+	when := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	return []Message{
+		{Role: "system", Content: "Be terse.", Time: when},
+		{Role: "user", Content: "What is \"rc\"?\nAnswer in a=b form, C:\\ paths and all.", Time: when},
+		{Role: "assistant", Content: "rc=the Plan 9 shell; ça marche 🙂\n\n", Time: when.Add(time.Second),
+			Usage: &Usage{PromptTokens: 12, CompletionTokens: 8, TotalTokens: 20}, Fingerprint: "fp_123"},
+	}
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	for name, st := range histstores {
+		t.Run(name, func(t *testing.T) {
+			store, err := st.open(filepath.Join(t.TempDir(), "s"+st.ext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			want := convo()
+			if err := store.Append(want[:1]...); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Append(want[1:]...); err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.Load(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got\n%#v\nwant\n%#v", got, want)
+			}
+			got, err = store.Load(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want[1:]) {
+				t.Errorf("Load(2) got\n%#v\nwant\n%#v", got, want[1:])
+			}
+		})
+	}
+}
+
+// TestStoreContract holds every -store to what HistoryStore
+// promises, sqlite too when it is built in (go test -tags sqlite
+// slm.go slm-sqlite.go slm_test.go slm-sqlite_test.go).
+func TestStoreContract(t *testing.T) {
+	for name, st := range histstores {
+		t.Run(name, func(t *testing.T) {
+			store, err := st.open(filepath.Join(t.TempDir(), "s"+st.ext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			if got, err := store.Load(0); err != nil || len(got) != 0 {
+				t.Fatalf("a new store loads %d messages, %v", len(got), err)
+			}
+			want := convo()
+			for _, m := range want {
+				if err := store.Append(m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, last := range []int{0, 1, len(want), len(want) + 5} {
+				got, err := store.Load(last)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tail := want
+				if last > 0 && last < len(want) {
+					tail = want[len(want)-last:]
+				}
+				if !reflect.DeepEqual(got, tail) {
+					t.Errorf("Load(%d) got\n%#v\nwant\n%#v", last, got, tail)
+				}
+			}
+		})
+	}
+}
+
+// TestRequestBodies pins the JSON sent to each API: OpenAI chat
+// completions and responses, and Anthropic messages.
+func TestRequestBodies(t *testing.T) {
+	msgs := []Message{
+		{Role: "system", Content: "Be terse."},
+		{Role: "user", Content: "Name a Plan 9 editor."},
+		{Role: "assistant", Content: "acme"},
+		{Role: "user", Content: "Another?"},
+	}
+	for _, c := range []struct {
+		name string
+		opts Opts
+	}{
+		{"chat", Opts{API: "chat", Provider: "openai", Model: "gpt-4o", Temp: 0.2, MaxTokens: 100}},
+		{"responses", Opts{API: "responses", Provider: "openai", Model: "gpt-4o", Temp: 0.2, MaxTokens: 100}},
+		{"anthropic", Opts{API: "chat", Provider: "anthropic", Model: "claude-3-5-haiku-latest", Temp: 0.2, MaxTokens: 100}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var req interface{} = chatreq(&c.opts, msgs)
+			switch c.name {
+			case "responses":
+				req = responsesreq(&c.opts, msgs)
+			case "anthropic":
+				req = anthropicreq(&c.opts, msgs)
+			}
+			b, err := json.MarshalIndent(req, "", "\t")
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden(t, "request-"+c.name+".json", string(b)+"\n")
+		})
+	}
+}
+
+// TestRunBadHistory checks that a history that will not parse stops
+// slm with a message naming it, before anything is sent.
+func TestRunBadHistory(t *testing.T) {
+	f := newfixture(t, chatreply("unused"))
+	path := histpath(f.home, "jsonl", SESSION)
+	if err := os.WriteFile(path, []byte("{\"role\":\"user\",\"content\":\"hi\"}\n{\"role\":\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, errs, code := f.run("", "-store", "jsonl", "-c", "hello")
+	if code != 1 {
+		t.Errorf("exit %d, want 1", code)
+	}
+	if !strings.Contains(errs, "history is unreadable") || !strings.Contains(errs, path) {
+		t.Errorf("stderr %q", errs)
+	}
+	if len(f.bodies) != 0 {
+		t.Errorf("%d requests sent on a bad history", len(f.bodies))
+	}
+}
+
+// TestRunFailures checks that failures stop slm with an error rather
+// than carrying on with bad state.
+func TestRunFailures(t *testing.T) {
+	f := newfixture(t, chatreply("unused"))
+	conf := filepath.Join(f.home, HISTDIR, CONFFILE)
+
+	t.Run("histdir", func(t *testing.T) {
+		home := f.home
+		defer func() { f.home = home }()
+		f.home = t.TempDir()
+		if err := os.WriteFile(filepath.Join(f.home, "lib"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, errs, code := f.run("", "-config", conf, "hello")
+		if code != 1 || !strings.Contains(errs, "[ERROR]: creating history dir") {
+			t.Errorf("exit %d, stderr %q", code, errs)
+		}
+	})
+	t.Run("load-request", func(t *testing.T) {
+		_, errs, code := f.run("", "-load-request", filepath.Join(f.home, "missing.json"))
+		if code != 1 || !strings.Contains(errs, "[ERROR]") || !strings.Contains(errs, "missing.json") {
+			t.Errorf("exit %d, stderr %q", code, errs)
+		}
+	})
+	t.Run("stdin", func(t *testing.T) {
+		_, errs, code := f.run("piped prompt\n")
+		if code != 0 || errs != "" {
+			t.Fatalf("exit %d, stderr %q", code, errs)
+		}
+		if n := len(f.bodies); n == 0 || !strings.Contains(f.bodies[n-1], "piped prompt") {
+			t.Errorf("the prompt read from stdin was not sent: %q", f.bodies)
+		}
+	})
+	if len(f.bodies) != 1 {
+		t.Errorf("%d requests, want only the one from stdin", len(f.bodies))
+	}
+}
+
+// TestParseflags checks that bad flags come back as errors from
+// parseflags rather than ending the process.
+func TestParseflags(t *testing.T) {
+	f := newfixture(t, chatreply("unused"))
+	parse := func(args ...string) (*Opts, error) { return f.parse(t, args...) }
+
+	if opts, err := parse("-m", "gpt-4o", "-t", "0.5", "hello"); err != nil {
+		t.Fatalf("good flags: %v", err)
+	} else if opts.Model != "gpt-4o" || opts.Temp != 0.5 || opts.UserPrompt != "hello" {
+		t.Errorf("good flags gave model %q temp %v prompt %q", opts.Model, opts.Temp, opts.UserPrompt)
+	}
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-max-tokens", "-1", "hi"}, "-max-tokens"},
+		{[]string{"-last", "-2", "hi"}, "-last must be >= 0"},
+		{[]string{"-api", "completions", "hi"}, "-api must be chat or responses"},
+		{[]string{"-pager", "-o", "out", "hi"}, "-pager does not go with -o"},
+		{[]string{"-o", "out", "-tee", "out", "hi"}, "use -o or -tee, not both"},
+		{[]string{"-S", "-api", "responses", "hi"}, "-S needs -api chat"},
+		{[]string{"-parallel-sample", "2", "-ci"}, "-parallel-sample does not go with"},
+		{[]string{"-batch", "prompts", "-c"}, "-batch does not go with"},
+		{[]string{"-store", "tape", "hi"}, "unknown history store"},
+		{[]string{"-s", "a", "-sp", "b", "hi"}, "use -s or -sp, not both"},
+		{[]string{"-session", "../etc", "hi"}, "bad session name"},
+		{[]string{"-context", "notes", "-ci"}, "-context goes with a single prompt"},
+		{[]string{"-context", "notes", "-batch", "prompts"}, "-context goes with a single prompt"},
+	} {
+		if _, err := parse(c.args...); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%q: got %v, want %q", c.args, err, c.want)
+		}
+	}
+	if _, err := parse("-no-such-flag"); err != errflags {
+		t.Errorf("unknown flag: got %v, want errflags", err)
+	}
+}
+
+// TestRunNoAppendOnError checks that only a whole, non-empty reply
+// gets into the history: a failed request or an empty reply leaves
+// the file as it was.
+func TestRunNoAppendOnError(t *testing.T) {
+	var reply http.HandlerFunc = chatreply("first answer")
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) { reply(w, r) })
+	path := histpath(f.home, "ndb", SESSION)
+	if _, errs, code := f.run("", "-c", "first question"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil || !bytes.Contains(before, []byte("first answer")) {
+		t.Fatalf("history after a good reply: %q, %v", before, err)
+	}
+
+	for _, c := range []struct {
+		name  string
+		reply http.HandlerFunc
+		want  string
+	}{
+		{"failed", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `{"error":{"message":"overloaded"}}`)
+		}, "overloaded"},
+		{"empty", chatreply(""), "empty reply not kept"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			reply = c.reply
+			_, errs, _ := f.run("", "-c", "-retries", "0", "second question")
+			if !strings.Contains(errs, c.want) {
+				t.Errorf("stderr %q, want %q", errs, c.want)
+			}
+			after, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(after, before) {
+				t.Errorf("history changed:\n%s", after)
+			}
+		})
+	}
+}
+
+// TestRunSystemOnceReplay checks that -system-once still sends the
+// system prompt when -replay-roles drops it from the history sent,
+// run after run, and does not keep it a second time.
+func TestRunSystemOnceReplay(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	if _, errs, code := f.run("", "-c", "-system-once", "-s", "Be terse.", "zero"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	for _, p := range []string{"one", "two", "three"} {
+		if _, errs, code := f.run("", "-c", "-system-once", "-s", "Be terse.", "-replay-roles", "user,assistant", p); code != 0 {
+			t.Fatalf("%s: exit %d, stderr %q", p, code, errs)
+		}
+	}
+	if len(f.bodies) != 4 {
+		t.Fatalf("%d requests, want 4", len(f.bodies))
+	}
+	for i, body := range f.bodies {
+		if n := strings.Count(body, `"role":"system"`); n != 1 {
+			t.Errorf("request %d sends %d system prompts, want 1: %s", i+1, n, body)
+		}
+	}
+	hist, err := histstore(&Opts{Home: f.home, Store: "ndb", Session: SESSION}).Load(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(replayroles(hist, map[string]bool{"system": true})); n != 1 {
+		t.Errorf("history keeps %d system prompts, want 1", n)
+	}
+}
+
+// TestValidateConfigBlankLines checks that -validate-config takes
+// lines of nothing but white space, CRLF endings among them.
+func TestValidateConfigBlankLines(t *testing.T) {
+	f := newfixture(t, chatreply("unused"))
+	conf := filepath.Join(f.home, HISTDIR, CONFFILE)
+	data, err := os.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append([]byte("\r\n\t\t\n \r\n"), data...)
+	if err := os.WriteFile(conf, append(data, "\r\n\v\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, errs, code := f.run("", "-validate-config")
+	if code != 0 || strings.Contains(out, "error:") {
+		t.Errorf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+}
+
+// TestRunValidateConfig checks that -validate-config warns of
+// mistyped records, attributes and defaults, passing the config all
+// the same, and fails on a template file that is not there.
+func TestRunValidateConfig(t *testing.T) {
+	f := newfixture(t, chatreply("unused"))
+	f.addconfig(t, "templte=greet text=hello\ndefaults= modle=gpt-4o\nalias=fast model=gpt-4o-mini modle=x\n")
+	out, errs, code := f.run("", "-validate-config")
+	if code != 0 || strings.Contains(out, "error:") {
+		t.Errorf("typos: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	for _, want := range []string{
+		": warning: line 2: unknown record templte=\n",
+		": warning: defaults: no flag -modle\n",
+		": warning: alias=fast: unknown attribute modle\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("typos: no %q in %q", want, out)
+		}
+	}
+
+	missing := filepath.Join(t.TempDir(), "gone.tmpl")
+	f = newfixture(t, chatreply("unused"))
+	f.addconfig(t, "template=review file="+missing+"\n")
+	out, errs, code = f.run("", "-validate-config")
+	if want := ": error: template=review: stat " + missing; code != 1 || !strings.Contains(out, want) {
+		t.Errorf("missing file: exit %d, stdout %q, stderr %q, want %q", code, out, errs, want)
+	}
+	if len(f.bodies) != 0 {
+		t.Errorf("sent %d requests", len(f.bodies))
+	}
+}
+
+// TestRunErrorLogEarly checks that -error-log catches a flag error,
+// which is found before the options it would otherwise need exist.
+func TestRunErrorLogEarly(t *testing.T) {
+	f := newfixture(t, chatreply("unused"))
+	path := filepath.Join(f.home, "errors")
+	_, errs, code := f.run("", "-error-log", path, "-last", "-1", "hello")
+	if code != 1 || !strings.Contains(errs, "-last must be >= 0") {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "-last must be >= 0") {
+		t.Errorf("error log %q", data)
+	}
+	for _, args := range [][]string{
+		{"-m", "x", "-error-log", "f"},
+		{"--error-log=f", "-c"},
+		{"-error-log=f"},
+	} {
+		if got := errorlogarg(args); got != "f" {
+			t.Errorf("errorlogarg(%q) = %q", args, got)
+		}
+	}
+	if got := errorlogarg([]string{"--", "-error-log", "f"}); got != "" {
+		t.Errorf("errorlogarg after -- = %q", got)
+	}
+}
+
+// TestRunSystemStdinBatch checks that -s - reads the system prompt
+// from stdin under -batch too, rather than sending "-".
+func TestRunSystemStdinBatch(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	prompts := filepath.Join(f.home, "prompts")
+	if err := os.WriteFile(prompts, []byte("one\ntwo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs, code := f.run("Be terse.\n", "-s", "-", "-batch", prompts); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if len(f.bodies) != 2 {
+		t.Fatalf("%d requests, want 2", len(f.bodies))
+	}
+	for _, body := range f.bodies {
+		if !strings.Contains(body, `{"role":"system","content":"Be terse."}`) {
+			t.Errorf("request %s", body)
+		}
+	}
+}
+
+// TestRunStreamDelimited checks that -S streams each reply of
+// -stdin-delimiter to stdout ahead of the delimiter.
+func TestRunStreamDelimited(t *testing.T) {
+	f := newfixture(t, streamreply("Hel", "lo"))
+	out, errs, code := f.run("one%%two%%", "-S", "-stdin-delimiter", "%%")
+	if code != 0 || errs != "" {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if want := "Hello\n%%Hello\n%%"; out != want {
+		t.Errorf("stdout %q, want %q", out, want)
+	}
+}
+
+// TestWatchDebounce checks that a burst of saves makes one call, and
+// a later save another.
+func TestWatchDebounce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompt")
+	if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	fired := make(chan struct{}, 10)
+	done := make(chan struct{})
+	go func() {
+		watch(ctx, path, 5*time.Millisecond, 60*time.Millisecond, func() { fired <- struct{}{} })
+		close(done)
+	}()
+	saves := func() {
+		for i := 1; i <= 3; i++ {
+			if err := os.WriteFile(path, []byte(strings.Repeat("y", i)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(15 * time.Millisecond)
+		}
+	}
+	count := func() int {
+		time.Sleep(250 * time.Millisecond)
+		return len(fired)
+	}
+	saves()
+	if n := count(); n != 1 {
+		t.Errorf("three saves in a row fired %d times, want 1", n)
+	}
+	if err := os.WriteFile(path, []byte("z"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("after one more save %d calls in all, want 2", n)
+	}
+	cancel()
+	<-done
+}
+
+// TestWatchSendStream checks that -watch -S streams the reply under
+// its line rather than writing to no writer at all.
+func TestWatchSendStream(t *testing.T) {
+	f := newfixture(t, streamreply("Hel", "lo"))
+	path := filepath.Join(f.home, "prompt")
+	if err := os.WriteFile(path, []byte("hi\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := f.parse(t, "-S", "-watch", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	watchsend(opts, &out)
+	if got := out.String(); !strings.HasPrefix(got, "--- ") || !strings.HasSuffix(got, "\nHello\n") {
+		t.Errorf("output %q", got)
+	}
+}
+
+// TestRunSystemOnce checks that -system-once sends one system prompt
+// a request however many runs follow, whether the history starts
+// with it or was begun without one.
+func TestRunSystemOnce(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		hist []Message
+	}{
+		{"starts with system", []Message{
+			{Role: "system", Content: "Be terse."},
+			{Role: "user", Content: "zero"},
+			{Role: "assistant", Content: "ok"},
+		}},
+		{"no system", []Message{
+			{Role: "user", Content: "zero"},
+			{Role: "assistant", Content: "ok"},
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := newfixture(t, chatreply("ok"))
+			store := ndbstore{path: histpath(f.home, "ndb", SESSION)}
+			if err := store.Append(c.hist...); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []string{"one", "two", "three"} {
+				if _, errs, code := f.run("", "-c", "-system-once", "-s", "Be terse.", p); code != 0 {
+					t.Fatalf("exit %d, stderr %q", code, errs)
+				}
+			}
+			for i, body := range f.bodies {
+				if n := strings.Count(body, `"role":"system"`); n != 1 {
+					t.Errorf("request %d sends %d system prompts, want 1: %s", i+1, n, body)
+				}
+			}
+			hist, err := store.Load(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := len(replayroles(hist, map[string]bool{"system": true})); n != 1 {
+				t.Errorf("history keeps %d system prompts, want 1", n)
+			}
+		})
+	}
+}
+
+// TestRunSystemStdinModes checks -s - alongside -doc and -from-last,
+// which take the prompt from elsewhere, and -load-request, which it
+// does not go with.
+func TestRunSystemStdinModes(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	sys := `{"role":"system","content":"Be terse."}`
+
+	doc := filepath.Join(f.home, "doc")
+	if err := os.WriteFile(doc, []byte("Draft.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs, code := f.run("Be terse.\n", "-s", "-", "-doc", doc); code != 0 {
+		t.Fatalf("-doc: exit %d, stderr %q", code, errs)
+	}
+	if body := f.bodies[len(f.bodies)-1]; !strings.Contains(body, sys) || !strings.Contains(body, "Draft.") {
+		t.Errorf("-doc request %s", body)
+	}
+
+	if _, errs, code := f.run("", "-c", "first"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if _, errs, code := f.run("Be terse.\n", "-s", "-", "-from-last", "Now shorter."); code != 0 {
+		t.Fatalf("-from-last: exit %d, stderr %q", code, errs)
+	}
+	if body := f.bodies[len(f.bodies)-1]; !strings.Contains(body, sys) || !strings.Contains(body, `ok\n\nNow shorter.`) {
+		t.Errorf("-from-last request %s", body)
+	}
+
+	n := len(f.bodies)
+	_, errs, code := f.run("Be terse.\n", "-s", "-", "-load-request", doc)
+	if code != 1 || !strings.Contains(errs, "-s - does not go with -load-request") {
+		t.Errorf("-load-request: exit %d, stderr %q", code, errs)
+	}
+	if len(f.bodies) != n {
+		t.Errorf("-load-request sent a request")
+	}
+}
+
+// TestRunFingerprint checks that a reply's system_fingerprint is
+// printed under -print-fingerprint and kept with it in the history,
+// and that a reply without one is kept without.
+func TestRunFingerprint(t *testing.T) {
+	fp := "fp_44d4"
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"system_fingerprint":`+quote(fp)+`,"choices":[{"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`)
+	})
+	for _, store := range []string{"ndb", "jsonl"} {
+		_, errs, code := f.run("", "-store", store, "-c", "-print-fingerprint", "hi")
+		if code != 0 || !strings.Contains(errs, "fp_44d4") {
+			t.Fatalf("%s: exit %d, stderr %q", store, code, errs)
+		}
+	}
+	fp = ""
+	for _, store := range []string{"ndb", "jsonl"} {
+		if _, errs, code := f.run("", "-store", store, "-c", "-print-fingerprint", "again"); code != 0 {
+			t.Fatalf("%s: exit %d, stderr %q", store, code, errs)
+		}
+		s, err := histstores[store].open(histpath(f.home, store, SESSION))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := s.Load(0)
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range msgs {
+			if m.Role == "assistant" {
+				got = append(got, m.Fingerprint)
+			}
+		}
+		if !reflect.DeepEqual(got, []string{"fp_44d4", ""}) {
+			t.Errorf("%s history keeps fingerprints %q", store, got)
+		}
+	}
+}
+
+// TestRunParallelSampleWarnings checks that the samples' warnings
+// come out whole, one each, rather than being written to stderr from
+// every sample at once; go test -race holds it to that.
+func TestRunParallelSampleWarnings(t *testing.T) {
+	f := newfixture(t, chatreply(""))
+	_, errs, _ := f.run("", "-parallel-sample", "4", "hi")
+	if len(f.bodies) != 4 {
+		t.Fatalf("%d requests, want 4", len(f.bodies))
+	}
+	if n := strings.Count(errs, "warning: "); n != 4 {
+		t.Errorf("%d warnings, want 4:\n%s", n, errs)
+	}
+}
+
+// TestRunTrace checks that the trace, given or made, goes in the
+// traceparent header, the log lines and a saved request, and that a
+// replayed request goes under it without it in the body.
+func TestRunTrace(t *testing.T) {
+	fail := true
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":{"message":"bad model"}}`)
+			return
+		}
+		chatreply("ok")(w, r)
+	})
+	id := "4bf92f3577b34da6a3ce929d0e0e4736"
+	_, errs, code := f.run("", "-trace-id", id, "hello")
+	if code != 1 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if tp := f.hdrs[0].Get("traceparent"); !strings.HasPrefix(tp, "00-"+id+"-") {
+		t.Errorf("traceparent %q", tp)
+	}
+	if !strings.HasPrefix(errs, "trace="+id+" ") {
+		t.Errorf("stderr %q", errs)
+	}
+
+	// one made up for the run goes in the log too
+	_, errs, _ = f.run("", "hello")
+	made := strings.Split(f.hdrs[1].Get("traceparent"), "-")
+	if len(made) != 4 || !strings.HasPrefix(errs, "trace="+made[1]+" ") {
+		t.Errorf("traceparent %q, stderr %q", f.hdrs[1].Get("traceparent"), errs)
+	}
+
+	fail = false
+	saved := filepath.Join(f.home, "req.json")
+	if _, errs, code := f.run("", "-trace-id", id, "-save-request", saved, "hello"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	data, err := os.ReadFile(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"traceparent":` + quote(f.hdrs[2].Get("traceparent")) + `,` + f.bodies[2][1:]; string(data) != want {
+		t.Errorf("saved request\n%s\nwant\n%s", data, want)
+	}
+	if _, errs, code := f.run("", "-load-request", saved); code != 0 {
+		t.Fatalf("-load-request: exit %d, stderr %q", code, errs)
+	}
+	if f.bodies[3] != f.bodies[2] {
+		t.Errorf("replayed body\n%s\nwant\n%s", f.bodies[3], f.bodies[2])
+	}
+	if tp := f.hdrs[3].Get("traceparent"); !strings.HasPrefix(tp, "00-"+id+"-") {
+		t.Errorf("replayed traceparent %q", tp)
+	}
+}
+
+// failfirst fails the first n requests with status and then answers
+// with reply.
+func failfirst(n, status int, reply http.HandlerFunc) http.HandlerFunc {
+	var mu sync.Mutex
+	seen := 0
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen++
+		failing := seen <= n
+		mu.Unlock()
+		if failing {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			io.WriteString(w, `{"error":{"message":"try again"}}`)
+			return
+		}
+		reply(w, r)
+	}
+}
+
+// TestRunIdempotencyKey checks that a retried request goes again
+// under the key of its first attempt, made or given.
+func TestRunIdempotencyKey(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		args []string
+		want string // "" for any
+	}{
+		{"made", nil, ""},
+		{"given", []string{"-idempotency-key", "job-7"}, "job-7"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := newfixture(t, failfirst(1, http.StatusServiceUnavailable, chatreply("ok")))
+			args := append([]string{"-retries", "1", "-retry-jitter", "full"}, c.args...)
+			if _, errs, code := f.run("", append(args, "hello")...); code != 0 {
+				t.Fatalf("exit %d, stderr %q", code, errs)
+			}
+			if len(f.hdrs) != 2 {
+				t.Fatalf("%d attempts, want 2", len(f.hdrs))
+			}
+			first, second := f.hdrs[0].Get("Idempotency-Key"), f.hdrs[1].Get("Idempotency-Key")
+			if first == "" || first != second {
+				t.Errorf("attempts sent keys %q and %q, want one key", first, second)
+			}
+			if c.want != "" && first != c.want {
+				t.Errorf("key %q, want %q", first, c.want)
+			}
+		})
+	}
+}
+
+// TestRunRetryBudget checks that -retry-budget bounds the whole of a
+// request: a first attempt that hangs, and retries that would run on.
+func TestRunRetryBudget(t *testing.T) {
+	t.Run("slow first attempt", func(t *testing.T) {
+		f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+			chatreply("late")(w, r)
+		})
+		start := time.Now()
+		_, errs, code := f.run("", "-retry-budget", "100ms", "hello")
+		if took := time.Since(start); took > time.Second {
+			t.Errorf("took %v with a 100ms budget", took)
+		}
+		if code != 1 || !strings.Contains(errs, "retry budget 100ms spent after 1 attempts") {
+			t.Errorf("exit %d, stderr %q", code, errs)
+		}
+	})
+	t.Run("retries", func(t *testing.T) {
+		f := newfixture(t, failfirst(100, http.StatusServiceUnavailable, chatreply("ok")))
+		_, errs, code := f.run("", "-retries", "5", "-retry-budget", "300ms", "hello")
+		if code != 1 || !strings.Contains(errs, "retry budget 300ms spent") {
+			t.Errorf("exit %d, stderr %q", code, errs)
+		}
+		if len(f.bodies) >= 6 {
+			t.Errorf("%d attempts; the budget did not stop them", len(f.bodies))
+		}
+	})
+}
+
+// apierror answers with an API error of status and code.
+func apierror(status int, code, msg string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, `{"error":{"message":`+quote(msg)+`,"code":`+quote(code)+`}}`)
+	}
+}
+
+// bymodel answers each request with the handler for its model.
+func bymodel(h map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Model string }
+		json.NewDecoder(r.Body).Decode(&req)
+		if hf, ok := h[req.Model]; ok {
+			hf(w, r)
+			return
+		}
+		apierror(http.StatusNotFound, "model_not_found", "no model "+req.Model)(w, r)
+	}
+}
+
+// models are the models of the requests the fixture was sent.
+func (f *fixture) models() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ms []string
+	for _, b := range f.bodies {
+		var req struct{ Model string }
+		json.Unmarshal([]byte(b), &req)
+		ms = append(ms, req.Model)
+	}
+	return ms
+}
+
+// TestRunFallback checks that -fallback moves down the list past a
+// missing and a rate limited model, and not past a bad request.
+func TestRunFallback(t *testing.T) {
+	f := newfixture(t, bymodel(map[string]http.HandlerFunc{
+		"gpt-4o-mini":   apierror(http.StatusTooManyRequests, "rate_limit_exceeded", "slow down"),
+		"gpt-3.5-turbo": chatreply("from the fallback"),
+		"gpt-4.1":       apierror(http.StatusBadRequest, "invalid_request_error", "prompt too long"),
+	}))
+	out, errs, code := f.run("", "-m", "gpt-4o", "-fallback", "gpt-4o-mini,gpt-3.5-turbo", "-retries", "0", "hello")
+	if code != 0 || out != "from the fallback\n" {
+		t.Fatalf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if got, want := f.models(), []string{"gpt-4o", "gpt-4o-mini", "gpt-3.5-turbo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tried %q, want %q", got, want)
+	}
+	if !strings.Contains(errs, "model: gpt-3.5-turbo") {
+		t.Errorf("stderr %q does not say which model answered", errs)
+	}
+
+	n := len(f.bodies)
+	if _, _, code := f.run("", "-m", "gpt-4.1", "-fallback", "gpt-3.5-turbo", "-retries", "0", "hello"); code != 1 {
+		t.Errorf("a bad request exits %d, want 1", code)
+	}
+	if got := f.models()[n:]; !reflect.DeepEqual(got, []string{"gpt-4.1"}) {
+		t.Errorf("a bad request tried %q, want no fallback", got)
+	}
+}
+
+// TestRunKeyRotate checks that -key-rotate moves to $KEYENV_2 when
+// the first key is refused, says so by name without the key, and
+// does not rotate on other errors.
+func TestRunKeyRotate(t *testing.T) {
+	second := "sk-second0123456789abcdef"
+	status := http.StatusOK
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Authorization") != "Bearer "+second:
+			apierror(http.StatusUnauthorized, "invalid_api_key", "bad key")(w, r)
+		case status != http.StatusOK:
+			apierror(status, "server_error", "down")(w, r)
+		default:
+			chatreply("ok")(w, r)
+		}
+	})
+	f.vars = map[string]string{"TEST_KEY_2": second}
+	out, errs, code := f.run("", "-key-rotate", "hello")
+	if code != 0 || out != "ok\n" {
+		t.Fatalf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if len(f.hdrs) != 2 || f.hdrs[0].Get("Authorization") == f.hdrs[1].Get("Authorization") {
+		t.Errorf("%d requests, keys not rotated", len(f.hdrs))
+	}
+	if !strings.Contains(errs, "key: TEST_KEY_2") || strings.Contains(errs, second) {
+		t.Errorf("stderr %q", errs)
+	}
+
+	// a refusal that is not about the key stays with it
+	f.vars["TEST_KEY"], f.vars["TEST_KEY_2"] = second, "sk-third0123456789abcdef"
+	status = http.StatusBadRequest
+	n := len(f.hdrs)
+	if _, _, code := f.run("", "-key-rotate", "-retries", "0", "hello"); code != 1 || len(f.hdrs) != n+1 {
+		t.Errorf("exit %d after %d requests, want 1 after 1", code, len(f.hdrs)-n)
+	}
+}
+
+// TestRunBatchJSONL checks that -batch-jsonl writes one whole JSON
+// line a prompt, assembled from its stream, in input order or as
+// they complete.
+func TestRunBatchJSONL(t *testing.T) {
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		var req ChatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		p := req.Messages[len(req.Messages)-1].Content
+		if strings.HasPrefix(p, "slow") {
+			time.Sleep(100 * time.Millisecond)
+		}
+		streamreply("re: ", p)(w, r)
+	})
+	prompts := filepath.Join(f.home, "prompts")
+	if err := os.WriteFile(prompts, []byte("slow one\ntwo\nthree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		order string
+		want  []int
+	}{
+		{"input", []int{1, 2, 3}},
+		{"completion", nil}, // the slow one last
+	} {
+		t.Run(c.order, func(t *testing.T) {
+			out, errs, code := f.run("", "-batch", prompts, "-batch-jsonl", c.order)
+			if code != 0 {
+				t.Fatalf("exit %d, stderr %q", code, errs)
+			}
+			lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+			if len(lines) != 3 {
+				t.Fatalf("%d lines, want 3:\n%s", len(lines), out)
+			}
+			var got []int
+			for _, line := range lines {
+				var rec BatchRec
+				if err := json.Unmarshal([]byte(line), &rec); err != nil {
+					t.Fatalf("line %q: %v", line, err)
+				}
+				want := "re: " + []string{"slow one", "two", "three"}[rec.Index-1]
+				if rec.Reply != want || rec.Error != "" {
+					t.Errorf("prompt %d: reply %q error %q, want %q", rec.Index, rec.Reply, rec.Error, want)
+				}
+				got = append(got, rec.Index)
+			}
+			if c.want != nil && !reflect.DeepEqual(got, c.want) {
+				t.Errorf("order %v, want %v", got, c.want)
+			}
+			if c.want == nil && got[2] != 1 {
+				t.Errorf("order %v, want the slow prompt last", got)
+			}
+		})
+	}
+}
+
+// TestChunks checks the -summarize-file cuts: no chunk over size,
+// each after the first starting with a bit of the one before, and
+// nothing lost or repeated beyond that.
+func TestChunks(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&b, "line %d says something about part %d of the file.\n", i, i/10)
+	}
+	for i := 0; i < 400; i++ {
+		fmt.Fprintf(&b, "w%d ", i) // a line too long for one chunk
+	}
+	b.WriteString("\n")
+	text := b.String()
+	const size, overlap = 120, 20
+	parts := chunks("gpt-4o", text, size, overlap)
+	if len(parts) < 2 {
+		t.Fatalf("%d chunks", len(parts))
+	}
+	var whole strings.Builder
+	for i, p := range parts {
+		if n := counttokens("gpt-4o", p); n > size {
+			t.Errorf("chunk %d is %d tokens, over %d", i+1, n, size)
+		}
+		if i == 0 {
+			whole.WriteString(p)
+			continue
+		}
+		// the longest start of p that ends what has been put
+		// together so far is the overlap
+		k := len(p)
+		for ; k > 0 && !strings.HasSuffix(whole.String(), p[:k]); k-- {
+		}
+		if k == len(p) {
+			t.Fatalf("chunk %d adds nothing", i+1)
+		}
+		if counttokens("gpt-4o", p[:k]) > overlap {
+			t.Errorf("chunk %d repeats %q, over %d tokens", i+1, p[:k], overlap)
+		}
+		whole.WriteString(p[k:])
+	}
+	if whole.String() != text {
+		t.Errorf("the chunks put back together are not the text")
+	}
+	if got := chunks("gpt-4o", "short\n", size, overlap); !reflect.DeepEqual(got, []string{"short\n"}) {
+		t.Errorf("a short text gave %q", got)
+	}
+	if got := chunks("gpt-4o", "\n \n", size, overlap); len(got) != 0 {
+		t.Errorf("a blank text gave %q", got)
+	}
+}
+
+// TestRunSummarizeFile checks that a file of several chunks gets a
+// summary each and then one of those, which alone is printed.
+func TestRunSummarizeFile(t *testing.T) {
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		var req ChatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		p := req.Messages[len(req.Messages)-1].Content
+		if strings.HasPrefix(p, "These are summaries") {
+			chatreply("the whole file")(w, r)
+			return
+		}
+		var i, n int
+		fmt.Sscanf(p, "This is part %d of %d", &i, &n)
+		chatreply(fmt.Sprintf("part %d of %d", i, n))(w, r)
+	})
+	path := filepath.Join(f.home, "long.txt")
+	if err := os.WriteFile(path, []byte(strings.Repeat("a line of the long file to summarize\n", 300)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, errs, code := f.run("", "-summarize-file", path, "-chunk-tokens", "500", "-chunk-overlap", "50")
+	if code != 0 || out != "the whole file\n" {
+		t.Fatalf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	n := len(chunks("gpt-3.5-turbo", strings.Repeat("a line of the long file to summarize\n", 300), 500, 50))
+	if n < 2 || len(f.bodies) != n+1 {
+		t.Errorf("%d requests for %d chunks, want one each and one to combine them", len(f.bodies), n)
+	}
+	last := f.bodies[len(f.bodies)-1]
+	for i := 1; i <= n; i++ {
+		if !strings.Contains(last, fmt.Sprintf("part %d of %d", i, n)) {
+			t.Errorf("the combining request lacks part %d: %s", i, last)
+		}
+	}
+}
+
+// TestSamehist checks that samehist reports a copy it cannot read as
+// an error for its caller, rather than ending the run.
+func TestSamehist(t *testing.T) {
+	dir := t.TempDir()
+	orig, bad := filepath.Join(dir, "a"+JSONLEXT), filepath.Join(dir, "b"+JSONLEXT)
+	if err := (jsonlstore{path: orig}).Append(convo()...); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bad, []byte("{\"role\":\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &Opts{Store: "jsonl"}
+	if err := samehist(opts, orig, orig); err != nil {
+		t.Errorf("a history and itself: %v", err)
+	}
+	if err := samehist(opts, orig, bad); err == nil {
+		t.Errorf("a corrupt copy passed")
+	}
+}
+
+// TestRunBackup checks that -backup makes copies that load to the
+// same messages as the histories, and that they keep them after the
+// history is rewritten.
+func TestRunBackup(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	for _, args := range [][]string{
+		{"-c", "hello"}, {"-c", "hello"}, {"-c", "-session", "other", "bye"},
+	} {
+		if _, errs, code := f.run("", args...); code != 0 {
+			t.Fatalf("%q: exit %d, stderr %q", args, code, errs)
+		}
+	}
+	load := func(path string) []Message {
+		t.Helper()
+		msgs, err := (ndbstore{path: path}).Load(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgs
+	}
+	orig := load(histpath(f.home, "ndb", SESSION))
+	dest := filepath.Join(f.home, "backups")
+
+	out, errs, code := f.run("", "-backup", dest)
+	if code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	dir := strings.TrimSpace(out)
+	if got := load(filepath.Join(dir, SESSION+HISTEXT)); !reflect.DeepEqual(got, orig) {
+		t.Errorf("the backup loads to\n%#v\nwant\n%#v", got, orig)
+	}
+	if exists(filepath.Join(dir, "other"+HISTEXT)) {
+		t.Errorf("-backup copied another session")
+	}
+
+	// -dedupe rewrites the history; the backup is as it was
+	if _, errs, code := f.run("", "-dedupe", "adjacent"); code != 0 {
+		t.Fatalf("-dedupe: exit %d, stderr %q", code, errs)
+	}
+	if now := load(histpath(f.home, "ndb", SESSION)); len(now) >= len(orig) {
+		t.Fatalf("-dedupe kept %d of %d messages", len(now), len(orig))
+	}
+	if got := load(filepath.Join(dir, SESSION+HISTEXT)); !reflect.DeepEqual(got, orig) {
+		t.Errorf("the backup changed with the history")
+	}
+
+	time.Sleep(time.Second) // the directories are named to the second
+	out, errs, code = f.run("", "-backup", dest, "-backup-all")
+	if code != 0 {
+		t.Fatalf("-backup-all: exit %d, stderr %q", code, errs)
+	}
+	for _, s := range []string{SESSION, "other"} {
+		path := filepath.Join(strings.TrimSpace(out), s+HISTEXT)
+		if got, want := load(path), load(histpath(f.home, "ndb", s)); !reflect.DeepEqual(got, want) {
+			t.Errorf("-backup-all copy of %s differs", s)
+		}
+	}
+}
+
+// addconfig appends lines to the fixture's config.
+func (f *fixture) addconfig(t *testing.T, lines string) {
+	t.Helper()
+	path := filepath.Join(f.home, HISTDIR, CONFFILE)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(data, lines...), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRunAllow checks that with allow= records in the config a model
+// on the list is used and one off it, fallbacks too, is refused
+// before anything is sent.
+func TestRunAllow(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	f.addconfig(t, "allow=gpt-4o*\n")
+	if out, errs, code := f.run("", "-m", "gpt-4o-mini", "hello"); code != 0 || out != "ok\n" {
+		t.Errorf("an allowed model: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	for _, args := range [][]string{
+		{"-m", "gpt-3.5-turbo", "hello"},
+		{"-m", "gpt-4o", "-fallback", "gpt-3.5-turbo", "hello"},
+	} {
+		_, errs, code := f.run("", args...)
+		if code != 1 || !strings.Contains(errs, "model gpt-3.5-turbo is not allowed by the config") {
+			t.Errorf("%q: exit %d, stderr %q", args, code, errs)
+		}
+	}
+	if len(f.bodies) != 1 {
+		t.Errorf("%d requests, want only the allowed one", len(f.bodies))
+	}
+}
+
+// TestRunNoDefaultHeaders checks that -no-default-headers sends the
+// one -H header given and none of slm's own, and warns that the key
+// is not sent.
+func TestRunNoDefaultHeaders(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	_, errs, code := f.run("", "-no-default-headers", "-H", "X-Debug: 1", "hello")
+	if code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if !strings.Contains(errs, "warning") {
+		t.Errorf("no warning about auth: stderr %q", errs)
+	}
+	var got []string
+	for k := range f.hdrs[0] {
+		// the transport's framing, which slm neither sets nor
+		// can stop
+		if k != "Accept-Encoding" && k != "Content-Length" {
+			got = append(got, k)
+		}
+	}
+	if !reflect.DeepEqual(got, []string{"X-Debug"}) || f.hdrs[0].Get("X-Debug") != "1" {
+		t.Errorf("headers sent %q, want only X-Debug: 1", f.hdrs[0])
+	}
+}
+
+// chatpart answers with content as a chat completion that ended for
+// finish, having used tokens in and out.
+func chatpart(content, finish string, tokens int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"choices":[{"message":{"role":"assistant","content":%s},"finish_reason":%q}],`+
+			`"usage":{"prompt_tokens":%d,"completion_tokens":%d,"total_tokens":%d}}`, quote(content), finish, tokens, tokens, 2*tokens)
+	}
+}
+
+// script answers the requests with hs in turn, the last one again
+// once they run out.
+func script(hs ...http.HandlerFunc) http.HandlerFunc {
+	var mu sync.Mutex
+	n := 0
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		h := hs[min(n, len(hs)-1)]
+		n++
+		mu.Unlock()
+		h(w, r)
+	}
+}
+
+// TestRunAutocontinue checks that -autocontinue asks for the rest of
+// a reply cut at the token limit until it stops or the cap is hit,
+// joining the parts.
+func TestRunAutocontinue(t *testing.T) {
+	parts := script(chatpart("one ", "length", 1), chatpart("two ", "length", 1), chatpart("three", "stop", 1))
+	f := newfixture(t, parts)
+	out, errs, code := f.run("", "-autocontinue", "5", "count")
+	if code != 0 || out != "one two three\n" {
+		t.Fatalf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if len(f.bodies) != 3 {
+		t.Fatalf("%d requests, want 3", len(f.bodies))
+	}
+	var req ChatRequest
+	if err := json.Unmarshal([]byte(f.bodies[2]), &req); err != nil {
+		t.Fatal(err)
+	}
+	n := len(req.Messages)
+	if req.Messages[n-2].Role != "assistant" || req.Messages[n-2].Content != "one two " || req.Messages[n-1].Content != continuemsg {
+		t.Errorf("third request %s", f.bodies[2])
+	}
+
+	f = newfixture(t, chatpart("more ", "length", 1))
+	out, errs, code = f.run("", "-autocontinue", "2", "count")
+	if code != 0 || out != "more more more \n" {
+		t.Errorf("at the cap: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if len(f.bodies) != 3 {
+		t.Errorf("%d requests, want the first and 2 more", len(f.bodies))
+	}
+}
+
+// TestRunAutocontinueCost checks that -autocontinue stops at
+// -max-cost, though the reply is still cut short, with a warning.
+func TestRunAutocontinueCost(t *testing.T) {
+	f := newfixture(t, chatpart("pricey ", "length", 100000))
+	out, errs, code := f.run("", "-m", "gpt-4o", "-autocontinue", "5", "-max-cost", "0.05", "-max-tokens", "100", "count")
+	if code != 0 || out != "pricey \n" {
+		t.Fatalf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if len(f.bodies) != 1 {
+		t.Errorf("%d requests, want the loop stopped after the first", len(f.bodies))
+	}
+	if !strings.Contains(errs, "-autocontinue stopped at about $") {
+		t.Errorf("stderr %q", errs)
+	}
+}
+
+// TestRunContinueCode checks that a reply cut inside a code block is
+// continued as code and stitched without a second fence.
+func TestRunContinueCode(t *testing.T) {
+	f := newfixture(t, script(
+		chatpart("Here:\n```go\nfunc main() {\n", "length", 1),
+		chatpart("```go\n\tprintln(1)\n}\n```\n", "stop", 1),
+	))
+	out, errs, code := f.run("", "-continue-code", "2", "write it")
+	if code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if want := "Here:\n```go\nfunc main() {\n\tprintln(1)\n}\n```\n\n"; out != want {
+		t.Errorf("stdout %q, want %q", out, want)
+	}
+	if len(f.bodies) != 2 {
+		t.Fatalf("%d requests, want 2", len(f.bodies))
+	}
+	var req ChatRequest
+	if err := json.Unmarshal([]byte(f.bodies[1]), &req); err != nil {
+		t.Fatal(err)
+	}
+	if last := req.Messages[len(req.Messages)-1]; last.Content != codecontinuemsg {
+		t.Errorf("second request asks %q", last.Content)
+	}
+
+	// the cap holds for code too
+	f = newfixture(t, chatpart("```\nx\n", "length", 1))
+	if _, errs, code := f.run("", "-continue-code", "1", "write it"); code != 0 || len(f.bodies) != 2 {
+		t.Errorf("exit %d after %d requests, want 2; stderr %q", code, len(f.bodies), errs)
+	}
+}
+
+// req is the i'th request the fixture's provider was sent.
+func (f *fixture) req(t *testing.T, i int) ChatRequest {
+	t.Helper()
+	if i >= len(f.bodies) {
+		t.Fatalf("%d requests, want request %d", len(f.bodies), i)
+	}
+	var req ChatRequest
+	if err := json.Unmarshal([]byte(f.bodies[i]), &req); err != nil {
+		t.Fatalf("request %d: %v", i, err)
+	}
+	return req
+}
+
+// last is the content of the last message in a request.
+func last(req ChatRequest) string {
+	if len(req.Messages) == 0 {
+		return ""
+	}
+	return req.Messages[len(req.Messages)-1].Content
+}
+
+// TestRunTemplate checks that -template renders the named template
+// with -var values, one of them read from a file, and refuses one
+// the template uses but was not given.
+func TestRunTemplate(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	f.addconfig(t, `template=review text="Review this {{.Lang}}:\n{{.Code}}"`+"\n")
+	code := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(code, []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs, rc := f.run("", "-template", "review", "-var", "Lang=Go", "-var", "Code=@"+code); rc != 0 {
+		t.Fatalf("exit %d, stderr %q", rc, errs)
+	}
+	if got, want := last(f.req(t, 0)), "Review this Go:\npackage main\n"; got != want {
+		t.Errorf("prompt %q, want %q", got, want)
+	}
+
+	_, errs, rc := f.run("", "-template", "review", "-var", "Lang=Go")
+	if rc == 0 || !strings.Contains(errs, "template review") || len(f.bodies) != 1 {
+		t.Errorf("missing var: exit %d, %d requests, stderr %q", rc, len(f.bodies), errs)
+	}
+}
+
+// TestEsttokens pins the estimator's counts, which -count-tokens and
+// -max-cost rely on being the same from run to run.
+func TestEsttokens(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"hello world", 4},
+		{"a, b.", 4},
+		{"héllo", 3},
+		{"internationalization", 5},
+		{"  \n\t ", 0},
+	} {
+		if got := esttokens("gpt-4o", c.text); got != c.want {
+			t.Errorf("esttokens(%q) = %d, want %d", c.text, got, c.want)
+		}
+	}
+	msgs := []Message{{Role: "user", Content: "hello world"}}
+	if got := msgtokens("gpt-4o", msgs); got != 3+4+4 {
+		t.Errorf("msgtokens = %d, want 11", got)
+	}
+
+	f := newfixture(t, chatreply("unsent"))
+	out, errs, code := f.run("", "-count-tokens", "hello world")
+	again, _, _ := f.run("", "-count-tokens", "hello world")
+	if code != 0 || out == "" || out != again {
+		t.Errorf("exit %d, stdout %q then %q, stderr %q", code, out, again, errs)
+	}
+	if len(f.bodies) != 0 {
+		t.Errorf("-count-tokens sent %d requests", len(f.bodies))
+	}
+}
+
+// TestRunWrapCode checks that -wrap-code fences the reply under the
+// tag it is given, and that replies are left alone without it.
+func TestRunWrapCode(t *testing.T) {
+	f := newfixture(t, chatreply("package main\n"))
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "package main\n\n"},
+		{[]string{"-wrap-code", "text"}, "```text\npackage main\n```\n"},
+		{[]string{"-wrap-code", "auto"}, "```go\npackage main\n```\n"},
+	} {
+		out, errs, code := f.run("", append(c.args, "code")...)
+		if code != 0 || out != c.want {
+			t.Errorf("%q: exit %d, stdout %q, want %q; stderr %q", c.args, code, out, c.want, errs)
+		}
+	}
+}
+
+func TestExtractCode(t *testing.T) {
+	one := "Here you are:\n```go\nfmt.Println(1)\n```\nDone."
+	two := "First:\n```sh\necho a\n```\nthen:\n~~~\necho b\n~~~\n"
+	for _, c := range []struct {
+		reply string
+		all   bool
+		want  string
+	}{
+		{one, false, "fmt.Println(1)"},
+		{one, true, "fmt.Println(1)"},
+		{two, false, "echo a"},
+		{two, true, "echo a\n\necho b"},
+		{"````md\n```go\nx\n```\n````", false, "```go\nx\n```"},
+		{"```\ncut off", false, "cut off"},
+		{"no code here", false, "no code here"},
+		{"no code here", true, "no code here"},
+	} {
+		if got := extractcode(c.reply, c.all); got != c.want {
+			t.Errorf("extractcode(%q, %v) = %q, want %q", c.reply, c.all, got, c.want)
+		}
+	}
+	if b := codeblocks(two); len(b) != 2 || b[0].Lang != "sh" || b[1].Lang != "" {
+		t.Errorf("codeblocks = %+v", b)
+	}
+
+	f := newfixture(t, chatreply("prose"))
+	if out, errs, code := f.run("", "-extract-code", "first", "-strict", "code"); code != EXITFORMAT {
+		t.Errorf("-strict without code: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+}
+
+// responsesbody is a /v1/responses reply with a reasoning item ahead
+// of the message, as reasoning models send.
+const responsesbody = `{"status":"completed","output":[
+	{"type":"reasoning","content":[{"type":"reasoning_text","text":"hmm"}]},
+	{"type":"message","content":[{"type":"output_text","text":"sam "},{"type":"refusal","text":"no"},{"type":"output_text","text":"and acme"}]}],
+	"usage":{"input_tokens":7,"output_tokens":3,"total_tokens":10}}`
+
+func TestResponsestext(t *testing.T) {
+	text, finish, u, err := responsestext([]byte(responsesbody))
+	if err != nil || text != "sam and acme" || finish != "stop" {
+		t.Errorf("got %q, %q, %v", text, finish, err)
+	}
+	if u == nil || *u != (Usage{7, 3, 10}) {
+		t.Errorf("usage %+v", u)
+	}
+	cut := `{"status":"incomplete","incomplete_details":{"reason":"max_output_tokens"},"output":[{"type":"message","content":[{"type":"output_text","text":"sa"}]}]}`
+	if _, finish, _, err := responsestext([]byte(cut)); err != nil || finish != "length" {
+		t.Errorf("incomplete: finish %q, %v", finish, err)
+	}
+	if _, _, _, err := responsestext([]byte(`{"status":"completed","output":[{"type":"reasoning"}]}`)); err == nil {
+		t.Error("no output text: no error")
+	}
+
+	var path string
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		io.WriteString(w, responsesbody)
+	})
+	out, errs, code := f.run("", "-api", "responses", "-m", "gpt-4o", "name two editors")
+	if code != 0 || out != "sam and acme\n" || path != "/v1/responses" {
+		t.Fatalf("exit %d, stdout %q, path %s, stderr %q", code, out, path, errs)
+	}
+	var req ResponsesRequest
+	if err := json.Unmarshal([]byte(f.bodies[0]), &req); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(req.Input); n == 0 || req.Input[n-1].Content != "name two editors" {
+		t.Errorf("request %s", f.bodies[0])
+	}
+}
+
+// TestRunRole checks that -role sends the prompt under that role.
+func TestRunRole(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	if _, errs, code := f.run("", "-role", "system", "answer in haiku"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	req := f.req(t, 0)
+	if m := req.Messages[len(req.Messages)-1]; m.Role != "system" || m.Content != "answer in haiku" {
+		t.Errorf("last message %+v", m)
+	}
+	if _, errs, code := f.run("", "-role", "tool", "hi"); code == 0 || !strings.Contains(errs, "-role") {
+		t.Errorf("-role tool: exit %d, stderr %q", code, errs)
+	}
+}
+
+// TestRunNoNewline checks the bytes printed with and without
+// -no-newline, streamed and not.
+func TestRunNoNewline(t *testing.T) {
+	plain := newfixture(t, chatreply("42"))
+	streamed := newfixture(t, streamreply("4", "2"))
+	for _, c := range []struct {
+		f    *fixture
+		args []string
+		want string
+	}{
+		{plain, nil, "42\n"},
+		{plain, []string{"-no-newline"}, "42"},
+		{streamed, []string{"-S"}, "42\n"},
+		{streamed, []string{"-S", "-no-newline"}, "42"},
+	} {
+		out, errs, code := c.f.run("", append(c.args, "answer")...)
+		if code != 0 || out != c.want {
+			t.Errorf("%q: exit %d, stdout %q, want %q; stderr %q", c.args, code, out, c.want, errs)
+		}
+	}
+}
+
+func TestCheckcost(t *testing.T) {
+	// 1000 tokens in and out of gpt-4o are $0.0025 and $0.01
+	if cost, err := checkcost("gpt-4o", 1000, 1000, 0.02); err != nil || cost != 0.0125 {
+		t.Errorf("under the limit: $%v, %v", cost, err)
+	}
+	if _, err := checkcost("gpt-4o", 1000, 1000, 0.01); err == nil || !strings.Contains(err.Error(), "over -max-cost") {
+		t.Errorf("over the limit: %v", err)
+	}
+	if _, err := checkcost("no-such-model", 1, 1, 1); err == nil {
+		t.Error("unknown model: no error")
+	}
+	if p, _ := modelprice("gpt-4o-mini-2024-07-18"); p != prices["gpt-4o-mini"] {
+		t.Errorf("dated snapshot priced %v", p)
+	}
+
+	f := newfixture(t, chatreply("ok"))
+	if _, errs, code := f.run("", "-m", "gpt-4o", "-max-cost", "0.000001", "hi"); code != 1 || !strings.Contains(errs, "over -max-cost") {
+		t.Errorf("abort: exit %d, stderr %q", code, errs)
+	}
+	if len(f.bodies) != 0 {
+		t.Errorf("sent %d requests over -max-cost", len(f.bodies))
+	}
+	if out, errs, code := f.run("", "-m", "gpt-4o", "-max-cost", "1", "hi"); code != 0 || out != "ok\n" {
+		t.Errorf("allow: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+}
+
+// TestRunPromptLibrary checks that -sp sends the named file in
+// $home/lib/llm/prompts as the system prompt and -list-prompts lists
+// the files there.
+func TestRunPromptLibrary(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	dir := filepath.Join(f.home, HISTDIR, PROMPTDIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range map[string]string{"terse": "Be terse.\n", "pirate": "Talk like a pirate.\n", ".hidden": "no"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, errs, code := f.run("", "-list-prompts")
+	if code != 0 || out != "pirate\nterse\n" {
+		t.Errorf("-list-prompts: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if _, errs, code := f.run("", "-sp", "terse", "hi"); code != 0 {
+		t.Fatalf("-sp terse: exit %d, stderr %q", code, errs)
+	}
+	if m := f.req(t, 0).Messages[0]; m.Role != "system" || m.Content != "Be terse." {
+		t.Errorf("first message %+v", m)
+	}
+	if _, errs, code := f.run("", "-sp", "missing", "hi"); code == 0 || !strings.Contains(errs, "system prompt missing") {
+		t.Errorf("-sp missing: exit %d, stderr %q", code, errs)
+	}
+}
+
+// TestRunContinueInteractive checks that -ci sends the history with
+// the first prompt typed, and each reply with the turns after it.
+func TestRunContinueInteractive(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	store := ndbstore{path: histpath(f.home, "ndb", SESSION)}
+	if err := store.Append(convo()[1:]...); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs, code := f.run("first\nsecond\n", "-ci"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if len(f.bodies) != 2 {
+		t.Fatalf("%d requests, want 2", len(f.bodies))
+	}
+	var got []string
+	for _, m := range f.req(t, 1).Messages {
+		got = append(got, m.Role+":"+m.Content)
+	}
+	want := []string{"user:" + convo()[1].Content, "assistant:" + convo()[2].Content, "user:first", "assistant:ok", "user:second"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("second turn sends\n%q\nwant\n%q", got, want)
+	}
+	if first := f.req(t, 0).Messages; len(first) != 3 || first[0].Content != convo()[1].Content {
+		t.Errorf("first turn sends %+v", first)
+	}
+}
+
+// limited answers ok with the given x-ratelimit-* headers.
+func limited(hdrs map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range hdrs {
+			w.Header().Set(k, v)
+		}
+		chatreply("ok")(w, r)
+	}
+}
+
+// TestRunRateLimit checks that -ratelimit reports the x-ratelimit-*
+// headers of the response.
+func TestRunRateLimit(t *testing.T) {
+	f := newfixture(t, limited(map[string]string{
+		"x-ratelimit-limit-requests":     "500",
+		"x-ratelimit-remaining-requests": "499",
+		"x-ratelimit-reset-requests":     "120ms",
+		"x-ratelimit-limit-tokens":       "30000",
+		"x-ratelimit-remaining-tokens":   "29500",
+		"x-ratelimit-reset-tokens":       "1s",
+	}))
+	_, errs, code := f.run("", "-ratelimit", "hi")
+	if want := "ratelimit: requests 499/500 (reset 120ms), tokens 29500/30000 (reset 1s)\n"; code != 0 || !strings.Contains(errs, want) {
+		t.Errorf("exit %d, stderr %q, want %q", code, errs, want)
+	}
+	if _, ok := ratelimit(http.Header{"Content-Type": {"application/json"}}); ok {
+		t.Error("ratelimit found limits in headers without any")
+	}
+	rl, ok := ratelimit(http.Header{"X-Ratelimit-Remaining-Tokens": {"12"}, "X-Ratelimit-Reset-Tokens": {"6m0s"}})
+	if !ok || rl != (RateLimit{RemainingTokens: 12, ResetTokens: 6 * time.Minute}) {
+		t.Errorf("some headers: %+v, %v", rl, ok)
+	}
+}
+
+func TestSince(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	msgs := []Message{
+		{Role: "user", Content: "undated"},
+		{Role: "user", Content: "old", Time: now.AddDate(0, 0, -30)},
+		{Role: "assistant", Content: "last week", Time: now.AddDate(0, 0, -7)},
+		{Role: "user", Content: "today", Time: now.Add(-time.Hour)},
+	}
+	contents := func(ms []Message) (s []string) {
+		for _, m := range ms {
+			s = append(s, m.Content)
+		}
+		return s
+	}
+	for _, c := range []struct {
+		since   string
+		undated bool
+		want    []string
+	}{
+		{"7d", false, []string{"last week", "today"}},
+		{"24h", false, []string{"today"}},
+		{"24h", true, []string{"undated", "today"}},
+		{"2024-01-01T00:00:00Z", false, []string{"old", "last week", "today"}},
+		{"1m", false, nil},
+	} {
+		cutoff, err := parsesince(c.since, now)
+		if err != nil {
+			t.Fatalf("parsesince(%q): %v", c.since, err)
+		}
+		if got := contents(since(msgs, cutoff, c.undated)); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("since %s (undated %v) = %q, want %q", c.since, c.undated, got, c.want)
+		}
+	}
+	if _, err := parsesince("last tuesday", now); err == nil {
+		t.Error("parsesince took a bad -since")
+	}
+
+	f := newfixture(t, chatreply("unused"))
+	store := ndbstore{path: histpath(f.home, "ndb", SESSION)}
+	recent := Message{Role: "user", Content: "recent", Time: time.Now().Add(-time.Minute)}
+	if err := store.Append(msgs[1], recent); err != nil {
+		t.Fatal(err)
+	}
+	out, errs, code := f.run("", "-view", "-since", "1h")
+	if code != 0 || !strings.Contains(out, "recent") || strings.Contains(out, "old") {
+		t.Errorf("-view -since 1h: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+}
+
+// TestRunHTMLReply checks that an HTML page served with status 200,
+// as captive portals and proxies do, is reported as such.
+func TestRunHTMLReply(t *testing.T) {
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, "<!doctype html>\n<html><body>\n<h1>Sign in to the guest network</h1></body></html>\n")
+	})
+	out, errs, code := f.run("", "hi")
+	if code != 1 || out != "" {
+		t.Errorf("exit %d, stdout %q", code, out)
+	}
+	for _, want := range []string{"sent a non-JSON reply (status 200, text/html", "Sign in to the guest network"} {
+		if !strings.Contains(errs, want) {
+			t.Errorf("stderr %q lacks %q", errs, want)
+		}
+	}
+	if !isjson("", []byte(" {\"choices\":[]}")) || isjson("text/plain", []byte("<p>")) || !isjson("application/json", nil) {
+		t.Error("isjson")
+	}
+}
+
+// hist loads the default session's history from the store.
+func (f *fixture) hist(t *testing.T, store string) []Message {
+	t.Helper()
+	s, err := histstores[store].open(histpath(f.home, store, SESSION))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	msgs, err := s.Load(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+// TestRunSaveUsage checks that -save-usage stores the usage with the
+// reply and that it reads back, and that without it none is stored.
+func TestRunSaveUsage(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	for _, store := range []string{"ndb", "jsonl"} {
+		for _, args := range [][]string{{"-save-usage"}, nil} {
+			if _, errs, code := f.run("", append([]string{"-store", store, "-c"}, append(args, "hi")...)...); code != 0 {
+				t.Fatalf("%s: exit %d, stderr %q", store, code, errs)
+			}
+		}
+		var got []*Usage
+		for _, m := range f.hist(t, store) {
+			if m.Role == "assistant" {
+				got = append(got, m.Usage)
+			}
+		}
+		if want := []*Usage{{3, 2, 5}, nil}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s history keeps usage %v, want %v", store, got, want)
+		}
+	}
+}
+
+// TestRunPostProcess checks that the reply printed and stored is the
+// one -postprocess turned it into, and that a failing command fails.
+func TestRunPostProcess(t *testing.T) {
+	f := newfixture(t, chatreply("quiet reply"))
+	out, errs, code := f.run("", "-c", "-postprocess", "tr a-z A-Z", "hi")
+	if code != 0 || out != "QUIET REPLY\n" {
+		t.Fatalf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if h := f.hist(t, "ndb"); len(h) != 2 || h[1].Content != "QUIET REPLY" {
+		t.Errorf("history %+v", h)
+	}
+	out, errs, code = f.run("", "-postprocess", "cat >/dev/null; exit 3", "hi")
+	if code == 0 || out != "" || !strings.Contains(errs, "-postprocess") {
+		t.Errorf("failing command: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+}
+
+// TestRunStrict checks that a truncated reply is a warning but under
+// -strict an error with its own exit status, and is not stored.
+func TestRunStrict(t *testing.T) {
+	f := newfixture(t, chatpart("half a", "length", 1))
+	out, errs, code := f.run("", "hi")
+	if code != 0 || out != "half a\n" || !strings.Contains(errs, "warning: reply truncated") {
+		t.Errorf("without -strict: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	out, errs, code = f.run("", "-c", "-strict", "hi")
+	if code != EXITTRUNC || out != "" || !strings.Contains(errs, "finish_reason=length") {
+		t.Errorf("-strict: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if h := f.hist(t, "ndb"); len(h) != 0 {
+		t.Errorf("-strict stored %+v", h)
+	}
+
+	f = newfixture(t, chatpart("", "content_filter", 1))
+	if _, errs, code := f.run("", "-strict", "hi"); code != EXITFILTER {
+		t.Errorf("content filter: exit %d, stderr %q", code, errs)
+	}
+}
+
+// TestRunPromptWrap checks that -prompt-prefix and -prompt-suffix go
+// either side of the prompt, and that the config's stand in for them.
+func TestRunPromptWrap(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	if _, errs, code := f.run("", "-prompt-prefix", "Q: ", "-prompt-suffix", "\nA:", "why"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if got := last(f.req(t, 0)); got != "Q: why\nA:" {
+		t.Errorf("prompt %q", got)
+	}
+	f.addconfig(t, `prompt= prefix="Briefly: " suffix="\nNo lists."`+"\n")
+	if _, errs, code := f.run("", "why"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if got := last(f.req(t, 1)); got != "Briefly: why\nNo lists." {
+		t.Errorf("prompt from config %q", got)
+	}
+	if _, errs, code := f.run("", "-prompt-prefix", "Q: ", "why"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if got := last(f.req(t, 2)); got != "Q: why\nNo lists." {
+		t.Errorf("prefix flag over config %q", got)
+	}
+}
+
+// TestRunEmptyPrompt checks that a blank prompt is refused with the
+// usage before anything is sent, unless a system prompt goes alone.
+func TestRunEmptyPrompt(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	for _, c := range []struct {
+		stdin string
+		args  []string
+	}{
+		{"", nil},
+		{" \n\t\n", nil},
+		{"", []string{"   "}},
+	} {
+		_, errs, code := f.run(c.stdin, c.args...)
+		if code != 2 || !strings.Contains(errs, "[ERROR]: empty prompt") || !strings.Contains(errs, "Usage") {
+			t.Errorf("stdin %q, args %q: exit %d, stderr %q", c.stdin, c.args, code, errs)
+		}
+	}
+	if len(f.bodies) != 0 {
+		t.Fatalf("%d requests for empty prompts", len(f.bodies))
+	}
+	if _, errs, code := f.run("", "-s", "Tell a joke."); code != 0 || len(f.bodies) != 1 {
+		t.Errorf("system prompt alone: exit %d, %d requests, stderr %q", code, len(f.bodies), errs)
+	}
+}
+
+// TestRunPruneSessions checks that -prune-sessions 2 keeps the two
+// most recently used of five sessions, and only once told yes.
+func TestRunPruneSessions(t *testing.T) {
+	f := newfixture(t, chatreply("unused"))
+	dir := filepath.Join(f.home, HISTDIR)
+	now := time.Now()
+	for i, name := range []string{"a", "b", "c", "d", "e"} {
+		path := filepath.Join(dir, name+HISTEXT)
+		if err := os.WriteFile(path, []byte("role=user content=hi\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// c and a are the newest
+		when := now.Add(-time.Duration([]int{1, 5, 0, 9, 7}[i]) * time.Hour)
+		if err := os.Chtimes(path, when, when); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sessions := func() (names []string) {
+		ents, _ := os.ReadDir(dir)
+		for _, e := range ents {
+			if strings.HasSuffix(e.Name(), HISTEXT) {
+				names = append(names, strings.TrimSuffix(e.Name(), HISTEXT))
+			}
+		}
+		return names
+	}
+
+	if _, errs, code := f.run("n\n", "-prune-sessions", "2"); code != 0 || !strings.Contains(errs, "remove 3 sessions?") {
+		t.Errorf("asking: exit %d, stderr %q", code, errs)
+	}
+	if got := sessions(); len(got) != 5 {
+		t.Errorf("answering no left %q", got)
+	}
+	if _, errs, code := f.run("", "-prune-sessions", "2", "-f"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if got := sessions(); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("kept %q, want a and c", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, CONFFILE)); err != nil {
+		t.Errorf("config: %v", err)
+	}
+}
+
+// TestRunDiff checks the review prompt -diff builds around a fixed
+// diff, and that an empty one is refused.
+func TestRunDiff(t *testing.T) {
+	diff := "--- a/x.go\n+++ b/x.go\n@@ -1 +1 @@\n-x := 1\n+x := 2\n"
+	got, err := reviewprompt(diff, "Mind the API.")
+	if want := reviewintro + "\n\nMind the API.\n\n```diff\n" + diff + "```\n"; err != nil || got != want {
+		t.Errorf("reviewprompt = %q, %v\nwant %q", got, err, want)
+	}
+	if _, err := reviewprompt("\n", ""); err == nil {
+		t.Error("empty diff: no error")
+	}
+
+	f := newfixture(t, chatreply("lgtm"))
+	path := filepath.Join(t.TempDir(), "change.diff")
+	if err := os.WriteFile(path, []byte(diff), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs, code := f.run("", "-diff", path); code != 0 {
+		t.Fatalf("-diff file: exit %d, stderr %q", code, errs)
+	}
+	if _, errs, code := f.run(diff, "-diff", "-"); code != 0 {
+		t.Fatalf("-diff -: exit %d, stderr %q", code, errs)
+	}
+	want, _ := reviewprompt(diff, "")
+	for i := 0; i < 2; i++ {
+		if got := last(f.req(t, i)); got != want {
+			t.Errorf("request %d prompt %q", i, got)
+		}
+	}
+}
+
+const pointschema = `{"type":"object","properties":{"x":{"type":"integer"},"y":{"type":"integer"},
+	"tag":{"enum":["a","b"]}},"required":["x","y"],"additionalProperties":false}`
+
+// TestRunSchema checks the response_format -schema asks for and that
+// the reply is checked against the schema locally too.
+func TestRunSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "point.json")
+	if err := os.WriteFile(path, []byte(pointschema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := newfixture(t, chatreply(`{"x":1,"y":2}`))
+	out, errs, code := f.run("", "-m", "gpt-4o", "-schema", path, "-strict", "a point")
+	if code != 0 || out != "{\"x\":1,\"y\":2}\n" {
+		t.Fatalf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	rf := f.req(t, 0).ResponseFormat
+	if rf == nil || rf.Type != "json_schema" || rf.JSONSchema.Name != "point" || !rf.JSONSchema.Strict {
+		t.Fatalf("response_format %+v in %s", rf, f.bodies[0])
+	}
+	var got, want interface{}
+	json.Unmarshal(rf.JSONSchema.Schema, &got)
+	json.Unmarshal([]byte(pointschema), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("schema sent %s", rf.JSONSchema.Schema)
+	}
+
+	for reply, msg := range map[string]string{
+		`{"x":1}`:                 `missing "y"`,
+		`{"x":1,"y":2.5}`:         "$.y: want integer",
+		`{"x":1,"y":2,"z":3}`:     `unexpected "z"`,
+		`{"x":1,"y":2,"tag":"c"}`: "is not one of",
+		`not json`:                "reply is not JSON",
+	} {
+		f := newfixture(t, chatreply(reply))
+		_, errs, code := f.run("", "-m", "gpt-4o", "-schema", path, "-strict", "a point")
+		if code != EXITFORMAT || !strings.Contains(errs, msg) {
+			t.Errorf("%s: exit %d, stderr %q, want %q", reply, code, errs, msg)
+		}
+		if _, errs, code := f.run("", "-m", "gpt-4o", "-schema", path, "a point"); code != 0 || !strings.Contains(errs, "warning: ") {
+			t.Errorf("%s without -strict: exit %d, stderr %q", reply, code, errs)
+		}
+	}
+}
+
+// TestRunMigrate checks that -migrate brings a version 0 history,
+// role and content only, up to the current version unchanged.
+func TestRunMigrate(t *testing.T) {
+	f := newfixture(t, chatreply("unused"))
+	path := histpath(f.home, "ndb", SESSION)
+	v0 := "role=user content=\"what is rc?\"\nrole=assistant content=\"the Plan 9 shell\"\n"
+	if err := os.WriteFile(path, []byte(v0), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := f.hist(t, "ndb")
+
+	out, errs, code := f.run("", "-migrate")
+	if code != 0 || out != fmt.Sprintf("%s: version 0 -> %d\n", path, HISTVER) {
+		t.Fatalf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), verline()+"\n") {
+		t.Errorf("migrated file starts %q", data)
+	}
+	if ver, err := histversion(path); err != nil || ver != HISTVER {
+		t.Errorf("version %d, %v", ver, err)
+	}
+	after := f.hist(t, "ndb")
+	if len(after) != 2 || !reflect.DeepEqual(after, before) {
+		t.Errorf("migrated history\n%+v\nwant\n%+v", after, before)
+	}
+	if out, _, code := f.run("", "-migrate"); code != 0 || !strings.Contains(out, fmt.Sprintf("already version %d", HISTVER)) {
+		t.Errorf("again: exit %d, stdout %q", code, out)
+	}
+}
+
+func TestJSONField(t *testing.T) {
+	reply := `{"user":{"name":"glenda","langs":["rc","go"],"age":30,"tags":{"a":true}}}`
+	for path, want := range map[string]string{
+		"user.name":    "glenda",
+		"user.langs.1": "go",
+		"user.age":     "30",
+		"user.tags":    `{"a":true}`,
+		"user.langs":   `["rc","go"]`,
+	} {
+		if got, err := jsonfield(reply, path); err != nil || got != want {
+			t.Errorf("jsonfield(%s) = %q, %v, want %q", path, got, err, want)
+		}
+	}
+	if got, err := jsonfield("Here:\n```json\n{\"a\":{\"b\":\"c\"}}\n```\n", "a.b"); err != nil || got != "c" {
+		t.Errorf("fenced: %q, %v", got, err)
+	}
+	for path, msg := range map[string]string{
+		"user.email":   `no "email" in $.user`,
+		"user.langs.2": `no index "2" in $.user.langs (2 items)`,
+		"user.langs.x": `no index "x"`,
+		"user.name.x":  "$.user.name is not an object or array",
+	} {
+		if _, err := jsonfield(reply, path); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("jsonfield(%s): %v, want %q", path, err, msg)
+		}
+	}
+	if _, err := jsonfield("not json", "a"); err == nil || !strings.Contains(err.Error(), "reply is not JSON") {
+		t.Errorf("not JSON: %v", err)
+	}
+
+	f := newfixture(t, chatreply(reply))
+	if out, errs, code := f.run("", "-field", "user.langs.0", "who"); code != 0 || out != "rc\n" {
+		t.Errorf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if _, errs, code := f.run("", "-field", "user.email", "who"); code != EXITFORMAT {
+		t.Errorf("missing field: exit %d, stderr %q", code, errs)
+	}
+}
+
+// TestRunLogprobs checks that -logprobs asks for log probabilities
+// and prints those that come back, and that without it the request
+// has no logprobs fields.
+func TestRunLogprobs(t *testing.T) {
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"Hi!"},"finish_reason":"stop",
+			"logprobs":{"content":[{"token":"Hi","logprob":-0.0123,"top_logprobs":[{"token":"Hi","logprob":-0.0123},{"token":"Hello","logprob":-4.5}]},
+			{"token":"!","logprob":-0.5,"top_logprobs":[]}]}}]}`)
+	})
+	out, errs, code := f.run("", "-m", "gpt-4o", "-logprobs", "2", "greet")
+	if code != 0 || out != "Hi!\n" {
+		t.Fatalf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	want := "logprob: \"Hi\"\t-0.0123\t\"Hi\"=-0.0123\t\"Hello\"=-4.5000\nlogprob: \"!\"\t-0.5000\n"
+	if !strings.Contains(errs, want) {
+		t.Errorf("stderr %q, want %q", errs, want)
+	}
+	if req := f.req(t, 0); !req.Logprobs || req.TopLogprobs != 2 {
+		t.Errorf("request %s", f.bodies[0])
+	}
+
+	if _, errs, code := f.run("", "-m", "gpt-4o", "greet"); code != 0 || strings.Contains(errs, "logprob") {
+		t.Fatalf("without -logprobs: exit %d, stderr %q", code, errs)
+	}
+	if strings.Contains(f.bodies[1], "logprobs") {
+		t.Errorf("request without -logprobs %s", f.bodies[1])
+	}
+}
+
+func TestConfirmlarge(t *testing.T) {
+	opts := &Opts{Model: "gpt-4o", ConfirmOver: 5}
+	big := strings.Repeat("word ", 10) // 10 tokens
+	msgs := []Message{{Role: "user", Content: big}}
+	for _, c := range []struct {
+		prompt string
+		tty    bool
+		strict bool
+		answer string
+		ok     bool
+		asked  bool
+		err    bool
+	}{
+		{"small", true, false, "", true, false, false},
+		{big, true, false, "y\n", true, true, false},
+		{big, true, false, "yes\n", true, true, false},
+		{big, true, false, "\n", false, true, false},
+		{big, true, false, "", false, true, false},
+		{big, false, false, "", true, false, false},
+		{big, false, true, "", false, false, true},
+	} {
+		opts.Strict = c.strict
+		var out bytes.Buffer
+		ok, err := confirmlarge(opts, msgs, c.prompt, c.tty, strings.NewReader(c.answer), &out)
+		asked := strings.Contains(out.String(), "prompt is about 10 tokens") && strings.HasSuffix(out.String(), "send? [y/N] ")
+		if ok != c.ok || asked != c.asked || (err != nil) != c.err {
+			t.Errorf("%.5q tty %v strict %v answer %q: ok %v, asked %v (%q), %v", c.prompt, c.tty, c.strict, c.answer, ok, asked, out.String(), err)
+		}
+	}
+}
+
+// TestRunTee checks that -tee prints the whole reply and writes it to
+// the file as well, streamed or not, and that -o only writes it.
+func TestRunTee(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		name  string
+		reply http.HandlerFunc
+		args  []string
+	}{
+		{"plain", chatreply("line one\nline two"), nil},
+		{"stream", streamreply("line one", "\nline ", "two"), []string{"-S"}},
+	} {
+		f := newfixture(t, c.reply)
+		path := filepath.Join(dir, c.name)
+		out, errs, code := f.run("", append(c.args, "-tee", path, "two lines")...)
+		if code != 0 || out != "line one\nline two\n" {
+			t.Errorf("%s: exit %d, stdout %q, stderr %q", c.name, code, out, errs)
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != out {
+			t.Errorf("%s: -tee file %q, %v, want %q", c.name, data, err, out)
+		}
+	}
+
+	f := newfixture(t, chatreply("only to the file"))
+	path := filepath.Join(dir, "o")
+	if out, errs, code := f.run("", "-o", path, "hi"); code != 0 || out != "" {
+		t.Errorf("-o: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "only to the file\n" {
+		t.Errorf("-o file %q", data)
+	}
+}
+
+// TestRunEffort checks that reasoning_effort is sent only when
+// -effort is given, and to a model that takes it.
+func TestRunEffort(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	for _, args := range [][]string{
+		{"-m", "o3-mini", "-effort", "low"},
+		{"-m", "o3-mini"},
+		{"-m", "gpt-4o", "-effort", "low"},
+	} {
+		if _, errs, code := f.run("", append(args, "think")...); code != 0 {
+			t.Fatalf("%q: exit %d, stderr %q", args, code, errs)
+		}
+	}
+	if !strings.Contains(f.bodies[0], `"reasoning_effort":"low"`) {
+		t.Errorf("-effort low: %s", f.bodies[0])
+	}
+	for _, i := range []int{1, 2} {
+		if strings.Contains(f.bodies[i], "effort") {
+			t.Errorf("request %d has an effort: %s", i, f.bodies[i])
+		}
+	}
+	if b, _ := json.Marshal(responsesreq(&Opts{Model: "o3-mini", Effort: "high"}, nil)); !strings.Contains(string(b), `"reasoning":{"effort":"high"}`) {
+		t.Errorf("-api responses: %s", b)
+	}
+	if b, _ := json.Marshal(responsesreq(&Opts{Model: "o3-mini"}, nil)); strings.Contains(string(b), "reasoning") {
+		t.Errorf("-api responses without -effort: %s", b)
+	}
+	if _, errs, _ := f.run("", "-m", "o3-mini", "-effort", "extreme", "think"); !strings.Contains(errs, "-effort") || len(f.bodies) != 3 {
+		t.Errorf("-effort extreme: stderr %q", errs)
+	}
+}
+
+// TestRunImg checks that -img goes with the prompt as an image part
+// to a vision model, and is left out with a warning for a model known
+// not to take images.
+func TestRunImg(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	png := filepath.Join(t.TempDir(), "dot.png")
+	if err := os.WriteFile(png, []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, errs, code := f.run("", "-m", "gpt-4o", "-img", png, "what is this?")
+	if code != 0 || errs != "" {
+		t.Fatalf("gpt-4o: exit %d, stderr %q", code, errs)
+	}
+	want := `"content":[{"type":"text","text":"what is this?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,`
+	if !strings.Contains(f.bodies[0], want) {
+		t.Errorf("gpt-4o: %s", f.bodies[0])
+	}
+	_, errs, code = f.run("", "-m", "gpt-3.5-turbo", "-img", png, "what is this?")
+	if code != 0 || !strings.Contains(errs, "gpt-3.5-turbo does not take -img") {
+		t.Errorf("gpt-3.5-turbo: exit %d, stderr %q", code, errs)
+	}
+	if strings.Contains(f.bodies[1], "image_url") || last(f.req(t, 1)) != "what is this?" {
+		t.Errorf("gpt-3.5-turbo: %s", f.bodies[1])
+	}
+	if _, errs, code := f.run("", "-img", filepath.Join(f.home, "lib", "llm", "config"), "hi"); code == 0 || !strings.Contains(errs, "not an image") {
+		t.Errorf("a text file: exit %d, stderr %q", code, errs)
+	}
+}
+
+// TestRunDropSystem checks that -drop-system sends no system message,
+// from -s or the history, while the history keeps its own.
+func TestRunDropSystem(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	store := ndbstore{path: histpath(f.home, "ndb", SESSION)}
+	if err := store.Append(convo()...); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs, code := f.run("", "-c", "-drop-system", "-s", "Be kind.", "again"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	req := f.req(t, 0)
+	for _, m := range req.Messages {
+		if m.Role == "system" {
+			t.Errorf("sent a system message: %s", f.bodies[0])
+		}
+	}
+	if len(req.Messages) != 3 || last(req) != "again" {
+		t.Errorf("sent %+v", req.Messages)
+	}
+	if h := f.hist(t, "ndb"); h[0].Role != "system" || h[0].Content != "Be terse." {
+		t.Errorf("history starts %+v", h[0])
+	}
+}
+
+// TestRunMeasure checks the timings -measure reports against a reply
+// that takes a known time to start and to finish.
+func TestRunMeasure(t *testing.T) {
+	const delay = 40 * time.Millisecond
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(delay)
+		chatreply("ok")(w, r)
+	})
+	_, errs, code := f.run("", "-measure", "hi")
+	if code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	var first, total time.Duration
+	var sfirst, stotal string
+	var ntok int
+	var rate float64
+	if _, err := fmt.Sscanf(errs[strings.Index(errs, "measure: "):], "measure: first byte %s total %s %d tokens, %f tokens/s",
+		&sfirst, &stotal, &ntok, &rate); err != nil {
+		t.Fatalf("stderr %q: %v", errs, err)
+	}
+	first, _ = time.ParseDuration(strings.TrimSuffix(sfirst, ","))
+	total, _ = time.ParseDuration(strings.TrimSuffix(stotal, ","))
+	if first < delay || total < 2*delay || ntok != 2 || rate <= 0 {
+		t.Errorf("first byte %v, total %v, %d tokens at %v/s; want over %v and %v", first, total, ntok, rate, delay, 2*delay)
+	}
+
+	res := &Reply{Content: "four words in here", FirstByte: time.Second, Elapsed: 2 * time.Second}
+	if got, want := measure("gpt-4o", res), "first byte 1s, total 2s, ~5 tokens, 2.5 tokens/s"; got != want {
+		t.Errorf("estimated: %q, want %q", got, want)
+	}
+	res.Usage = &Usage{CompletionTokens: 10}
+	if got, want := measure("gpt-4o", res), "first byte 1s, total 2s, 10 tokens, 5.0 tokens/s"; got != want {
+		t.Errorf("from usage: %q, want %q", got, want)
+	}
+}
+
+// TestRunPromptsOnly checks that under -store-prompts-only the
+// history gets the prompts but not the replies.
+func TestRunPromptsOnly(t *testing.T) {
+	f := newfixture(t, chatreply("secret reply"))
+	for _, p := range []string{"one", "two"} {
+		if _, errs, code := f.run("", "-c", "-store-prompts-only", p); code != 0 {
+			t.Fatalf("exit %d, stderr %q", code, errs)
+		}
+	}
+	var got []string
+	for _, m := range f.hist(t, "ndb") {
+		got = append(got, m.Role+":"+m.Content)
+	}
+	if want := []string{"user:one", "user:two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("history %q, want %q", got, want)
+	}
+	if n := len(f.req(t, 1).Messages); n != 2 {
+		t.Errorf("second request sends %d messages, want the two prompts", n)
+	}
+}
+
+// TestRunBase64 checks that a prompt with bytes a shell would mangle
+// goes through -base64-prompt intact, and that -reply-base64 encodes
+// the reply so it decodes back to what was sent.
+func TestRunBase64(t *testing.T) {
+	prompt := "tab\there, \x1b[31mescapes\x1b[0m, ünïcode and \"quotes\"\n"
+	reply := "reply with\r\nCRLF and \x7f"
+	f := newfixture(t, chatreply(reply))
+	enc := base64.StdEncoding.EncodeToString([]byte(prompt))
+	// encoders wrap their lines
+	wrapped := enc[:20] + "\n" + enc[20:] + "\n"
+	out, errs, code := f.run(wrapped, "-base64-prompt", "-reply-base64")
+	if code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if got := last(f.req(t, 0)); got != prompt {
+		t.Errorf("prompt %q, want %q", got, prompt)
+	}
+	dec, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(out, "\n"))
+	if err != nil || string(dec) != reply {
+		t.Errorf("reply %q decodes to %q, %v", out, dec, err)
+	}
+	if _, errs, code := f.run("not base64!", "-base64-prompt"); code == 0 || !strings.Contains(errs, "-base64-prompt") {
+		t.Errorf("bad base64: exit %d, stderr %q", code, errs)
+	}
+}
+
+// TestRunViewRedact checks that -view -redact masks emails, keys and
+// the config's patterns in what it shows, leaving the file as it was.
+func TestRunViewRedact(t *testing.T) {
+	f := newfixture(t, chatreply("unused"))
+	f.addconfig(t, `redact=phone pattern="[0-9]{3}-[0-9]{4}"`+"\n")
+	store := ndbstore{path: histpath(f.home, "ndb", SESSION)}
+	msgs := []Message{
+		{Role: "user", Content: "mail glenda@example.com or call 555-0199"},
+		{Role: "assistant", Content: "your key sk-abcdefghijklmnop0123 is showing"},
+	}
+	if err := store.Append(msgs...); err != nil {
+		t.Fatal(err)
+	}
+	out, errs, code := f.run("", "-view", "-redact")
+	if code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	for _, secret := range []string{"glenda@", "555-0199", "sk-abc"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("-view -redact shows %q:\n%s", secret, out)
+		}
+	}
+	if n := strings.Count(out, "[redacted]"); n != 3 {
+		t.Errorf("%d masked, want 3:\n%s", n, out)
+	}
+	if got := f.hist(t, "ndb"); got[0].Content != msgs[0].Content || got[1].Content != msgs[1].Content {
+		t.Errorf("history changed: %+v", got)
+	}
+	if out, _, _ := f.run("", "-view"); !strings.Contains(out, "glenda@example.com") {
+		t.Errorf("-view alone masks:\n%s", out)
+	}
+}
+
+// TestDefaults checks that defaults= in the config sets flags that
+// the command line can still override.
+func TestDefaults(t *testing.T) {
+	f := newfixture(t, chatreply("unused"))
+	f.addconfig(t, "defaults= S=true t=0.3\n")
+	for _, c := range []struct {
+		args   []string
+		stream bool
+		temp   float64
+	}{
+		{[]string{"hi"}, true, 0.3},
+		{[]string{"-S=false", "hi"}, false, 0.3},
+		{[]string{"-t", "1", "hi"}, true, 1},
+	} {
+		opts, err := f.parse(t, c.args...)
+		if err != nil {
+			t.Fatalf("%q: %v", c.args, err)
+		}
+		if opts.Stream != c.stream || opts.Temp != c.temp {
+			t.Errorf("%q: stream %v, t %v; want %v, %v", c.args, opts.Stream, opts.Temp, c.stream, c.temp)
+		}
+	}
+
+	f.addconfig(t, "defaults= nosuchflag=1\n")
+	if _, err := f.parse(t, "hi"); err == nil || !strings.Contains(err.Error(), "nosuchflag") {
+		t.Errorf("unknown default: %v", err)
+	}
+}
+
+// TestRunFailOnEmpty checks that an empty reply is a warning, but
+// under -fail-on-empty exit status 5 and not stored.
+func TestRunFailOnEmpty(t *testing.T) {
+	f := newfixture(t, chatreply(" \n"))
+	if _, errs, code := f.run("", "hi"); code != 0 || !strings.Contains(errs, "warning: reply is empty") {
+		t.Errorf("without the flag: exit %d, stderr %q", code, errs)
+	}
+	out, errs, code := f.run("", "-c", "-fail-on-empty", "hi")
+	if code != EXITEMPTY || out != "" || !strings.Contains(errs, "reply is empty") {
+		t.Errorf("-fail-on-empty: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if h := f.hist(t, "ndb"); len(h) != 0 {
+		t.Errorf("stored %+v", h)
+	}
+}
+
+// TestRunConfigPath checks that -config reads the file it names and
+// -show-config shows the settings with the flags over them.
+func TestRunConfigPath(t *testing.T) {
+	f := newfixture(t, chatreply("unused"))
+	path := filepath.Join(t.TempDir(), "other")
+	conf := "provider=alt type=openai url=https://alt.example/v1 keyenv=TEST_KEY model=gpt-4o-mini\ndefaults= t=0.1\n"
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, errs, code := f.run("", "-config", path, "-provider", "alt", "-show-config", "-t", "0.9")
+	if code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	for _, want := range []string{
+		"config=" + quote(path),
+		`endpoint="https://alt.example/v1/chat/completions"`,
+		`m="gpt-4o-mini"`,
+		`t="0.9"`,
+		`key="sk-...cdef"`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("-show-config lacks %s:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "0123456789abcdef") {
+		t.Errorf("-show-config shows the key:\n%s", out)
+	}
+	if _, errs, code := f.run("", "-config", filepath.Join(t.TempDir(), "none"), "-provider", "alt", "-show-config"); code == 0 {
+		t.Errorf("missing provider: exit 0, stderr %q", errs)
+	}
+}
+
+// TestRunStreamToFile checks that -S -o writes each chunk to the file
+// as it comes: the stub holds back the rest of the reply until the
+// first chunk is in the file.
+func TestRunStreamToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reply")
+	seen := false
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"first \"}}]}\n\n")
+		w.(http.Flusher).Flush()
+		for end := time.Now().Add(5 * time.Second); time.Now().Before(end); time.Sleep(5 * time.Millisecond) {
+			if data, _ := os.ReadFile(path); string(data) == "first " {
+				seen = true
+				break
+			}
+		}
+		streamreply("second")(w, r)
+	})
+	out, errs, code := f.run("", "-S", "-o", path, "write it out")
+	if code != 0 || out != "" {
+		t.Fatalf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if !seen {
+		t.Error("the first chunk was not in the file before the second was sent")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "first second\n" {
+		t.Errorf("file %q", data)
+	}
+}
+
+func TestModelname(t *testing.T) {
+	for _, c := range []struct{ base, suffix, want string }{
+		{"gpt-4o-mini", "", "gpt-4o-mini"},
+		{"gpt-4o-mini", "acme::9xyz", "ft:gpt-4o-mini:acme::9xyz"},
+		{"gpt-4o-mini", ":acme::9xyz", "ft:gpt-4o-mini:acme::9xyz"},
+		{"ft:gpt-4o-mini", "acme::9xyz", "ft:gpt-4o-mini:acme::9xyz"},
+	} {
+		if got := modelname(c.base, c.suffix); got != c.want {
+			t.Errorf("modelname(%q, %q) = %q, want %q", c.base, c.suffix, got, c.want)
+		}
+	}
+
+	f := newfixture(t, chatreply("ok"))
+	f.addconfig(t, "alias=mini model=gpt-4o-mini\n")
+	opts, err := f.parse(t, "-m", "mini", "-model-suffix", "acme::9xyz", "-fallback", "gpt-4o", "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Model != "ft:gpt-4o-mini:acme::9xyz" || !reflect.DeepEqual(opts.Fallback, []string{"ft:gpt-4o:acme::9xyz"}) {
+		t.Errorf("model %q, fallbacks %q", opts.Model, opts.Fallback)
+	}
+}
+
+func TestDetectlang(t *testing.T) {
+	for code, want := range map[string]string{
+		"```python\nx = 1\n```":                          "python",
+		"```\npackage main\n\nfunc main() {}\n```":       "go",
+		"#!/usr/bin/env python3\nprint(1)":               "python",
+		"#!/bin/rc\necho $home":                          "rc",
+		`{"a": [1, 2]}`:                                  "json",
+		"fn main() {\n    let mut x = 1;\n}":             "rust",
+		"#include <stdio.h>\nint main(void) {}":          "c",
+		"def f(x):\n    return x":                        "python",
+		"SELECT name FROM users WHERE id = 1;":           "sql",
+		"const f = (x) => x + 1;":                        "javascript",
+		"for f in *.go; do\n\tgofmt -l $f\ndone":         "sh",
+		"<!DOCTYPE html>\n<html></html>":                 "html",
+		"Just some prose, with a function of two words.": "",
+	} {
+		if got := detectlang(code); got != want {
+			t.Errorf("detectlang(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+// TestRunWarnTokens checks that -warn-tokens warns when the tokens
+// left in the rate limit window drop under it, and says when they
+// come back.
+func TestRunWarnTokens(t *testing.T) {
+	hdrs := map[string]string{
+		"x-ratelimit-limit-tokens":     "30000",
+		"x-ratelimit-remaining-tokens": "900",
+		"x-ratelimit-reset-tokens":     "1m30s",
+	}
+	f := newfixture(t, limited(hdrs))
+	_, errs, code := f.run("", "-warn-tokens", "1000", "hi")
+	if code != 0 || !strings.Contains(errs, "900 of 30000 tokens left, the budget resets in 1m30s") {
+		t.Errorf("under: exit %d, stderr %q", code, errs)
+	}
+	if _, errs, _ := f.run("", "-warn-tokens", "500", "hi"); strings.Contains(errs, "tokens left") {
+		t.Errorf("over: stderr %q", errs)
+	}
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	h := http.Header{}
+	if _, low := tokenslow(h, 1000, now); low {
+		t.Error("no headers: low")
+	}
+	h.Set("x-ratelimit-remaining-tokens", "0")
+	h.Set("x-ratelimit-reset-tokens", "30s")
+	if msg, low := tokenslow(h, 1, now); !low || !strings.HasSuffix(msg, "(at 12:00:30)") {
+		t.Errorf("none left: %q, %v", msg, low)
+	}
+}
+
+// TestRunClip checks -clip and -reply-to-clip against a snarf file
+// standing in for the clipboard.
+func TestRunClip(t *testing.T) {
+	snarfile := filepath.Join(t.TempDir(), "snarf")
+	if err := os.WriteFile(snarfile, []byte("prompt from the clipboard"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	oclip := clipboard
+	t.Cleanup(func() { clipboard = oclip })
+	clipboard = func() (Clipboard, error) { return snarf{snarfile}, nil }
+
+	f := newfixture(t, chatreply("reply for the clipboard"))
+	out, errs, code := f.run("", "-clip", "-reply-to-clip")
+	if code != 0 || out != "reply for the clipboard\n" {
+		t.Fatalf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if got := last(f.req(t, 0)); got != "prompt from the clipboard" {
+		t.Errorf("prompt %q", got)
+	}
+	if data, _ := os.ReadFile(snarfile); string(data) != "reply for the clipboard" {
+		t.Errorf("clipboard holds %q", data)
+	}
+
+	clipboard = func() (Clipboard, error) { return nil, errors.New("no clipboard tool found") }
+	if _, errs, code := f.run("", "-clip"); code == 0 || !strings.Contains(errs, "-clip: no clipboard tool found") {
+		t.Errorf("no clipboard: exit %d, stderr %q", code, errs)
+	}
+}
+
+// TestRunArchive checks that each exchange adds one record to the
+// config's archive, and that not being able to write it only warns.
+func TestRunArchive(t *testing.T) {
+	f := newfixture(t, chatreply("archived reply"))
+	path := filepath.Join(t.TempDir(), "archive.jsonl")
+	f.addconfig(t, "archive= file="+path+" format=jsonl\n")
+	for _, p := range []string{"one", "two"} {
+		if _, errs, code := f.run("", "-m", "gpt-4o", "-session", "work", p); code != 0 {
+			t.Fatalf("exit %d, stderr %q", code, errs)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d archive records, want 2:\n%s", len(lines), data)
+	}
+	var rec ArchiveRec
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Session != "work" || rec.Model != "gpt-4o" || rec.Prompt != "two" || rec.Reply != "archived reply" || rec.Time.IsZero() || rec.Usage == nil {
+		t.Errorf("record %+v", rec)
+	}
+
+	f.addconfig(t, "archive= file="+filepath.Join(path, "not-a-dir")+"\n")
+	out, errs, code := f.run("", "three")
+	if code != 0 || out != "archived reply\n" || !strings.Contains(errs, "warning: archive") {
+		t.Errorf("unwritable archive: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+}
+
+// TestRunMaxHistoryBytes checks that a history over -max-history-bytes
+// is loaded from the tail, from the first whole record in it.
+func TestRunMaxHistoryBytes(t *testing.T) {
+	for _, store := range []string{"ndb", "jsonl"} {
+		t.Run(store, func(t *testing.T) {
+			f := newfixture(t, chatreply("ok"))
+			path := histpath(f.home, store, SESSION)
+			s, err := histstores[store].open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				if err := s.Append(Message{Role: []string{"user", "assistant"}[i%2], Content: fmt.Sprintf("message %d", i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.Close()
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.SplitAfter(string(data), "\n")
+			lines = lines[:len(lines)-1]
+			// the last three records and part of the one before
+			max := 5
+			for _, l := range lines[len(lines)-3:] {
+				max += len(l)
+			}
+
+			_, errs, code := f.run("", "-store", store, "-c", "-max-history-bytes", fmt.Sprint(max), "next")
+			if code != 0 || !strings.Contains(errs, fmt.Sprintf("loading only the last %d", max)) {
+				t.Fatalf("exit %d, stderr %q", code, errs)
+			}
+			var got []string
+			for _, m := range f.req(t, 0).Messages {
+				got = append(got, m.Content)
+			}
+			if want := []string{"message 7", "message 8", "message 9", "next"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("sent %q, want %q", got, want)
+			}
+			if _, errs, _ := f.run("", "-store", store, "-c", "-max-history-bytes", "0", "next"); strings.Contains(errs, "loading only") {
+				t.Errorf("-max-history-bytes 0: stderr %q", errs)
+			}
+		})
+	}
+}
+
+// TestRunProvider checks that a named provider in the config sets the
+// URL, the key and how it is sent, and the model.
+func TestRunProvider(t *testing.T) {
+	var paths []string
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/messages") {
+			io.WriteString(w, `{"content":[{"type":"text","text":"from claude"}],"stop_reason":"end_turn"}`)
+			return
+		}
+		chatreply("from llama")(w, r)
+	})
+	f.vars = map[string]string{"WORK_KEY": "sk-ant-work"}
+	f.addconfig(t, "provider=work type=anthropic url="+f.srv.URL+"/v1/ keyenv=WORK_KEY model=claude-3-5-haiku-latest\n"+
+		"provider=local type=ollama url="+f.srv.URL+"/v1 model=llama3\n")
+
+	out, errs, code := f.run("", "-provider", "work", "hi")
+	if code != 0 || out != "from claude\n" {
+		t.Fatalf("work: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	h := f.hdrs[0]
+	if h.Get("x-api-key") != "sk-ant-work" || h.Get("anthropic-version") == "" || h.Get("Authorization") != "" {
+		t.Errorf("work headers %v", h)
+	}
+	if !strings.Contains(f.bodies[0], `"model":"claude-3-5-haiku-latest"`) {
+		t.Errorf("work request %s", f.bodies[0])
+	}
+
+	out, errs, code = f.run("", "-provider", "local", "hi")
+	if code != 0 || out != "from llama\n" {
+		t.Fatalf("local: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	if f.hdrs[1].Get("Authorization") != "" || !strings.Contains(f.bodies[1], `"model":"llama3"`) {
+		t.Errorf("local sent %v %s", f.hdrs[1], f.bodies[1])
+	}
+	if _, _, code := f.run("", "-provider", "local", "-m", "mistral", "hi"); code != 0 || !strings.Contains(f.bodies[2], `"model":"mistral"`) {
+		t.Errorf("-m over the provider's model: %s", f.bodies[2])
+	}
+	if want := []string{"/v1/messages", "/v1/chat/completions", "/v1/chat/completions"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths %q", paths)
+	}
+	if _, errs, code := f.run("", "-provider", "nowhere", "hi"); code == 0 || !strings.Contains(errs, `no provider "nowhere"`) {
+		t.Errorf("unknown provider: exit %d, stderr %q", code, errs)
+	}
+}
+
+// TestRunDryCost checks the per-prompt and total estimates -dry-cost
+// gives for a batch file, without sending any of it.
+func TestRunDryCost(t *testing.T) {
+	f := newfixture(t, chatreply("unsent"))
+	path := filepath.Join(t.TempDir(), "batch")
+	if err := os.WriteFile(path, []byte("# two prompts\nhello world\n\nhi\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, errs, code := f.run("", "-batch", path, "-dry-cost", "-m", "gpt-4o", "-max-tokens", "1000")
+	if code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	// 11 and 8 tokens in at $2.50 a million, up to 1000 out at $10
+	want := "prompt 1\t11 tokens\t$0.0100\nprompt 2\t8 tokens\t$0.0100\ntotal\t19 tokens\t$0.0200\n"
+	if out != want {
+		t.Errorf("stdout\n%s\nwant\n%s", out, want)
+	}
+	if len(f.bodies) != 0 {
+		t.Errorf("-dry-cost sent %d requests", len(f.bodies))
+	}
+	if _, errs, code := f.run("", "-batch", path, "-dry-cost", "-m", "unpriced"); code == 0 || !strings.Contains(errs, "no price known") {
+		t.Errorf("unknown model: exit %d, stderr %q", code, errs)
+	}
+}
+
+// TestRunReplyRole checks that -reply-role stores the reply under
+// that role, and refuses a role that is not a name.
+func TestRunReplyRole(t *testing.T) {
+	f := newfixture(t, chatreply("noted"))
+	for _, store := range []string{"ndb", "jsonl"} {
+		if _, errs, code := f.run("", "-store", store, "-c", "-reply-role", "narrator", "hi"); code != 0 {
+			t.Fatalf("%s: exit %d, stderr %q", store, code, errs)
+		}
+		h := f.hist(t, store)
+		if len(h) != 2 || h[1].Role != "narrator" || h[1].Content != "noted" {
+			t.Errorf("%s history %+v", store, h)
+		}
+	}
+	if _, errs, code := f.run("", "-reply-role", "two words", "hi"); code == 0 || !strings.Contains(errs, "bad -reply-role") {
+		t.Errorf("bad role: exit %d, stderr %q", code, errs)
+	}
+}
+
+// TestPing checks that the providers are pinged at once, fastest
+// first, with the one that is too slow and the one that fails last.
+func TestPing(t *testing.T) {
+	serve := func(delay time.Duration, status int) Provider {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+			w.WriteHeader(status)
+		}))
+		t.Cleanup(srv.Close)
+		return Provider{Type: "openai", URL: srv.URL + "/v1"}
+	}
+	provs := map[string]Provider{
+		"fast":   serve(0, http.StatusOK),
+		"slow":   serve(250*time.Millisecond, http.StatusOK),
+		"hung":   serve(10*time.Second, http.StatusOK),
+		"broken": serve(0, http.StatusInternalServerError),
+	}
+	oclient, ogetenv := client, getenv
+	t.Cleanup(func() { client, getenv = oclient, ogetenv })
+	client, getenv = http.DefaultClient, func(string) string { return "" }
+
+	start := time.Now()
+	pings := ping(provs, 300*time.Millisecond)
+	// one after the other would take over 550ms
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("ping took %v", d)
+	}
+	var names []string
+	for _, p := range pings {
+		names = append(names, p.Name)
+	}
+	if len(pings) != 4 || names[0] != "fast" || names[1] != "slow" || pings[1].Err != nil {
+		t.Fatalf("pings %+v", pings)
+	}
+	for _, p := range pings[2:] {
+		if p.Err == nil {
+			t.Errorf("%s did not fail", p.Name)
+		}
+	}
+	var buf bytes.Buffer
+	printpings(&buf, pings)
+	if !strings.HasPrefix(buf.String(), "fast\t") || !strings.Contains(buf.String(), "\tfastest\nslow\t") || !strings.Contains(buf.String(), "broken\tunreachable: status 500") {
+		t.Errorf("printpings:\n%s", buf.String())
+	}
+}
+
+// TestRunCompactJSON checks that -compact-json squeezes a pretty JSON
+// reply onto one line and passes anything else as it came, unless
+// -strict.
+func TestRunCompactJSON(t *testing.T) {
+	for _, c := range []struct {
+		reply, want string
+		strict      bool
+		code        int
+	}{
+		{"{\n  \"a\": [1, 2],\n  \"b\": {\"c\": \"d e\"}\n}\n", `{"a":[1,2],"b":{"c":"d e"}}` + "\n", false, 0},
+		{"Sure! Here it is.", "Sure! Here it is.\n", false, 0},
+		{"{\"a\": 1,}", "", true, EXITFORMAT},
+	} {
+		f := newfixture(t, chatreply(c.reply))
+		args := []string{"-compact-json", "json please"}
+		if c.strict {
+			args = append([]string{"-strict"}, args...)
+		}
+		out, errs, code := f.run("", args...)
+		if code != c.code || out != c.want {
+			t.Errorf("%q: exit %d, stdout %q, want %d, %q; stderr %q", c.reply, code, out, c.code, c.want, errs)
+		}
+	}
+}
+
+// TestRunSystemEvery checks that -system-every 2 repeats the system
+// prompt before every second user turn of what is sent, and that the
+// history does not get the copies.
+func TestRunSystemEvery(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	hist := []Message{{Role: "system", Content: "Be terse."}}
+	for i := 1; i <= 4; i++ {
+		hist = append(hist, Message{Role: "user", Content: fmt.Sprint("u", i)}, Message{Role: "assistant", Content: fmt.Sprint("a", i)})
+	}
+	store := ndbstore{path: histpath(f.home, "ndb", SESSION)}
+	if err := store.Append(hist...); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs, code := f.run("", "-c", "-system-every", "2", "u5"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	var got []string
+	for _, m := range f.req(t, 0).Messages {
+		if m.Role == "system" {
+			got = append(got, "S")
+		} else {
+			got = append(got, m.Content)
+		}
+	}
+	want := []string{"S", "u1", "a1", "u2", "a2", "S", "u3", "a3", "u4", "a4", "S", "u5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+	if n := len(replayroles(f.hist(t, "ndb"), map[string]bool{"system": true})); n != 1 {
+		t.Errorf("history has %d system messages, want 1", n)
+	}
+	if msgs := interleave(hist[1:], 1); !reflect.DeepEqual(msgs, hist[1:]) {
+		t.Errorf("no system prompt to repeat: %+v", msgs)
+	}
+}
+
+func TestStripthinking(t *testing.T) {
+	for _, c := range []struct{ reply, want string }{
+		{"<think>the user wants 4</think>\n\n4", "4"},
+		{"<think>a</think>Step one.<think>b\nc</think> Step two.", "Step one. Step two."},
+		{"no scratchpad here\n", "no scratchpad here\n"},
+		{"answer <think>never closed", "answer <think>never closed"},
+	} {
+		if got := stripthinking(c.reply, "<think>", "</think>"); got != c.want {
+			t.Errorf("stripthinking(%q) = %q, want %q", c.reply, got, c.want)
+		}
+	}
+	if got := stripthinking("[[x]]done", "[[", "]]"); got != "done" {
+		t.Errorf("other tags: %q", got)
+	}
+
+	f := newfixture(t, chatreply("<reasoning>hmm</reasoning>42"))
+	out, errs, code := f.run("", "-strip-thinking", "-think-tags", "<reasoning>,</reasoning>", "answer")
+	if code != 0 || out != "42\n" {
+		t.Errorf("exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+}
+
+// TestRunAnswerAfter checks that -answer-after prints what follows the
+// last marker, and the whole reply when there is none unless -strict.
+func TestRunAnswerAfter(t *testing.T) {
+	for _, c := range []struct {
+		reply, want string
+		strict      bool
+		code        int
+	}{
+		{"Working: 6*7.\nANSWER: 41?\nno.\nANSWER:  42 \n", "42\n", false, 0},
+		{"just 42", "just 42\n", false, 0},
+		{"just 42", "", true, EXITFORMAT},
+	} {
+		f := newfixture(t, chatreply(c.reply))
+		args := []string{"-answer-after", "ANSWER:", "what is 6*7"}
+		if c.strict {
+			args = append([]string{"-strict"}, args...)
+		}
+		out, errs, code := f.run("", args...)
+		if code != c.code || out != c.want {
+			t.Errorf("%q: exit %d, stdout %q, want %d, %q; stderr %q", c.reply, code, out, c.code, c.want, errs)
+		}
+	}
+}
+
+// TestRunRetryOnEmpty checks that -retry-on-empty resends after an
+// empty reply and prints the one that has something in it.
+func TestRunRetryOnEmpty(t *testing.T) {
+	f := newfixture(t, script(chatreply(""), chatreply(" \n"), chatreply("at last")))
+	out, errs, code := f.run("", "-retry-on-empty", "3", "hi")
+	if code != 0 || out != "at last\n" || len(f.bodies) != 3 {
+		t.Errorf("exit %d after %d requests, stdout %q, stderr %q", code, len(f.bodies), out, errs)
+	}
+	if !strings.Contains(errs, "empty reply; resending (2 of 3)") {
+		t.Errorf("stderr %q", errs)
+	}
+
+	f = newfixture(t, chatreply(""))
+	if _, errs, code := f.run("", "-retry-on-empty", "2", "-fail-on-empty", "hi"); code != EXITEMPTY || len(f.bodies) != 3 {
+		t.Errorf("always empty: exit %d after %d requests, stderr %q", code, len(f.bodies), errs)
+	}
+}
+
+// TestRunSaveRequest checks that -save-request writes the body that
+// was sent byte for byte, behind the traceparent it went under.
+func TestRunSaveRequest(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	saved := filepath.Join(t.TempDir(), "req.json")
+	prompt := "<tags> & \"quotes\", ünïcode\nand a second line"
+	if _, errs, code := f.run("", "-m", "gpt-4o", "-s", "Be terse.", "-save-request", saved, prompt); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	data, err := os.ReadFile(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, tp, err := untrace(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != f.bodies[0] {
+		t.Errorf("saved\n%s\nsent\n%s", body, f.bodies[0])
+	}
+	if tp == "" || tp != f.hdrs[0].Get("traceparent") {
+		t.Errorf("saved traceparent %q, sent %q", tp, f.hdrs[0].Get("traceparent"))
+	}
+	for _, b := range []string{`{}`, `{"model":"m"}`, `[1]`} {
+		got, _, err := untrace(withtrace([]byte(b), "00-x-y-01"))
+		if err != nil || string(got) != b {
+			t.Errorf("round trip of %s: %s, %v", b, got, err)
+		}
+	}
+}
+
+// TestRunLoadRequest checks that -load-request sends the file as it
+// is and prints the reply, streamed when the request asks for it.
+func TestRunLoadRequest(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		name, body string
+		reply      http.HandlerFunc
+	}{
+		{"plain", `{"model":"gpt-4o",  "temperature":0,"messages":[{"role":"user","content":"hi"}],"seed":7}`, chatreply("hello")},
+		{"stream", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`, streamreply("hel", "lo")},
+	} {
+		f := newfixture(t, c.reply)
+		path := filepath.Join(dir, c.name+".json")
+		if err := os.WriteFile(path, []byte(c.body+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		out, errs, code := f.run("", "-load-request", path)
+		if code != 0 || out != "hello\n" {
+			t.Errorf("%s: exit %d, stdout %q, stderr %q", c.name, code, out, errs)
+		}
+		if len(f.bodies) != 1 || f.bodies[0] != c.body {
+			t.Errorf("%s: sent %q, want %q", c.name, f.bodies, c.body)
+		}
+	}
+
+	f := newfixture(t, chatreply("unsent"))
+	path := filepath.Join(dir, "empty.json")
+	if err := os.WriteFile(path, []byte(`{"model":"gpt-4o","messages":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs, code := f.run("", "-load-request", path); code != 1 || !strings.Contains(errs, "no model or no messages") || len(f.bodies) != 0 {
+		t.Errorf("no messages: exit %d, stderr %q", code, errs)
+	}
+}
+
+// TestRender checks the ANSI render gives markdown, and that -render
+// leaves the reply as it is when stdout is not a terminal.
+func TestRender(t *testing.T) {
+	md := "# Title\n- **bold** item\n* `code` item\n```go\nx := 1\n```\nplain"
+	want := ansibold + ansiul + "Title" + ansireset + "\n" +
+		"• " + ansibold + "bold" + ansireset + " item\n" +
+		"• " + ansicode + "code" + ansireset + " item\n" +
+		ansicode + "x := 1" + ansireset + "\n" +
+		"plain"
+	if got := render(md); got != want {
+		t.Errorf("render\n%q\nwant\n%q", got, want)
+	}
+
+	f := newfixture(t, chatreply(md))
+	out, errs, code := f.run("", "-render", "show me")
+	if code != 0 || out != md+"\n" {
+		t.Errorf("not a terminal: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+}
+
+// TestRunFileOrder checks that history goes out in the order of the
+// file's records, which a hand edit moving them about changes, there
+// being no sequence numbers to fall out of step.
+func TestRunFileOrder(t *testing.T) {
+	for _, store := range []string{"ndb", "jsonl"} {
+		t.Run(store, func(t *testing.T) {
+			f := newfixture(t, chatreply("ok"))
+			path := histpath(f.home, store, SESSION)
+			s, err := histstores[store].open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range []string{"one", "two", "three"} {
+				if err := s.Append(Message{Role: "user", Content: c}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.Close()
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// swap the last two records, as an editor would
+			lines := strings.SplitAfter(string(data), "\n")
+			n := len(lines) - 1
+			lines[n-2], lines[n-1] = lines[n-1], lines[n-2]
+			if err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, errs, code := f.run("", "-store", store, "-c", "four"); code != 0 {
+				t.Fatalf("exit %d, stderr %q", code, errs)
+			}
+			var got []string
+			for _, m := range f.req(t, 0).Messages {
+				got = append(got, m.Content)
+			}
+			if want := []string{"one", "three", "two", "four"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("sent %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestRunJSONRetry checks that -strict-json-retry asks again with the
+// bad reply and what was wrong with it, and gives up after its count.
+func TestRunJSONRetry(t *testing.T) {
+	f := newfixture(t, script(chatreply("{'a': 1}"), chatreply(`{"a": 1}`)))
+	out, errs, code := f.run("", "-strict-json-retry", "2", "json please")
+	if code != 0 || out != "{\"a\": 1}\n" || len(f.bodies) != 2 {
+		t.Fatalf("exit %d after %d requests, stdout %q, stderr %q", code, len(f.bodies), out, errs)
+	}
+	msgs := f.req(t, 1).Messages
+	n := len(msgs)
+	if n < 3 || msgs[n-3].Content != "json please" || msgs[n-2].Role != "assistant" || msgs[n-2].Content != "{'a': 1}" ||
+		!strings.Contains(msgs[n-1].Content, "reply is not JSON") {
+		t.Errorf("retry sends %+v", msgs)
+	}
+
+	f = newfixture(t, chatreply("never json"))
+	_, errs, code = f.run("", "-strict-json-retry", "2", "json please")
+	if code != EXITFORMAT || len(f.bodies) != 3 || !strings.Contains(errs, "still no valid JSON after 2 retries") {
+		t.Errorf("always bad: exit %d after %d requests, stderr %q", code, len(f.bodies), errs)
+	}
+}
+
+// TestRunNormalizeRoles checks that -normalize-roles sends an imported
+// transcript's human and ai turns as user and assistant, maps the
+// config's roles, and drops what it cannot place.
+func TestRunNormalizeRoles(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	f.addconfig(t, "role=narrator as=system\n")
+	store := ndbstore{path: histpath(f.home, "ndb", SESSION)}
+	if err := store.Append(
+		Message{Role: "narrator", Content: "A chat."},
+		Message{Role: "Human", Content: "hi"},
+		Message{Role: "ai", Content: "hello"},
+		Message{Role: "tool", Content: "{}"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	_, errs, code := f.run("", "-c", "-normalize-roles", "bye")
+	if code != 0 || !strings.Contains(errs, `dropping unknown role "tool"`) {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	var got []string
+	for _, m := range f.req(t, 0).Messages {
+		got = append(got, m.Role+":"+m.Content)
+	}
+	if want := []string{"system:A chat.", "user:hi", "assistant:hello", "user:bye"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+// TestRunMeta checks that -meta goes in the body's metadata, or under
+// -meta-header in headers instead, and that bad keys are refused.
+func TestRunMeta(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	if _, errs, code := f.run("", "-meta", "team=infra", "-meta", "job_id=42", "hi"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if got := f.req(t, 0).Metadata; !reflect.DeepEqual(got, map[string]string{"team": "infra", "job_id": "42"}) {
+		t.Errorf("metadata %v", got)
+	}
+	if _, errs, code := f.run("", "-meta", "team=infra", "-meta-header", "X-Meta-", "hi"); code != 0 {
+		t.Fatalf("-meta-header: exit %d, stderr %q", code, errs)
+	}
+	if got := f.hdrs[1].Get("X-Meta-team"); got != "infra" || strings.Contains(f.bodies[1], "metadata") {
+		t.Errorf("-meta-header: header %q, body %s", got, f.bodies[1])
+	}
+	for _, bad := range []string{"noequals", "bad key=1", "k=line\nbreak"} {
+		if _, errs, code := f.run("", "-meta", bad, "hi"); code == 0 {
+			t.Errorf("-meta %q: exit 0, stderr %q", bad, errs)
+		}
+	}
+	if len(f.bodies) != 2 {
+		t.Errorf("%d requests, want 2", len(f.bodies))
+	}
+}
+
+// TestRunTruncate checks that -truncate-reply-at cuts the printed
+// reply at that many characters, and the stored one only under
+// -truncate-history.
+func TestRunTruncate(t *testing.T) {
+	for _, c := range []struct {
+		hist   bool
+		stored string
+	}{
+		{false, "ünïcode reply"},
+		{true, "ünïc…"},
+	} {
+		f := newfixture(t, chatreply("ünïcode reply"))
+		args := []string{"-c", "-truncate-reply-at", "5", "hi"}
+		if c.hist {
+			args = append([]string{"-truncate-history"}, args...)
+		}
+		out, errs, code := f.run("", args...)
+		if code != 0 || out != "ünïc…\n" {
+			t.Errorf("exit %d, stdout %q, stderr %q", code, out, errs)
+		}
+		if h := f.hist(t, "ndb"); len(h) != 2 || h[1].Content != c.stored {
+			t.Errorf("-truncate-history %v stored %+v", c.hist, h)
+		}
+	}
+	for s, want := range map[string]string{"short": "short", "exact": "exact", "longer": "long…"} {
+		if got := truncate(s, 5); got != want {
+			t.Errorf("truncate(%q, 5) = %q, want %q", s, got, want)
+		}
+	}
+	if truncate("anything", 0) != "anything" {
+		t.Error("truncate at 0 cut")
+	}
+}
+
+// TestRunAutotitle checks that -autotitle stores the title asked for
+// after a session's first exchange, and only then, and that
+// -list-sessions shows it.
+func TestRunAutotitle(t *testing.T) {
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), titlemsg) {
+			chatreply(`"Rc Shell Basics"`)(w, r)
+			return
+		}
+		chatreply("answer")(w, r)
+	})
+	for _, p := range []string{"what is rc?", "and its quoting?"} {
+		if out, errs, code := f.run("", "-c", "-session", "rc", "-autotitle", p); code != 0 || out != "answer\n" {
+			t.Fatalf("exit %d, stdout %q, stderr %q", code, out, errs)
+		}
+	}
+	if len(f.bodies) != 3 {
+		t.Errorf("%d requests, want two prompts and one title", len(f.bodies))
+	}
+	if req := f.req(t, 1); req.MaxTokens != 16 || last(req) != titlemsg || req.Messages[0].Content != "what is rc?" {
+		t.Errorf("title request %s", f.bodies[1])
+	}
+	if got := readtitle(f.home, "rc"); got != "Rc Shell Basics" {
+		t.Errorf("title %q", got)
+	}
+	out, errs, code := f.run("", "-list-sessions")
+	if code != 0 || !regexp.MustCompile(`(?m)^rc\t\d{4}-\d\d-\d\d \d\d:\d\d\tRc Shell Basics$`).MatchString(out) {
+		t.Errorf("-list-sessions: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+}
+
+// TestRunCompactOnExit checks that -compact-on-exit leaves the ndb
+// history without the record a crash cut short.
+func TestRunCompactOnExit(t *testing.T) {
+	f := newfixture(t, chatreply("fine"))
+	path := histpath(f.home, "ndb", SESSION)
+	hist := verline() + "\n" +
+		`role=user content="first"` + "\n" +
+		`role=assistant content="cut sho` + "\n" +
+		`role=assistant content="whole"` + "\n"
+	if err := os.WriteFile(path, []byte(hist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, errs, code := f.run("", "-c", "-compact-on-exit", "second")
+	if code != 0 || !strings.Contains(errs, "dropped 1 records") {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "cut sho") {
+		t.Errorf("compacted file still has the broken record:\n%s", data)
+	}
+	var got []string
+	for _, m := range f.hist(t, "ndb") {
+		got = append(got, m.Content)
+	}
+	if want := []string{"first", "whole", "second", "fine"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("history %q, want %q", got, want)
+	}
+	if _, errs, _ := f.run("", "-c", "-compact-on-exit", "third"); strings.Contains(errs, "compacted") {
+		t.Errorf("clean file compacted again: %q", errs)
+	}
+}
+
+// TestRunLang checks that -lang adds the instruction to reply in the
+// language after the prompt, and after a -prompt-suffix.
+func TestRunLang(t *testing.T) {
+	f := newfixture(t, chatreply("bonjour"))
+	for _, args := range [][]string{
+		{"-lang", "fr", "hello"},
+		{"-lang", "FR", "-prompt-suffix", " Be brief.", "hello"},
+		{"-lang", "Klingon", "hello"},
+	} {
+		if _, errs, code := f.run("", args...); code != 0 {
+			t.Fatalf("%q: exit %d, stderr %q", args, code, errs)
+		}
+	}
+	for i, want := range []string{
+		"hello\n\nRespond in French.",
+		"hello Be brief.\n\nRespond in French.",
+		"hello\n\nRespond in Klingon.",
+	} {
+		if got := last(f.req(t, i)); got != want {
+			t.Errorf("request %d prompt %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1)).Int63n
+	for attempt := 0; attempt < 8; attempt++ {
+		d := backoff(attempt)
+		if d > RETRYMAX || d <= 0 {
+			t.Fatalf("backoff(%d) = %v", attempt, d)
+		}
+		for i := 0; i < 100; i++ {
+			if j := jitter(d, "full", rnd); j < 0 || j > d {
+				t.Errorf("full jitter of %v: %v", d, j)
+			}
+			if j := jitter(d, "equal", rnd); j < d/2 || j > d {
+				t.Errorf("equal jitter of %v: %v", d, j)
+			}
+		}
+		if j := jitter(d, "none", rnd); j != d {
+			t.Errorf("no jitter of %v: %v", d, j)
+		}
+	}
+	// the ends of the ranges are reached
+	lo := func(int64) int64 { return 0 }
+	hi := func(n int64) int64 { return n - 1 }
+	d := time.Second
+	if jitter(d, "full", lo) != 0 || jitter(d, "full", hi) != d || jitter(d, "equal", lo) != d/2 || jitter(d, "equal", hi) != d {
+		t.Error("jitter range ends")
+	}
+	if backoff(0) != RETRYBASE || backoff(1) != 2*RETRYBASE || backoff(100) != RETRYMAX {
+		t.Errorf("backoff %v %v %v", backoff(0), backoff(1), backoff(100))
+	}
+}
+
+// TestRunRequireHistory checks that -c -require-history stops, naming
+// the session, when it has no history yet, and goes on when it has.
+func TestRunRequireHistory(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	_, errs, code := f.run("", "-c", "-require-history", "-session", "typo", "hi")
+	if code != 1 || !strings.Contains(errs, `-require-history: session "typo" has no history`) || len(f.bodies) != 0 {
+		t.Errorf("missing: exit %d, %d requests, stderr %q", code, len(f.bodies), errs)
+	}
+	if _, errs, code := f.run("", "-c", "hi"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	if _, errs, code := f.run("", "-c", "-require-history", "again"); code != 0 {
+		t.Errorf("present: exit %d, stderr %q", code, errs)
+	}
+	if _, errs, code := f.run("", "-require-history", "hi"); code == 0 || !strings.Contains(errs, "needs -c or -ci") {
+		t.Errorf("without -c: exit %d, stderr %q", code, errs)
+	}
+}
+
+// TestRunMergeRoles checks that -merge-roles joins the -context
+// message and the prompt, both user messages, into one, a line apart,
+// while the history keeps the prompt as it was.
+func TestRunMergeRoles(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	notes := filepath.Join(t.TempDir(), "notes")
+	if err := os.WriteFile(notes, []byte("rc is the shell"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"-context", notes, "again"},
+		{"-merge-roles", "-context", notes, "again"},
+	} {
+		if _, errs, code := f.run("", args...); code != 0 {
+			t.Fatalf("%q: exit %d, stderr %q", args, code, errs)
+		}
+	}
+	if req := f.req(t, 0); len(req.Messages) != 2 || last(req) != "again" {
+		t.Errorf("without -merge-roles: %+v", req.Messages)
+	}
+	req := f.req(t, 1)
+	want := "File: " + notes + "\n\nrc is the shell\nagain"
+	if len(req.Messages) != 1 || req.Messages[0].Role != "user" || last(req) != want {
+		t.Errorf("with -merge-roles: %+v", req.Messages)
+	}
+	if _, errs, code := f.run("", "-c", "-merge-roles", "-context", notes, "once more"); code != 0 {
+		t.Fatalf("-c: exit %d, stderr %q", code, errs)
+	}
+	if h := f.hist(t, "ndb"); len(h) != 2 || h[0].Content != "once more" {
+		t.Errorf("history %+v", h)
+	}
+}
+
+// TestRunReplyHash checks that -reply-hash gives identical replies
+// the same sha256 and different ones different sums.
+func TestRunReplyHash(t *testing.T) {
+	f := newfixture(t, script(chatreply("same"), chatreply("same"), chatreply("other")))
+	var sums []string
+	for i := 0; i < 3; i++ {
+		_, errs, code := f.run("", "-reply-hash", "hi")
+		if code != 0 {
+			t.Fatalf("exit %d, stderr %q", code, errs)
+		}
+		sums = append(sums, strings.TrimSpace(strings.TrimPrefix(errs, "reply-hash: ")))
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256([]byte("same"))); sums[0] != want {
+		t.Errorf("hash of same: %q, want %q", sums[0], want)
+	}
+	if sums[0] != sums[1] || sums[1] == sums[2] {
+		t.Errorf("hashes %q", sums)
+	}
+}
+
+// TestRunDedupe checks that -dedupe adjacent drops only the exchange
+// repeated back to back and -dedupe all every later repeat, keeping
+// the distinct exchanges in their order.
+func TestRunDedupe(t *testing.T) {
+	ex := func(q, a string) []Message {
+		return []Message{{Role: "user", Content: q}, {Role: "assistant", Content: a}}
+	}
+	var msgs []Message
+	msgs = append(msgs, Message{Role: "system", Content: "Be terse."})
+	for _, qa := range [][2]string{{"q1", "a1"}, {"q1", "a1"}, {"q2", "a2"}, {"q1", "a1"}, {"q3", "a3"}} {
+		msgs = append(msgs, ex(qa[0], qa[1])...)
+	}
+	for _, tc := range []struct {
+		mode, removed string
+		want          []string
+	}{
+		{"adjacent", "removed 1 repeated exchanges", []string{"Be terse.", "q1", "a1", "q2", "a2", "q1", "a1", "q3", "a3"}},
+		{"all", "removed 2 repeated exchanges", []string{"Be terse.", "q1", "a1", "q2", "a2", "q3", "a3"}},
+	} {
+		f := newfixture(t, chatreply("ok"))
+		store := ndbstore{path: histpath(f.home, "ndb", SESSION)}
+		if err := store.Append(msgs...); err != nil {
+			t.Fatal(err)
+		}
+		out, errs, code := f.run("", "-dedupe", tc.mode)
+		if code != 0 || !strings.Contains(out, tc.removed) {
+			t.Errorf("%s: exit %d, stdout %q, stderr %q", tc.mode, code, out, errs)
+		}
+		var got []string
+		for _, m := range f.hist(t, "ndb") {
+			got = append(got, m.Content)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: kept %q, want %q", tc.mode, got, tc.want)
+		}
+		if len(f.bodies) != 0 {
+			t.Errorf("%s: sent %d requests", tc.mode, len(f.bodies))
+		}
+	}
+}
+
+// TestPace checks the waits pace shares out as the rate limit runs
+// low, and that -adaptive-rate waits between the prompts of -batch,
+// -batch-jsonl included.
+func TestPace(t *testing.T) {
+	for _, c := range []struct {
+		rl   RateLimit
+		want time.Duration
+	}{
+		{RateLimit{}, 0},
+		{RateLimit{LimitRequests: 100, RemainingRequests: 50, ResetRequests: time.Minute}, 0},
+		{RateLimit{LimitRequests: 100, RemainingRequests: 10, ResetRequests: 11 * time.Second}, time.Second},
+		{RateLimit{LimitRequests: 100, RemainingRequests: 0, ResetRequests: 5 * time.Second}, 5 * time.Second},
+		{RateLimit{LimitRequests: 100, RemainingRequests: 0}, 0},
+		{RateLimit{
+			LimitRequests: 100, RemainingRequests: 9, ResetRequests: 10 * time.Second,
+			LimitTokens: 1000, RemainingTokens: 0, ResetTokens: 30 * time.Second,
+		}, 30 * time.Second},
+	} {
+		if got := pace(c.rl); got != c.want {
+			t.Errorf("pace(%+v) = %v, want %v", c.rl, got, c.want)
+		}
+	}
+
+	low := map[string]string{
+		"x-ratelimit-limit-requests":     "100",
+		"x-ratelimit-remaining-requests": "0",
+		"x-ratelimit-reset-requests":     "20ms",
+	}
+	f := newfixture(t, func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range low {
+			w.Header().Set(k, v)
+		}
+		var req ChatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Stream {
+			streamreply("ok")(w, r)
+			return
+		}
+		chatreply("ok")(w, r)
+	})
+	prompts := filepath.Join(f.home, "prompts")
+	if err := os.WriteFile(prompts, []byte("one\ntwo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"-batch", prompts},
+		{"-batch", prompts, "-batch-jsonl", "input"},
+	} {
+		_, errs, code := f.run("", append(args, "-adaptive-rate")...)
+		if code != 0 || strings.Count(errs, "rate limit running low; waiting 20ms") != 2 {
+			t.Errorf("%q: exit %d, stderr %q", args, code, errs)
+		}
+		if _, errs, _ := f.run("", args...); strings.Contains(errs, "waiting") {
+			t.Errorf("%q without -adaptive-rate: stderr %q", args, errs)
+		}
+	}
+}
+
+// TestRunLineHistory checks that prompts typed at one -ci session
+// with -line-history can be recalled at the next, by !!, !N and !text,
+// and that without it ! lines are sent as they are.
+func TestRunLineHistory(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	if _, errs, code := f.run("first\nsecond\n", "-ci", "-line-history"); code != 0 {
+		t.Fatalf("first session: exit %d, stderr %q", code, errs)
+	}
+	out, errs, code := f.run("!!\n!f\n!1\n!zzz\n!\n", "-ci", "-line-history")
+	if code != 0 {
+		t.Fatalf("second session: exit %d, stderr %q", code, errs)
+	}
+	var got []string
+	for i := 2; i < len(f.bodies); i++ {
+		got = append(got, last(f.req(t, i)))
+	}
+	if want := []string{"second", "first", "first"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recalled %q, want %q", got, want)
+	}
+	if !strings.Contains(errs, "!zzz: not in the line history") || !strings.Contains(errs, "    2  second\n") {
+		t.Errorf("stdout %q, stderr %q", out, errs)
+	}
+	data, err := os.ReadFile(filepath.Join(f.home, HISTDIR, LINEHIST))
+	if err != nil || !strings.HasPrefix(string(data), "first\nsecond\n") {
+		t.Errorf("%s: %q, %v", LINEHIST, data, err)
+	}
+	n := len(f.bodies)
+	if _, errs, code := f.run("!!\n", "-ci"); code != 0 || last(f.req(t, n)) != "!!" {
+		t.Errorf("without -line-history: exit %d, stderr %q, sent %q", code, errs, f.bodies[n:])
+	}
+}
+
+// TestRunDoc checks that -doc sends the file as the prompt and appends
+// the reply after a --- line, so the next run sends the grown document.
+func TestRunDoc(t *testing.T) {
+	f := newfixture(t, script(chatreply("Part one."), chatreply("Part two.\n")))
+	doc := filepath.Join(t.TempDir(), "notes.md")
+	if err := os.WriteFile(doc, []byte("# Notes\nWrite on."), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, errs, code := f.run("", "-doc", doc); code != 0 {
+			t.Fatalf("run %d: exit %d, stderr %q", i+1, code, errs)
+		}
+	}
+	if p := last(f.req(t, 0)); p != "# Notes\nWrite on." {
+		t.Errorf("first prompt %q", p)
+	}
+	if p := last(f.req(t, 1)); p != "# Notes\nWrite on.\n\n---\n\nPart one.\n" {
+		t.Errorf("second prompt %q", p)
+	}
+	data, err := os.ReadFile(doc)
+	if want := "# Notes\nWrite on.\n\n---\n\nPart one.\n\n---\n\nPart two.\n"; err != nil || string(data) != want {
+		t.Errorf("document %q, %v, want %q", data, err, want)
+	}
+}
+
+// TestRunOrgProject checks that OpenAI-Project goes alongside
+// OpenAI-Organization when a project is set, by flag or environment,
+// and that neither header is sent unset.
+func TestRunOrgProject(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	runs := []struct {
+		vars         map[string]string
+		args         []string
+		org, project string
+	}{
+		{nil, nil, "", ""},
+		{nil, []string{"-org", "org-1"}, "org-1", ""},
+		{nil, []string{"-org", "org-1", "-project", "proj_1"}, "org-1", "proj_1"},
+		{map[string]string{"OPENAI_ORG_ID": "org-env", "OPENAI_PROJECT": "proj_env"}, nil, "org-env", "proj_env"},
+		{map[string]string{"OPENAI_PROJECT": "proj_env"}, []string{"-project", "proj_flag"}, "", "proj_flag"},
+	}
+	for i, r := range runs {
+		f.vars = r.vars
+		if _, errs, code := f.run("", append(r.args, "hi")...); code != 0 {
+			t.Fatalf("%q: exit %d, stderr %q", r.args, code, errs)
+		}
+		h := f.hdrs[i]
+		if _, has := h["Openai-Organization"]; has != (r.org != "") || h.Get("OpenAI-Organization") != r.org {
+			t.Errorf("%q: OpenAI-Organization %q, want %q", r.args, h.Values("OpenAI-Organization"), r.org)
+		}
+		if _, has := h["Openai-Project"]; has != (r.project != "") || h.Get("OpenAI-Project") != r.project {
+			t.Errorf("%q: OpenAI-Project %q, want %q", r.args, h.Values("OpenAI-Project"), r.project)
+		}
+	}
+}
+
+// TestRunSplit checks that -split prints each part of the reply under
+// a numbered line, blank parts dropped, and that with -split-dir it
+// writes N parts to part-1 ... part-N instead.
+func TestRunSplit(t *testing.T) {
+	f := newfixture(t, chatreply("one\n===\n\n===\ntwo\nlines\n===\nthree\n"))
+	out, errs, code := f.run("", "-split", "===", "hi")
+	if want := "--- part 1\none\n--- part 2\ntwo\nlines\n--- part 3\nthree\n"; code != 0 || out != want {
+		t.Errorf("printed: exit %d, stdout %q, stderr %q, want %q", code, out, errs, want)
+	}
+	dir := filepath.Join(t.TempDir(), "parts")
+	out, errs, code = f.run("", "-split", "===", "-split-dir", dir, "hi")
+	if code != 0 || out != "" {
+		t.Fatalf("-split-dir: exit %d, stdout %q, stderr %q", code, out, errs)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "part-*"))
+	if err != nil || len(names) != 3 {
+		t.Fatalf("wrote %q, %v", names, err)
+	}
+	for i, want := range []string{"one\n", "two\nlines\n", "three\n"} {
+		path := filepath.Join(dir, fmt.Sprintf("part-%d", i+1))
+		if data, err := os.ReadFile(path); err != nil || string(data) != want {
+			t.Errorf("%s: %q, %v, want %q", path, data, err, want)
+		}
+		if !strings.Contains(errs, path+"\n") {
+			t.Errorf("stderr %q does not name %s", errs, path)
+		}
+	}
+}
+
+// TestRunReplyStats checks the counts -reply-stats prints: characters
+// rather than bytes, words, and a last line without a newline counted.
+func TestRunReplyStats(t *testing.T) {
+	f := newfixture(t, chatreply("ça va\nbien, merci"))
+	out, errs, code := f.run("", "-reply-stats", "hi")
+	if want := "reply-stats: 17 chars, 4 words, 2 lines\n"; code != 0 || errs != want {
+		t.Errorf("exit %d, stderr %q, want %q", code, errs, want)
+	}
+	if out != "ça va\nbien, merci\n" {
+		t.Errorf("stdout %q", out)
+	}
+	for _, c := range []struct {
+		s                   string
+		chars, words, lines int
+	}{
+		{"", 0, 0, 0},
+		{"one\n", 4, 1, 1},
+		{"a b\n\nc", 6, 3, 3},
+	} {
+		if ch, w, l := textstats(c.s); ch != c.chars || w != c.words || l != c.lines {
+			t.Errorf("textstats(%q) = %d, %d, %d, want %d, %d, %d", c.s, ch, w, l, c.chars, c.words, c.lines)
+		}
+	}
+}
+
+// TestRunFromLast checks that -from-last puts the session's latest
+// reply, under -reply-role if given, before the instruction, and is
+// an error when there is none.
+func TestRunFromLast(t *testing.T) {
+	f := newfixture(t, chatreply("ok"))
+	_, errs, code := f.run("", "-from-last", "Now translate the above")
+	if code == 0 || !strings.Contains(errs, "-from-last: the llm history has no reply") || len(f.bodies) != 0 {
+		t.Errorf("no history: exit %d, %d requests, stderr %q", code, len(f.bodies), errs)
+	}
+	store := ndbstore{path: histpath(f.home, "ndb", SESSION)}
+	msgs := append(convo(),
+		Message{Role: "user", Content: "And acme?"},
+		Message{Role: "assistant", Content: "\nA text editor.\n"},
+		Message{Role: "user", Content: "Thanks"},
+		Message{Role: "model", Content: "From the other model."})
+	if err := store.Append(msgs...); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs, code := f.run("", "-from-last", "Now translate the above"); code != 0 {
+		t.Fatalf("exit %d, stderr %q", code, errs)
+	}
+	req := f.req(t, 0)
+	if len(req.Messages) != 1 || last(req) != "A text editor.\n\nNow translate the above" {
+		t.Errorf("sent %+v", req.Messages)
+	}
+	if _, errs, code := f.run("", "-from-last", "-reply-role", "model", "Shorter"); code != 0 {
+		t.Fatalf("-reply-role: exit %d, stderr %q", code, errs)
+	}
+	if p := last(f.req(t, 1)); p != "From the other model.\n\nShorter" {
+		t.Errorf("-reply-role model: sent %q", p)
+	}
+}
+
+// TestRunQuiet checks that -q silences warnings and the retry notes
+// but not errors or the reports flags ask for.
+func TestRunQuiet(t *testing.T) {
+	args := []string{"-m", "gpt-3.5-turbo", "-effort", "low", "-retries", "1", "hi"}
+	f := newfixture(t, failfirst(1, http.StatusInternalServerError, chatreply("ok")))
+	if _, errs, code := f.run("", args...); code != 0 || !strings.Contains(errs, "warning: gpt-3.5-turbo does not take -effort") || !strings.Contains(errs, "retrying in") {
+		t.Errorf("without -q: exit %d, stderr %q", code, errs)
+	}
+	f = newfixture(t, failfirst(1, http.StatusInternalServerError, chatreply("ok")))
+	out, errs, code := f.run("", append([]string{"-q"}, args...)...)
+	if code != 0 || errs != "" || out != "ok\n" || len(f.bodies) != 2 {
+		t.Errorf("-q: exit %d, %d requests, stdout %q, stderr %q", code, len(f.bodies), out, errs)
+	}
+	if _, errs, _ := f.run("", "-q", "-reply-hash", "hi"); !strings.HasPrefix(errs, "reply-hash: ") {
+		t.Errorf("-q -reply-hash: stderr %q", errs)
+	}
+	f = newfixture(t, apierror(http.StatusBadRequest, "invalid_request_error", "bad request"))
+	if _, errs, code := f.run("", "-q", "hi"); code == 0 || !strings.Contains(errs, "[ERROR]") {
+		t.Errorf("-q error: exit %d, stderr %q", code, errs)
+	}
+}